@@ -5,6 +5,8 @@ go 1.12
 require (
 	github.com/container-storage-interface/spec v1.1.0
 	github.com/golang/mock v1.2.0
+	github.com/golang/protobuf v1.2.0
+	github.com/prometheus/client_golang v0.9.2
 	github.com/tebeka/go2xunit v1.4.10
 	google.golang.org/grpc v1.22.0
 	gopkg.in/yaml.v2 v2.2.2
@@ -20,22 +20,80 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	driver "github.com/ibm/ibm-block-csi-driver/node/pkg/driver"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
 	"k8s.io/klog"
 )
 
+const defaultConfigFile = "./common/config.yaml"
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func main() {
 	var (
-		endpoint = flag.String("csi-endpoint", "unix://csi/csi.sock", "CSI Endpoint")
-		version  = flag.Bool("version", false, "Print the version and exit.")
-		configFile  = flag.String("config-file-path",  "./common/config.yaml", "Shared config file.")
-		hostname  = flag.String("hostname",  "host-dns-name", "The name of the host the node is running on.")
+		endpoint      = flag.String("csi-endpoint", "unix://csi/csi.sock", "CSI Endpoint")
+		version       = flag.Bool("version", false, "Print the version and exit.")
+		validate      = flag.Bool("validate-config", false, "Validate the config file, print all problems and exit.")
+		configFile    = flag.String("config-file-path", defaultConfigFile, "Shared config file. Defaults to $"+driver.EnvNameDriverConfFile+" when set.")
+		configWatch   = flag.Duration("config-watch-interval", driver.DefaultConfigWatchInterval, "How often to check the config files for changes and reload them. 0 disables the watch, SIGHUP always reloads.")
+		configDir     = flag.String("config-dir", "", "Directory of per-node *.yaml config files applied over the shared config file in lexical order. Defaults to "+driver.DefaultConfigDropInDir+" next to the config file.")
+		hostname      = flag.String("hostname", "", "The Kubernetes name of the node. Defaults to $"+driver.EnvNameNodeName+", $"+driver.EnvNameKubeNodeName+" or the OS host name, mapped to the array host name by node.host_name of the config file.")
+		execMode      = flag.String("exec-mode", executor.ExecModeDirect, "How to run host tools: direct (in the container), nsenter (in the host mount namespace, requires hostPID) or chroot (into --exec-chroot-dir).")
+		execChrootDir = flag.String("exec-chroot-dir", "", "The host root file system mounted in the container, used by --exec-mode=chroot. Defaults to the host root, or "+executor.DefaultChrootDir+" when the host root is \"/\".")
+		hostRoot      = flag.String("host-root", "", "Directory the host root file system is mounted on in the container. Overrides node.host_root of the config file.")
+		healthPort    = flag.Int("health-port", 0, "HTTP port to serve /healthz and /readyz on. 0 disables the endpoints.")
+		logFormat     = flag.String("log-format", logging.FormatText, "Log format, text (klog) or json. JSON lines carry the request id, RPC name, volume id and node id of the request.")
+		traceExporter = flag.String("tracing-exporter", "none", "Where to export traces of the RPCs and host commands: none or file (JSON lines appended to --tracing-endpoint).")
+		traceEndpoint = flag.String("tracing-endpoint", "", "Trace file path of the file exporter.")
+		gracePeriod   = flag.Duration("shutdown-grace-period", driver.DefaultShutdownGracePeriod, "How long to wait for in-flight RPCs on SIGTERM or SIGINT before stopping the server forcibly.")
+		tlsCertFile   = flag.String("tls-cert-file", "", "TLS certificate of a tcp:// CSI endpoint. Reloaded when the file changes.")
+		tlsKeyFile    = flag.String("tls-key-file", "", "TLS private key of a tcp:// CSI endpoint.")
+		tlsClientCA   = flag.String("tls-client-ca-file", "", "CA bundle to verify client certificates with (mutual TLS).")
+		insecureTCP   = flag.Bool("insecure-tcp", false, "Allow a plaintext tcp:// CSI endpoint without TLS.")
+		socketMode    = flag.String("socket-mode", "", "Octal permissions of a unix:// CSI endpoint socket, such as 0660. Defaults to the process umask, or 0660 with --socket-group.")
+		socketGroup   = flag.String("socket-group", "", "Group name or id that owns a unix:// CSI endpoint socket.")
+		metricsPort   = flag.Int("metrics-port", 0, "HTTP port to serve Prometheus metrics on at /metrics. May be the same as --health-port. 0 disables the metrics.")
 	)
 
+	var configOverrides stringList
+	flag.Var(&configOverrides, "set", "Config field override as path=value, such as node.stale_device_gc.mode=report. Repeatable, wins over the config files and the "+driver.ConfigEnvPrefix+"* environment variables.")
+
 	klog.InitFlags(nil)
 	flag.Parse()
-	
+	if !isFlagSet("config-file-path") {
+		if path := os.Getenv(driver.EnvNameDriverConfFile); path != "" {
+			*configFile = path
+		}
+	}
+	if err := logging.SetFormat(*logFormat); err != nil {
+		klog.Fatalln(err)
+	}
 
 	if *version {
 		info, err := driver.GetVersionJSON(*configFile)
@@ -46,11 +104,87 @@ func main() {
 		os.Exit(0)
 	}
 
-	drv, err := driver.NewDriver(*endpoint, *configFile, *hostname)
+	// klog keeps the -v level to itself, a reloaded config without node.log_verbosity restores it.
+	// flag.Parse already rejected a -v that is no number
+	logVerbosity, _ := strconv.Atoi(flag.Lookup("v").Value.String())
+
+	var mode uint64
+	if *socketMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(*socketMode, 8, 32); err != nil {
+			logging.Fatalf("Invalid --socket-mode %q: %v", *socketMode, err)
+		}
+	}
+
+	options := driver.DriverOptions{
+		Endpoint:            *endpoint,
+		ConfigFilePath:      *configFile,
+		ConfigDropInDir:     *configDir,
+		ConfigOverrides:     configOverrides,
+		ConfigWatchInterval: *configWatch,
+		LogVerbosity:        logVerbosity,
+		Hostname:            *hostname,
+		ExecMode:            *execMode,
+		ExecChrootDir:       *execChrootDir,
+		HostRoot:            *hostRoot,
+		HealthPort:          *healthPort,
+		MetricsPort:         *metricsPort,
+		TracingExporter:     *traceExporter,
+		TracingEndpoint:     *traceEndpoint,
+		TLSCertFile:         *tlsCertFile,
+		TLSKeyFile:          *tlsKeyFile,
+		TLSClientCAFile:     *tlsClientCA,
+		InsecureTCP:         *insecureTCP,
+		SocketMode:          os.FileMode(mode),
+		SocketGroup:         *socketGroup,
+	}
+
+	if *validate {
+		if _, err := driver.LoadConfig(options.ConfigSources()); err != nil {
+			if validationErr, ok := err.(*driver.ConfigValidationError); ok {
+				fmt.Fprintf(os.Stderr, "Config file %s is invalid:\n", *configFile)
+				for _, problem := range validationErr.Problems {
+					fmt.Fprintf(os.Stderr, "  %s\n", problem)
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("Config file %s is valid\n", *configFile)
+		os.Exit(0)
+	}
+
+	drv, err := driver.NewDriver(options)
 	if err != nil {
-		klog.Fatalln(err)
+		logging.Fatalf("%v", err)
 	}
-	if err := drv.Run(); err != nil {
-		klog.Fatalln(err)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- drv.Run()
+	}()
+
+	for {
+		select {
+		case err := <-runErr:
+			if err != nil {
+				logging.Fatalf("%v", err)
+			}
+			return
+		case sig := <-signals:
+			logging.Infof("Received signal %v", sig)
+			if sig == syscall.SIGHUP {
+				drv.ReloadConfig()
+				continue
+			}
+			drv.Shutdown(*gracePeriod)
+			if err := <-runErr; err != nil {
+				logging.Errorf("%v", err)
+			}
+			return
+		}
 	}
 }
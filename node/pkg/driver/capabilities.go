@@ -0,0 +1,109 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+var (
+	// defaultNodeCaps are advertised when the config file lists no node capabilities
+	defaultNodeCaps = []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	}
+)
+
+// pluginCapabilities returns the plugin capabilities of the node plugin: the service capabilities
+// of the node section by their CSI enum names, and the volume expansion type ONLINE or OFFLINE of
+// the identity section if set. The service capabilities of the identity section are the ones of
+// the controller plugin, which serves CONTROLLER_SERVICE.
+func pluginCapabilities(config ConfigFile) ([]*csi.PluginCapability, error) {
+	serviceTypes, err := pluginServiceTypes("node.plugin_capabilities", config.Node.Plugin_capabilities)
+	if err != nil {
+		return nil, err
+	}
+	var caps []*csi.PluginCapability
+	for _, serviceType := range serviceTypes {
+		if serviceType == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+			return nil, fmt.Errorf("node.plugin_capabilities: %s is served by the controller plugin", serviceType)
+		}
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: serviceType,
+				},
+			},
+		})
+	}
+
+	if name := config.Identity.Volume_expansion; name != "" {
+		value, ok := csi.PluginCapability_VolumeExpansion_Type_value[name]
+		if !ok || value == int32(csi.PluginCapability_VolumeExpansion_UNKNOWN) {
+			return nil, fmt.Errorf("identity.volume_expansion: must be ONLINE or OFFLINE, got %q", name)
+		}
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_Type(value),
+				},
+			},
+		})
+	}
+	return caps, nil
+}
+
+// pluginServiceTypes parses the plugin service capabilities of the config at the path.
+func pluginServiceTypes(path string, names []string) ([]csi.PluginCapability_Service_Type, error) {
+	var serviceTypes []csi.PluginCapability_Service_Type
+	seen := map[string]bool{}
+	for _, name := range names {
+		value, ok := csi.PluginCapability_Service_Type_value[name]
+		if !ok || value == int32(csi.PluginCapability_Service_UNKNOWN) {
+			return nil, fmt.Errorf("%s: unknown plugin capability %q", path, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s: duplicate plugin capability %q", path, name)
+		}
+		seen[name] = true
+		serviceTypes = append(serviceTypes, csi.PluginCapability_Service_Type(value))
+	}
+	return serviceTypes, nil
+}
+
+// nodeCapabilities returns the node RPC capabilities listed by their CSI enum names in the node
+// section, or the default ones if none are listed.
+func nodeCapabilities(config ConfigFile) ([]csi.NodeServiceCapability_RPC_Type, error) {
+	if len(config.Node.Capabilities) == 0 {
+		return defaultNodeCaps, nil
+	}
+	var caps []csi.NodeServiceCapability_RPC_Type
+	seen := map[string]bool{}
+	for _, name := range config.Node.Capabilities {
+		value, ok := csi.NodeServiceCapability_RPC_Type_value[name]
+		if !ok || value == int32(csi.NodeServiceCapability_RPC_UNKNOWN) {
+			return nil, fmt.Errorf("node.capabilities: unknown node capability %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("node.capabilities: duplicate node capability %q", name)
+		}
+		seen[name] = true
+		caps = append(caps, csi.NodeServiceCapability_RPC_Type(value))
+	}
+	return caps, nil
+}
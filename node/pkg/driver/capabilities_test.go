@@ -0,0 +1,132 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func serviceCap(t csi.PluginCapability_Service_Type) *csi.PluginCapability {
+	return &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: t}},
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	testCases := []struct {
+		name         string
+		capabilities []string
+		expansion    string
+		expCaps      []*csi.PluginCapability
+		expErr       bool
+	}{
+		{name: "none"},
+		{name: "controller service", capabilities: []string{"CONTROLLER_SERVICE"}, expErr: true},
+		{
+			name:         "topology and online expansion",
+			capabilities: []string{"VOLUME_ACCESSIBILITY_CONSTRAINTS"},
+			expansion:    "ONLINE",
+			expCaps: []*csi.PluginCapability{
+				serviceCap(csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS),
+				{
+					Type: &csi.PluginCapability_VolumeExpansion_{
+						VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+					},
+				},
+			},
+		},
+		{name: "unknown capability", capabilities: []string{"SNAPSHOTS"}, expErr: true},
+		{name: "unknown enum value", capabilities: []string{"UNKNOWN"}, expErr: true},
+		{name: "lower case", capabilities: []string{"controller_service"}, expErr: true},
+		{name: "duplicate", capabilities: []string{"VOLUME_ACCESSIBILITY_CONSTRAINTS", "VOLUME_ACCESSIBILITY_CONSTRAINTS"}, expErr: true},
+		{name: "unknown expansion", expansion: "LIVE", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Driver{nodeService: newTestNodeService(nil)}
+			// the capabilities of the controller plugin are not advertised by the node plugin
+			d.configYaml.Identity.Capabilities = []string{"CONTROLLER_SERVICE"}
+			d.configYaml.Node.Plugin_capabilities = tc.capabilities
+			d.configYaml.Identity.Volume_expansion = tc.expansion
+
+			if _, err := pluginCapabilities(d.configYaml); (err != nil) != tc.expErr {
+				t.Fatalf("Expected error %v, got %v", tc.expErr, err)
+			}
+			resp, err := d.GetPluginCapabilities(context.TODO(), &csi.GetPluginCapabilitiesRequest{})
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Capabilities, tc.expCaps) {
+				t.Fatalf("Expected capabilities %v, got %v", tc.expCaps, resp.Capabilities)
+			}
+		})
+	}
+}
+
+func TestNodeCapabilities(t *testing.T) {
+	testCases := []struct {
+		name         string
+		capabilities []string
+		expCaps      []csi.NodeServiceCapability_RPC_Type
+		expErr       bool
+	}{
+		{name: "default", expCaps: []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME}},
+		{
+			name:         "stage and expand",
+			capabilities: []string{"STAGE_UNSTAGE_VOLUME", "EXPAND_VOLUME"},
+			expCaps:      []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME, csi.NodeServiceCapability_RPC_EXPAND_VOLUME},
+		},
+		{name: "plugin capability", capabilities: []string{"CONTROLLER_SERVICE"}, expErr: true},
+		{name: "duplicate", capabilities: []string{"GET_VOLUME_STATS", "GET_VOLUME_STATS"}, expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestNodeService(nil)
+			d.configYaml.Node.Capabilities = tc.capabilities
+
+			resp, err := d.NodeGetCapabilities(context.TODO(), &csi.NodeGetCapabilitiesRequest{})
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			var caps []csi.NodeServiceCapability_RPC_Type
+			for _, cap := range resp.Capabilities {
+				caps = append(caps, cap.GetRpc().GetType())
+			}
+			if !reflect.DeepEqual(caps, tc.expCaps) {
+				t.Fatalf("Expected capabilities %v, got %v", tc.expCaps, caps)
+			}
+		})
+	}
+}
@@ -0,0 +1,587 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ConfigEnvPrefix is the prefix of the environment variables that set config fields, the rest
+	// of the name is the upper case YAML path joined with "_", e.g. IBM_CSI_NODE_STALE_DEVICE_GC_MODE
+	ConfigEnvPrefix = "IBM_CSI_"
+	// DefaultConfigDropInDir is the drop-in directory name next to the config file
+	DefaultConfigDropInDir = "conf.d"
+
+	redactedValue = "<redacted>"
+
+	unknownFieldSuffix = ": unknown field"
+)
+
+var (
+	// secretConfigKeys are substrings of the keys whose values are redacted when the config is logged
+	secretConfigKeys = []string{"password", "secret", "token", "credential", "private_key"}
+
+	yamlLinePrefix = regexp.MustCompile(`^line \d+: `)
+	// yamlUnknownField matches the strict decoding error of an unknown key
+	yamlUnknownField = regexp.MustCompile(`field (\S+) not found in type `)
+)
+
+// ConfigSources are the layers of the config. Every layer overrides the fields it sets in the
+// previous ones: the built-in defaults, the shared config file, the drop-in files, the IBM_CSI_
+// environment variables and finally the overrides of the command line.
+type ConfigSources struct {
+	File string
+	// DropInDir holds per-node *.yaml files applied in lexical order, empty means conf.d next to File
+	DropInDir string
+	// Environ is the environment in the form of os.Environ
+	Environ []string
+	// Overrides are path=value settings such as node.stale_device_gc.mode=report
+	Overrides []string
+}
+
+// paths returns the config file and the drop-in directory with their defaults.
+func (sources ConfigSources) paths() (string, string) {
+	configYamlPath := sources.File
+	if configYamlPath == "" {
+		configYamlPath = DefualtConfigFile
+	}
+	dropInDir := sources.DropInDir
+	if dropInDir == "" {
+		dropInDir = filepath.Join(filepath.Dir(configYamlPath), DefaultConfigDropInDir)
+	}
+	return configYamlPath, dropInDir
+}
+
+func ReadConfigFile(configFilePath string) (ConfigFile, error) {
+	return LoadConfig(ConfigSources{File: configFilePath})
+}
+
+// defaultConfig returns the built-in defaults, the first layer of the config.
+func defaultConfig() ConfigFile {
+	var config ConfigFile
+	config.Controller.Publish_context_lun_parameter = "PUBLISH_CONTEXT_LUN"
+	config.Controller.Publish_context_connectivity_parameter = "PUBLISH_CONTEXT_CONNECTIVITY"
+
+	node := &config.Node
+	node.Journal_dir = DefaultJournalDir
+	node.Stage_info_dir = DefaultStageInfoDir
+	node.Kubelet_dir = DefaultKubeletDir
+	node.Stale_device_gc.Mode = GCModeDisabled
+	node.Stale_device_gc.Interval = DefaultGCInterval
+	node.Stale_device_gc.Min_stale_age = DefaultGCMinStaleAge
+	node.Stale_device_gc.Max_removals_per_run = DefaultGCMaxRemovalsPerRun
+	node.Journal_recovery.Retry_interval = DefaultJournalRetryInterval
+	node.Journal_recovery.Max_age = DefaultJournalMaxAge
+	node.Orphan_dir_cleanup.Policy = CleanupPolicyDisabled
+	node.Orphan_dir_cleanup.Interval = DefaultCleanupInterval
+	node.Orphan_dir_cleanup.Min_age = DefaultCleanupMinAge
+	node.Health.Check_iscsid = true
+	node.Health.Check_multipathd = true
+	node.Health.Required_kernel_modules = append([]string{}, DefaultRequiredKernelModules...)
+	node.Metrics.Collect_interval = DefaultMetricsCollectInterval
+	node.Reachability.Interval = DefaultReachabilityInterval
+	node.Reachability.Timeout = DefaultReachabilityTimeout
+	return config
+}
+
+// LoadConfig merges all layers of the config and validates the result. All problems of all layers
+// are returned at once in a ConfigValidationError.
+func LoadConfig(sources ConfigSources) (ConfigFile, error) {
+	configYamlPath, dropInDir := sources.paths()
+	if sources.File == "" {
+		logging.V(4).Infof("Not found config file environment variable %s. Set default value %s.", EnvNameDriverConfFile, configYamlPath)
+	} else {
+		logging.V(4).Infof("Config file environment variable %s=%s", EnvNameDriverConfFile, configYamlPath)
+	}
+
+	config := defaultConfig()
+	yamlFile, err := ioutil.ReadFile(configYamlPath)
+	if err != nil {
+		logging.Errorf("failed to read file %q: %v", configYamlPath, err)
+		return ConfigFile{}, err
+	}
+	problems, parsed := decodeConfigLayer(configYamlPath, yamlFile, &config)
+
+	dropIns, err := filepath.Glob(filepath.Join(dropInDir, "*.yaml"))
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	sort.Strings(dropIns)
+	for _, dropIn := range dropIns {
+		data, err := ioutil.ReadFile(dropIn)
+		if err != nil {
+			return ConfigFile{}, err
+		}
+		logging.V(4).Infof("Applying config drop-in %s", dropIn)
+		dropInProblems, ok := decodeConfigLayer(dropIn, data, &config)
+		problems = append(problems, dropInProblems...)
+		parsed = parsed && ok
+	}
+
+	var envVars []string
+	for _, env := range sources.Environ {
+		if strings.HasPrefix(env, ConfigEnvPrefix) {
+			envVars = append(envVars, env)
+		}
+	}
+	sort.Strings(envVars)
+	for _, env := range envVars {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		keys, fieldType, ok := configPathFromEnv(reflect.TypeOf(config), strings.TrimPrefix(parts[0], ConfigEnvPrefix))
+		if !ok {
+			// Kubernetes injects variables of its own with the prefix, e.g. IBM_CSI_METRICS_SERVICE_HOST
+			// for a service named ibm-csi-metrics, so unknown variables are not fatal as unknown keys are
+			logging.Warningf("Ignoring environment variable %s, it sets no config field", parts[0])
+			continue
+		}
+		problems = append(problems, setConfigValue(parts[0], keys, fieldType, parts[1], &config)...)
+	}
+
+	for _, override := range sources.Overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			problems = append(problems, fmt.Sprintf("%s: expected path=value", override))
+			continue
+		}
+		keys, fieldType, ok := configPathFromKeys(reflect.TypeOf(config), strings.Split(parts[0], "."))
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: no such config field", parts[0]))
+			continue
+		}
+		problems = append(problems, setConfigValue(parts[0], keys, fieldType, parts[1], &config)...)
+	}
+
+	// the fields of a layer that is not valid YAML were not applied, so they would be reported as missing
+	if parsed {
+		problems = append(problems, validateConfig(config)...)
+	}
+	if len(problems) > 0 {
+		err := &ConfigValidationError{Problems: problems}
+		logging.Errorf("Invalid config: %v", err)
+		return ConfigFile{}, err
+	}
+	return config, nil
+}
+
+// parseConfig decodes a single config file over the built-in defaults and validates it.
+func parseConfig(data []byte) (ConfigFile, error) {
+	config := defaultConfig()
+	problems, parsed := decodeConfigLayer("", data, &config)
+	if parsed {
+		problems = append(problems, validateConfig(config)...)
+	}
+	if len(problems) > 0 {
+		return ConfigFile{}, &ConfigValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+// decodeConfigLayer decodes a YAML document strictly over the config, it returns the problems
+// prefixed with the source name if one is given, and false if the document is not valid YAML.
+func decodeConfigLayer(source string, data []byte, config *ConfigFile) ([]string, bool) {
+	var problems []string
+	addProblem := func(problem string) {
+		if source != "" {
+			problem = source + ": " + problem
+		}
+		problems = append(problems, problem)
+	}
+
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		addProblem(err.Error())
+		return problems, false
+	}
+	unknownKeys, typeProblems := checkConfigTree(tree, reflect.TypeOf(*config), "")
+	reportedKeys := map[string]bool{}
+	for _, problem := range unknownKeys {
+		path := strings.TrimSuffix(problem, unknownFieldSuffix)
+		reportedKeys[path[strings.LastIndex(path, ".")+1:]] = true
+		addProblem(problem)
+	}
+
+	// The strict decoding checks the layer on its own, decoding it over the previous layers would
+	// reject map keys they set, then the layer is merged leniently
+	var layer ConfigFile
+	if err := yaml.UnmarshalStrict(data, &layer); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			addProblem(err.Error())
+			return problems, false
+		}
+		for _, msg := range typeErr.Errors {
+			// unknown keys that were already reported with their paths are not reported twice
+			if match := yamlUnknownField.FindStringSubmatch(msg); match != nil && reportedKeys[match[1]] {
+				continue
+			}
+			// type errors are reported by the YAML path of their value instead of its line
+			msg, typeProblems = takeTypeProblem(msg, typeProblems)
+			addProblem(msg)
+		}
+	}
+	// the errors were reported by the strict decoding
+	yaml.Unmarshal(data, config)
+	return problems, true
+}
+
+// setConfigValue sets the field at the YAML keys to a value of the environment or command line.
+// Values of string fields are taken as is, other values are parsed as YAML, e.g. "[a, b]" for a list.
+func setConfigValue(source string, keys []string, fieldType reflect.Type, raw string, config *ConfigFile) []string {
+	var value interface{} = raw
+	if fieldType.Kind() != reflect.String {
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+			return []string{fmt.Sprintf("%s: %v", source, err)}
+		}
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		value = yaml.MapSlice{{Key: keys[i], Value: value}}
+	}
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", source, err)}
+	}
+	var problems []string
+	layerProblems, _ := decodeConfigLayer("", data, config)
+	for _, problem := range layerProblems {
+		// the source names the path already, and the line numbers of the generated document mean
+		// nothing to the user
+		problem = strings.TrimPrefix(problem, strings.Join(keys, ".")+": ")
+		problems = append(problems, fmt.Sprintf("%s: %s", source, yamlLinePrefix.ReplaceAllString(problem, "")))
+	}
+	return problems
+}
+
+// configPathFromEnv resolves the name of an environment variable without the prefix, such as
+// NODE_STALE_DEVICE_GC_MODE, to the YAML keys and type of the field. Field names contain "_" too,
+// so every field whose name is a prefix of the variable name is tried.
+func configPathFromEnv(structType reflect.Type, name string) ([]string, reflect.Type, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key := configKey(field)
+		fieldName := strings.ToUpper(key)
+		if name == fieldName && field.Type.Kind() != reflect.Struct && field.Type.Kind() != reflect.Map {
+			return []string{key}, field.Type, true
+		}
+		if !strings.HasPrefix(name, fieldName+"_") {
+			continue
+		}
+		rest := strings.TrimPrefix(name, fieldName+"_")
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			if keys, fieldType, ok := configPathFromEnv(field.Type, rest); ok {
+				return append([]string{key}, keys...), fieldType, true
+			}
+		case reflect.Map:
+			return []string{key, strings.ToLower(rest)}, field.Type.Elem(), true
+		}
+	}
+	return nil, nil, false
+}
+
+// configPathFromKeys resolves a dotted YAML path, already split into keys, to the type of the field.
+func configPathFromKeys(structType reflect.Type, keys []string) ([]string, reflect.Type, bool) {
+	field, ok := configField(structType, keys[0])
+	if !ok {
+		return nil, nil, false
+	}
+	switch {
+	case field.Type.Kind() == reflect.Struct && len(keys) > 1:
+		if _, fieldType, ok := configPathFromKeys(field.Type, keys[1:]); ok {
+			return keys, fieldType, true
+		}
+	case field.Type.Kind() == reflect.Map && len(keys) == 2:
+		return keys, field.Type.Elem(), true
+	case field.Type.Kind() != reflect.Struct && field.Type.Kind() != reflect.Map && len(keys) == 1:
+		return keys, field.Type, true
+	}
+	return nil, nil, false
+}
+
+// redactedConfig returns the config as YAML with the values of secret keys replaced.
+func redactedConfig(config ConfigFile) string {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err.Error()
+	}
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return err.Error()
+	}
+	data, err = yaml.Marshal(redactConfigTree(tree))
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func redactConfigTree(tree yaml.MapSlice) yaml.MapSlice {
+	redacted := make(yaml.MapSlice, 0, len(tree))
+	for _, item := range tree {
+		key := strings.ToLower(fmt.Sprintf("%v", item.Key))
+		if subtree, ok := item.Value.(yaml.MapSlice); ok {
+			item.Value = redactConfigTree(subtree)
+		} else {
+			for _, secret := range secretConfigKeys {
+				if strings.Contains(key, secret) && item.Value != nil && item.Value != "" {
+					item.Value = redactedValue
+					break
+				}
+			}
+		}
+		redacted = append(redacted, item)
+	}
+	return redacted
+}
+
+// checkConfigTree returns the keys of the YAML mapping that have no field in the struct type, and
+// the type errors of the values that do not decode into their fields, by their YAML paths.
+func checkConfigTree(tree yaml.MapSlice, structType reflect.Type, path string) ([]string, []string) {
+	var unknownKeys, typeProblems []string
+	for _, item := range tree {
+		key := fmt.Sprintf("%v", item.Key)
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		field, ok := configField(structType, key)
+		if !ok {
+			unknownKeys = append(unknownKeys, keyPath+unknownFieldSuffix)
+			continue
+		}
+		subtree, isTree := item.Value.(yaml.MapSlice)
+		switch {
+		case isTree && field.Type.Kind() == reflect.Struct:
+			unknown, types := checkConfigTree(subtree, field.Type, keyPath)
+			unknownKeys = append(unknownKeys, unknown...)
+			typeProblems = append(typeProblems, types...)
+		case isTree && field.Type.Kind() == reflect.Map:
+			// the keys of the map are names, e.g. of node.reachability.arrays or node.command_timeouts
+			for _, entry := range subtree {
+				entryPath := fmt.Sprintf("%s.%v", keyPath, entry.Key)
+				entryTree, ok := entry.Value.(yaml.MapSlice)
+				if !ok || field.Type.Elem().Kind() != reflect.Struct {
+					typeProblems = append(typeProblems, configValueTypeProblems(entryPath, entry.Value, field.Type.Elem())...)
+					continue
+				}
+				unknown, types := checkConfigTree(entryTree, field.Type.Elem(), entryPath)
+				unknownKeys = append(unknownKeys, unknown...)
+				typeProblems = append(typeProblems, types...)
+			}
+		default:
+			typeProblems = append(typeProblems, configValueTypeProblems(keyPath, item.Value, field.Type)...)
+		}
+	}
+	return unknownKeys, typeProblems
+}
+
+// configValueTypeProblems decodes a value of the YAML tree into the type of its field and returns
+// the type errors prefixed with the YAML path of the value.
+func configValueTypeProblems(path string, value interface{}, fieldType reflect.Type) []string {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	typeErr, ok := yaml.Unmarshal(data, reflect.New(fieldType).Interface()).(*yaml.TypeError)
+	if !ok {
+		return nil
+	}
+	var problems []string
+	for _, msg := range typeErr.Errors {
+		// the line numbers of the encoded value mean nothing to the user
+		problems = append(problems, path+": "+yamlLinePrefix.ReplaceAllString(msg, ""))
+	}
+	return problems
+}
+
+// takeTypeProblem returns the problem of the type problems that reports the strict decoding error
+// msg by its YAML path, and the type problems without it. The yaml package reports the error by the
+// line of the value, msg is returned as is if no type problem matches it.
+func takeTypeProblem(msg string, typeProblems []string) (string, []string) {
+	suffix := ": " + yamlLinePrefix.ReplaceAllString(msg, "")
+	for i, problem := range typeProblems {
+		if strings.HasSuffix(problem, suffix) {
+			return problem, append(typeProblems[:i:i], typeProblems[i+1:]...)
+		}
+	}
+	return msg, typeProblems
+}
+
+// configField returns the struct field a YAML key decodes into, by the lower case field name as
+// the yaml package does.
+func configField(structType reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if configKey(field) == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func configKey(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+// validateConfig returns the problems of the decoded config file prefixed with their YAML paths.
+func validateConfig(config ConfigFile) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	notEmpty := func(path string, value string) {
+		if strings.TrimSpace(value) == "" {
+			addf("%s: must not be empty", path)
+		}
+	}
+	notNegative := func(path string, value time.Duration) {
+		if value < 0 {
+			addf("%s: must not be negative, got %v", path, value)
+		}
+	}
+	absolutePath := func(path string, value string) {
+		if value != "" && !filepath.IsAbs(value) {
+			addf("%s: must be an absolute path, got %q", path, value)
+		}
+	}
+	oneOf := func(path string, value string, allowed ...string) {
+		if value == "" {
+			return
+		}
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		addf("%s: must be one of %s, got %q", path, strings.Join(allowed, ", "), value)
+	}
+
+	notEmpty("identity.name", config.Identity.Name)
+	notEmpty("identity.version", config.Identity.Version)
+	if _, err := pluginServiceTypes("identity.capabilities", config.Identity.Capabilities); err != nil {
+		addf("%v", err)
+	}
+	if _, err := pluginCapabilities(config); err != nil {
+		addf("%v", err)
+	}
+
+	notEmpty("controller.publish_context_lun_parameter", config.Controller.Publish_context_lun_parameter)
+	notEmpty("controller.publish_context_connectivity_parameter", config.Controller.Publish_context_connectivity_parameter)
+
+	node := config.Node
+	if _, err := nodeCapabilities(config); err != nil {
+		addf("%v", err)
+	}
+	if node.Log_verbosity != nil && *node.Log_verbosity < 0 {
+		addf("node.log_verbosity: must not be negative, got %d", *node.Log_verbosity)
+	}
+	if _, err := parseHostNameTemplate(node.Host_name.Template); err != nil {
+		addf("node.host_name.template: %v", err)
+	}
+	var nodeNames []string
+	for nodeName := range node.Host_name.Mapping {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	for _, nodeName := range nodeNames {
+		if err := validateArrayHostName(node.Host_name.Mapping[nodeName]); err != nil {
+			addf("node.host_name.mapping.%s: %v", nodeName, err)
+		}
+	}
+	var segmentKeys []string
+	for key := range node.Topology.Segments {
+		segmentKeys = append(segmentKeys, key)
+	}
+	sort.Strings(segmentKeys)
+	for _, key := range segmentKeys {
+		if err := validateTopologySegment(key, node.Topology.Segments[key]); err != nil {
+			addf("node.topology.segments.%s: %v", key, err)
+		}
+	}
+	var commands []string
+	for command := range node.Command_timeouts {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		if timeout := node.Command_timeouts[command]; timeout <= 0 {
+			addf("node.command_timeouts.%s: must be positive, got %v", command, timeout)
+		}
+	}
+	absolutePath("node.host_root", node.Host_root)
+	absolutePath("node.journal_dir", node.Journal_dir)
+	absolutePath("node.stage_info_dir", node.Stage_info_dir)
+	absolutePath("node.kubelet_dir", node.Kubelet_dir)
+
+	oneOf("node.stale_device_gc.mode", node.Stale_device_gc.Mode, GCModeDisabled, GCModeReport, GCModeRemove)
+	notNegative("node.stale_device_gc.interval", node.Stale_device_gc.Interval)
+	notNegative("node.stale_device_gc.min_stale_age", node.Stale_device_gc.Min_stale_age)
+	if node.Stale_device_gc.Max_removals_per_run < 0 {
+		addf("node.stale_device_gc.max_removals_per_run: must not be negative, got %d", node.Stale_device_gc.Max_removals_per_run)
+	}
+
+	notNegative("node.journal_recovery.retry_interval", node.Journal_recovery.Retry_interval)
+	notNegative("node.journal_recovery.max_age", node.Journal_recovery.Max_age)
+	oneOf("node.orphan_dir_cleanup.policy", node.Orphan_dir_cleanup.Policy, CleanupPolicyDisabled, CleanupPolicyReport, CleanupPolicyRemove)
+	notNegative("node.orphan_dir_cleanup.interval", node.Orphan_dir_cleanup.Interval)
+	notNegative("node.orphan_dir_cleanup.min_age", node.Orphan_dir_cleanup.Min_age)
+
+	for i, module := range node.Health.Required_kernel_modules {
+		notEmpty(fmt.Sprintf("node.health.required_kernel_modules[%d]", i), module)
+	}
+	notNegative("node.metrics.collect_interval", node.Metrics.Collect_interval)
+
+	oneOf("node.array_type", node.Array_type, ArrayTypeSvc, ArrayTypeA9000)
+	oneOf("node.max_volumes.source", node.Max_volumes.Source, MaxVolumesSourceStatic, MaxVolumesSourceArrayType, MaxVolumesSourceRemainingLunIds)
+	if node.Max_volumes.Source == MaxVolumesSourceStatic && node.Max_volumes.Static <= 0 {
+		addf("node.max_volumes.static: must be positive with the static source, got %d", node.Max_volumes.Static)
+	} else if node.Max_volumes.Static < 0 {
+		addf("node.max_volumes.static: must not be negative, got %d", node.Max_volumes.Static)
+	}
+
+	notNegative("node.reachability.interval", node.Reachability.Interval)
+	if node.Reachability.Timeout <= 0 {
+		addf("node.reachability.timeout: must be positive, got %v", node.Reachability.Timeout)
+	}
+	var arrays []string
+	for array := range node.Reachability.Arrays {
+		arrays = append(arrays, array)
+	}
+	sort.Strings(arrays)
+	for _, array := range arrays {
+		for _, problem := range validateArrayEndpoints(array, node.Reachability.Arrays[array]) {
+			addf("node.reachability.arrays.%s: %s", array, problem)
+		}
+	}
+	return problems
+}
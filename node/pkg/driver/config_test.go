@@ -0,0 +1,340 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const validTestConfig = `
+identity:
+   name: ibm-block-csi-driver
+   version: 1.0.0
+controller:
+   publish_context_lun_parameter: "PUBLISH_CONTEXT_LUN"
+   publish_context_connectivity_parameter: "PUBLISH_CONTEXT_CONNECTIVITY"
+`
+
+func TestReadConfigFileShared(t *testing.T) {
+	path, err := getConfigFilePath()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Expected the shared config file to be valid, got %v", err)
+	}
+	if config.Controller != defaultConfig().Controller {
+		t.Fatalf("Expected the publish context keys of the default config, got %+v", config.Controller)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	testCases := []struct {
+		name        string
+		yaml        string
+		expProblems []string
+	}{
+		{name: "valid", yaml: validTestConfig},
+		{
+			name: "unknown keys",
+			yaml: validTestConfig + `
+   publish_context_lun_paramter: "PUBLISH_CONTEXT_LUN"
+node:
+   stale_device_gc:
+      intervall: 10m
+extra: true
+`,
+			expProblems: []string{
+				"controller.publish_context_lun_paramter: unknown field",
+				"node.stale_device_gc.intervall: unknown field",
+				"extra: unknown field",
+			},
+		},
+		{
+			name: "unknown key of a map value",
+			yaml: validTestConfig + `
+node:
+   reachability:
+      arrays:
+         array-1:
+            iscsi_portals: [10.0.0.1]
+            fc_target_port: [500507680b21ac2e]
+`,
+			expProblems: []string{"node.reachability.arrays.array-1.fc_target_port: unknown field"},
+		},
+		{
+			name: "invalid values",
+			yaml: `
+identity:
+   name: ""
+   version: 1.0.0
+   capabilities: [CONTROLLER_SERVICE, SNAPSHOTS]
+controller:
+   publish_context_lun_parameter: " "
+   publish_context_connectivity_parameter: "PUBLISH_CONTEXT_CONNECTIVITY"
+node:
+   journal_dir: journal
+   command_timeouts:
+      iscsiadm: 0s
+   stale_device_gc:
+      mode: delete
+      max_removals_per_run: -1
+   orphan_dir_cleanup:
+      min_age: -1h
+   health:
+      required_kernel_modules: [""]
+   host_name:
+      mapping:
+         worker-1: "k8s;worker-1"
+      template: "{{ .NodeName"
+   array_type: DS8000
+   max_volumes:
+      source: static
+`,
+			expProblems: []string{
+				"identity.name: must not be empty",
+				`identity.capabilities: unknown plugin capability "SNAPSHOTS"`,
+				"controller.publish_context_lun_parameter: must not be empty",
+				"node.host_name.template: template: host_name:1: unclosed action",
+				`node.host_name.mapping.worker-1: "k8s;worker-1" must start with a letter or digit and contain only letters, digits, '.', '_' and '-'`,
+				"node.command_timeouts.iscsiadm: must be positive, got 0s",
+				`node.journal_dir: must be an absolute path, got "journal"`,
+				`node.stale_device_gc.mode: must be one of disabled, report, remove, got "delete"`,
+				"node.stale_device_gc.max_removals_per_run: must not be negative, got -1",
+				"node.orphan_dir_cleanup.min_age: must not be negative, got -1h0m0s",
+				"node.health.required_kernel_modules[0]: must not be empty",
+				`node.array_type: must be one of SVC, A9000, got "DS8000"`,
+				"node.max_volumes.static: must be positive with the static source, got 0",
+			},
+		},
+		{
+			name: "bad duration",
+			yaml: validTestConfig + `
+node:
+   metrics:
+      collect_interval: 1 minute
+`,
+			expProblems: []string{"node.metrics.collect_interval: cannot unmarshal !!str `1 minute` into time.Duration"},
+		},
+		{
+			name: "bad values",
+			yaml: validTestConfig + `
+node:
+   health:
+      check_iscsid: "maybe"
+   reachability:
+      arrays:
+         array-1:
+            iscsi_portals: 10.0.0.1
+         array-2: none
+   command_timeouts:
+      mkfs: [10m]
+`,
+			expProblems: []string{
+				"node.health.check_iscsid: cannot unmarshal !!str `maybe` into bool",
+				"node.reachability.arrays.array-1.iscsi_portals: cannot unmarshal !!str `10.0.0.1` into []string",
+				"node.reachability.arrays.array-2: cannot unmarshal !!str `none` into driver.ArrayEndpoints",
+				"node.command_timeouts.mkfs: cannot unmarshal !!seq into time.Duration",
+				"node.reachability.arrays.array-1: must have iscsi_portals or fc_target_ports",
+			},
+		},
+		{
+			name:        "syntax error",
+			yaml:        "identity: [",
+			expProblems: []string{"yaml: line 1: did not find expected node content"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tc.yaml))
+			if tc.expProblems == nil {
+				if err != nil {
+					t.Fatalf("err is not nil. got: %v", err)
+				}
+				return
+			}
+			validationErr, ok := err.(*ConfigValidationError)
+			if !ok {
+				t.Fatalf("Expected a ConfigValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(validationErr.Problems, tc.expProblems) {
+				t.Fatalf("Expected problems:\n%s\ngot:\n%s", strings.Join(tc.expProblems, "\n"), strings.Join(validationErr.Problems, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseConfigValues(t *testing.T) {
+	config, err := parseConfig([]byte(validTestConfig + `
+node:
+   command_timeouts:
+      default: 30s
+   orphan_dir_cleanup:
+      policy: report
+`))
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if config.Node.Command_timeouts["default"] != 30*time.Second || config.Node.Orphan_dir_cleanup.Policy != CleanupPolicyReport {
+		t.Fatalf("Unexpected config %+v", config.Node)
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	writeTestFile(t, configPath, []byte(validTestConfig+`
+node:
+   command_timeouts:
+      default: 30s
+      iscsiadm: 30s
+   stale_device_gc:
+      mode: report
+      interval: 1m
+   orphan_dir_cleanup:
+      policy: report
+`), time.Now())
+	if err := os.Mkdir(filepath.Join(dir, DefaultConfigDropInDir), 0755); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, DefaultConfigDropInDir, "20-second.yaml"), []byte("node:\n   stale_device_gc:\n      interval: 3m\n"), time.Now())
+	writeTestFile(t, filepath.Join(dir, DefaultConfigDropInDir, "10-first.yaml"), []byte("node:\n   stale_device_gc:\n      interval: 2m\n      mode: remove\n   command_timeouts:\n      iscsiadm: 1m\n"), time.Now())
+	writeTestFile(t, filepath.Join(dir, DefaultConfigDropInDir, "ignored.txt"), []byte("not yaml: ["), time.Now())
+
+	config, err := LoadConfig(ConfigSources{
+		File: configPath,
+		Environ: []string{
+			"PATH=/usr/bin",
+			"IBM_CSI_NODE_STALE_DEVICE_GC_MODE=disabled",
+			"IBM_CSI_NODE_ORPHAN_DIR_CLEANUP_POLICY=remove",
+			"IBM_CSI_NODE_HEALTH_REQUIRED_KERNEL_MODULES=[iscsi_tcp]",
+			"IBM_CSI_IDENTITY_VERSION=2.0",
+			// service link variables of a service named ibm-csi-metrics
+			"IBM_CSI_METRICS_SERVICE_HOST=10.0.0.1",
+			"IBM_CSI_METRICS_PORT=tcp://10.0.0.1:9080",
+		},
+		Overrides: []string{"node.orphan_dir_cleanup.policy=disabled"},
+	})
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	node := config.Node
+	if node.Stale_device_gc.Interval != 3*time.Minute {
+		t.Fatalf("Expected the last drop-in to win, got interval %v", node.Stale_device_gc.Interval)
+	}
+	if node.Stale_device_gc.Mode != GCModeDisabled {
+		t.Fatalf("Expected the environment to win over the drop-ins, got mode %q", node.Stale_device_gc.Mode)
+	}
+	if node.Orphan_dir_cleanup.Policy != CleanupPolicyDisabled {
+		t.Fatalf("Expected the override to win over the environment, got policy %q", node.Orphan_dir_cleanup.Policy)
+	}
+	expTimeouts := map[string]time.Duration{"default": 30 * time.Second, "iscsiadm": time.Minute}
+	if !reflect.DeepEqual(node.Command_timeouts, expTimeouts) {
+		t.Fatalf("Expected command timeouts %v, got %v", expTimeouts, node.Command_timeouts)
+	}
+	if !reflect.DeepEqual(node.Health.Required_kernel_modules, []string{"iscsi_tcp"}) {
+		t.Fatalf("Unexpected kernel modules %v", node.Health.Required_kernel_modules)
+	}
+	if config.Identity.Version != "2.0" {
+		t.Fatalf("Expected the string version 2.0, got %q", config.Identity.Version)
+	}
+	if node.Journal_dir != DefaultJournalDir || node.Orphan_dir_cleanup.Min_age != DefaultCleanupMinAge {
+		t.Fatalf("Expected the built-in defaults for unset fields, got %+v", node)
+	}
+
+	_, err = LoadConfig(ConfigSources{
+		File:      configPath,
+		Environ:   []string{"IBM_CSI_NODE_STALE_DEVICE_GC_MODEL=report", "IBM_CSI_NODE_METRICS_COLLECT_INTERVAL=soon"},
+		Overrides: []string{"node.health", "node.healthy=true"},
+	})
+	validationErr, ok := err.(*ConfigValidationError)
+	if !ok {
+		t.Fatalf("Expected a ConfigValidationError, got %v", err)
+	}
+	expProblems := []string{
+		"IBM_CSI_NODE_METRICS_COLLECT_INTERVAL: cannot unmarshal !!str `soon` into time.Duration",
+		"node.health: expected path=value",
+		"node.healthy: no such config field",
+	}
+	if !reflect.DeepEqual(validationErr.Problems, expProblems) {
+		t.Fatalf("Expected problems:\n%s\ngot:\n%s", strings.Join(expProblems, "\n"), strings.Join(validationErr.Problems, "\n"))
+	}
+}
+
+func TestConfigPathFromEnv(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expKeys []string
+	}{
+		{name: "IDENTITY_NAME", expKeys: []string{"identity", "name"}},
+		{name: "CONTROLLER_PUBLISH_CONTEXT_LUN_PARAMETER", expKeys: []string{"controller", "publish_context_lun_parameter"}},
+		{name: "NODE_STALE_DEVICE_GC_MAX_REMOVALS_PER_RUN", expKeys: []string{"node", "stale_device_gc", "max_removals_per_run"}},
+		{name: "NODE_COMMAND_TIMEOUTS_XFS_GROWFS", expKeys: []string{"node", "command_timeouts", "xfs_growfs"}},
+		{name: "NODE_STALE_DEVICE_GC"},
+		{name: "NODE"},
+		{name: "NODE_UNKNOWN"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, _, ok := configPathFromEnv(reflect.TypeOf(ConfigFile{}), tc.name)
+			if ok != (tc.expKeys != nil) || !reflect.DeepEqual(keys, tc.expKeys) {
+				t.Fatalf("Expected keys %v, got %v, %v", tc.expKeys, keys, ok)
+			}
+		})
+	}
+}
+
+func TestRedactConfigTree(t *testing.T) {
+	tree := yaml.MapSlice{
+		{Key: "name", Value: "node-1"},
+		{Key: "array", Value: yaml.MapSlice{
+			{Key: "password", Value: "passw0rd"},
+			{Key: "api_token", Value: "abc"},
+			{Key: "client_secret", Value: ""},
+		}},
+	}
+	expTree := yaml.MapSlice{
+		{Key: "name", Value: "node-1"},
+		{Key: "array", Value: yaml.MapSlice{
+			{Key: "password", Value: redactedValue},
+			{Key: "api_token", Value: redactedValue},
+			{Key: "client_secret", Value: ""},
+		}},
+	}
+	if redacted := redactConfigTree(tree); !reflect.DeepEqual(redacted, expTree) {
+		t.Fatalf("Expected %v, got %v", expTree, redacted)
+	}
+	if !strings.Contains(redactedConfig(defaultConfig()), "journal_dir: "+DefaultJournalDir) {
+		t.Fatalf("Expected the journal dir in the effective config")
+	}
+}
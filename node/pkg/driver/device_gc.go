@@ -0,0 +1,575 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+// Modes of the stale device garbage collector
+const (
+	GCModeDisabled = "disabled"
+	GCModeReport   = "report"
+	GCModeRemove   = "remove"
+
+	DefaultGCInterval          = 10 * time.Minute
+	DefaultGCMinStaleAge       = 30 * time.Minute
+	DefaultGCMaxRemovalsPerRun = 5
+)
+
+const (
+	ibmScsiVendor         = "IBM"
+	multipathDmUuidPrefix = "mpath-"
+	sysBlockPath          = "/sys/block"
+)
+
+var (
+	// SCSI models of the supported IBM storage systems: 2145 - Spectrum Virtualize family, 2810 - A9000 and XIV
+	ibmScsiModelPrefixes = []string{"2145", "2810"}
+)
+
+// ibmDevice is an IBM volume device on the host: a multipath map with its SCSI paths, or a single
+// SCSI device that is not part of a multipath map.
+type ibmDevice struct {
+	Name         string // dm-N or sdX
+	MultipathMap string // empty for a single SCSI device
+	Wwid         string
+	ScsiDevices  []string
+}
+
+func (s ibmDevice) String() string {
+	if s.MultipathMap != "" {
+		return fmt.Sprintf("multipath map %s (%s, wwid %s, paths %v)", s.MultipathMap, s.Name, s.Wwid, s.ScsiDevices)
+	}
+	return fmt.Sprintf("scsi device %s (wwid %s)", s.Name, s.Wwid)
+}
+
+// deviceGC removes, or reports, stale IBM devices. A device is removed only after it was stale in
+// consecutive runs for at least minStaleAge, so devices of a stage in progress are never touched.
+// The devices of the volumes kubelet tracks are never stale, an unmounted device attached by hand
+// is. Report mode lists the devices remove mode would remove.
+type deviceGC struct {
+	mode              string
+	dryRun            bool
+	minStaleAge       time.Duration
+	maxRemovalsPerRun int
+	firstSeenStale    map[string]time.Time
+	clock             func() time.Time
+}
+
+func newDeviceGC(mode string, dryRun bool, minStaleAge time.Duration, maxRemovalsPerRun int) *deviceGC {
+	gc := &deviceGC{
+		firstSeenStale: map[string]time.Time{},
+		clock:          time.Now,
+	}
+	gc.configure(mode, dryRun, minStaleAge, maxRemovalsPerRun)
+	return gc
+}
+
+// configure changes the settings of the garbage collector, the devices seen stale are kept.
+func (gc *deviceGC) configure(mode string, dryRun bool, minStaleAge time.Duration, maxRemovalsPerRun int) {
+	if minStaleAge <= 0 {
+		minStaleAge = DefaultGCMinStaleAge
+	}
+	if maxRemovalsPerRun <= 0 {
+		maxRemovalsPerRun = DefaultGCMaxRemovalsPerRun
+	}
+	gc.mode = mode
+	gc.dryRun = dryRun
+	gc.minStaleAge = minStaleAge
+	gc.maxRemovalsPerRun = maxRemovalsPerRun
+}
+
+// runStaleDeviceGC runs the garbage collector every interval until stopCh is closed. The settings
+// are read from the current config on every run, so a config reload can enable or disable it.
+func (d *nodeService) runStaleDeviceGC(stopCh <-chan struct{}) {
+	gc := newDeviceGC(GCModeDisabled, false, 0, 0)
+	for {
+		interval := d.currentConfig().Node.Stale_device_gc.Interval
+		if interval <= 0 {
+			interval = DefaultGCInterval
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		gcConfig := d.currentConfig().Node.Stale_device_gc
+		mode := gcConfig.Mode
+		if mode == "" {
+			mode = GCModeDisabled
+		}
+		if mode != gc.mode || gcConfig.Dry_run != gc.dryRun {
+			logging.Infof("Stale device garbage collector runs in %s mode (dry run %v) with interval %v", mode, gcConfig.Dry_run, interval)
+		}
+		gc.configure(mode, gcConfig.Dry_run, gcConfig.Min_stale_age, gcConfig.Max_removals_per_run)
+		if mode == GCModeDisabled {
+			continue
+		}
+		if err := d.collectStaleDevices(context.Background(), gc); err != nil {
+			logging.Errorf("Stale device garbage collection failed: %v", err)
+		}
+	}
+}
+
+// collectStaleDevices runs one garbage collection pass. The devices of the volumes of the node
+// operations in the journal are skipped, they are in progress or left to their recovery.
+func (d *nodeService) collectStaleDevices(ctx context.Context, gc *deviceGC) error {
+	pendingDevices, err := d.pendingDevices()
+	if err != nil {
+		return err
+	}
+
+	stale, err := d.findStaleDevices()
+	if err != nil {
+		return err
+	}
+
+	now := gc.clock()
+	stillStale := map[string]time.Time{}
+	removals := 0
+	for _, device := range stale {
+		if pendingDevices[normalizeWwid(device.Wwid)] || pendingDevices[device.Name] {
+			logging.V(4).Infof("Skipping stale %s, a node operation of its volume is pending", device)
+			continue
+		}
+		firstSeen, ok := gc.firstSeenStale[device.Name]
+		if !ok {
+			firstSeen = now
+		}
+		stillStale[device.Name] = firstSeen
+
+		if gc.mode != GCModeRemove {
+			logging.Warningf("Found stale %s", device)
+			continue
+		}
+		if now.Sub(firstSeen) < gc.minStaleAge {
+			logging.V(4).Infof("Found stale %s, waiting %v before removing it", device, gc.minStaleAge-now.Sub(firstSeen))
+			continue
+		}
+		if removals >= gc.maxRemovalsPerRun {
+			logging.V(4).Infof("Reached %d removals in this run, %s is left for the next run", gc.maxRemovalsPerRun, device)
+			continue
+		}
+		removals++
+		if gc.dryRun {
+			logging.Infof("Dry run: would remove stale %s", device)
+			continue
+		}
+		if err := d.removeStaleDevice(ctx, device); err != nil {
+			logging.Errorf("Failed to remove stale %s: %v", device, err)
+			continue
+		}
+		delete(stillStale, device.Name)
+		logging.Infof("Removed stale %s", device)
+	}
+	gc.firstSeenStale = stillStale
+	return nil
+}
+
+// pendingDevices returns the WWNs and device names of the node operations in the journal.
+func (d *nodeService) pendingDevices() (map[string]bool, error) {
+	pending := map[string]bool{}
+	if d.journal == nil {
+		return pending, nil
+	}
+	ops, err := d.journal.Pending()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		// stale device removals are recorded by the wwid of the device, other operations by volume ID
+		if wwn := volumeWwn(op.VolumeId); wwn != "" {
+			pending[wwn] = true
+		} else if op.VolumeId != "" {
+			pending[normalizeWwid(op.VolumeId)] = true
+		}
+		if device := op.Params[operationParamDevice]; device != "" {
+			pending[device] = true
+		}
+	}
+	return pending, nil
+}
+
+// findStaleDevices returns the IBM devices with no mounts, no holders, no stage info and no volume
+// tracked by kubelet.
+func (d *nodeService) findStaleDevices() ([]ibmDevice, error) {
+	candidates, err := d.ibmDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	mountedDevices, err := d.mountedDevices()
+	if err != nil {
+		return nil, err
+	}
+	stagedDevices := d.stagedDevices("")
+	kubeletVolumes := d.kubeletVolumeWwns("")
+
+	var stale []ibmDevice
+	for _, device := range candidates {
+		if reason := d.deviceInUse(device, mountedDevices, stagedDevices, kubeletVolumes); reason != "" {
+			logging.V(5).Infof("Device %s is in use: %s", device.Name, reason)
+			continue
+		}
+		stale = append(stale, device)
+	}
+	sort.Slice(stale, func(i, k int) bool { return stale[i].Name < stale[k].Name })
+	return stale, nil
+}
+
+// ibmDevices returns the multipath maps of IBM volumes and the IBM SCSI devices that are not part
+// of a multipath map.
+func (d *nodeService) ibmDevices() ([]ibmDevice, error) {
+	blockDir := d.hostRoot.Path(sysBlockPath)
+	entries, err := ioutil.ReadDir(blockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ibmDisks := map[string]string{} // sdX -> wwid
+	var dmDevices []string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, "sd"):
+			if d.isIbmScsiDevice(name) {
+				ibmDisks[name] = d.readSysBlockAttr(name, "device/wwid")
+			}
+		case strings.HasPrefix(name, "dm-"):
+			dmDevices = append(dmDevices, name)
+		}
+	}
+
+	var candidates []ibmDevice
+	multipathSlaves := map[string]bool{}
+	for _, dm := range dmDevices {
+		uuid := d.readSysBlockAttr(dm, "dm/uuid")
+		if !strings.HasPrefix(uuid, multipathDmUuidPrefix) {
+			continue
+		}
+		slaves := d.listSysBlockDir(dm, "slaves")
+		isIbm := false
+		for _, slave := range slaves {
+			multipathSlaves[slave] = true
+			if _, ok := ibmDisks[slave]; ok {
+				isIbm = true
+			}
+		}
+		if !isIbm {
+			continue
+		}
+		candidates = append(candidates, ibmDevice{
+			Name:         dm,
+			MultipathMap: d.readSysBlockAttr(dm, "dm/name"),
+			Wwid:         strings.TrimPrefix(uuid, multipathDmUuidPrefix),
+			ScsiDevices:  slaves,
+		})
+	}
+	for disk, wwid := range ibmDisks {
+		if !multipathSlaves[disk] {
+			candidates = append(candidates, ibmDevice{Name: disk, Wwid: wwid, ScsiDevices: []string{disk}})
+		}
+	}
+	return candidates, nil
+}
+
+// findVolumeDevice returns the IBM device of the volume with the WWN, preferring its multipath map
+// over a single SCSI device.
+func (d *nodeService) findVolumeDevice(wwn string) (ibmDevice, bool) {
+	devices, err := d.ibmDevices()
+	if err != nil {
+		logging.V(4).Infof("Failed to list the IBM devices: %v", err)
+		return ibmDevice{}, false
+	}
+	found := false
+	var volumeDevice ibmDevice
+	for _, device := range devices {
+		if normalizeWwid(device.Wwid) != wwn {
+			continue
+		}
+		if device.MultipathMap != "" {
+			return device, true
+		}
+		volumeDevice, found = device, true
+	}
+	return volumeDevice, found
+}
+
+// deviceInUse returns why the device is in use, or an empty string for a stale device.
+func (d *nodeService) deviceInUse(device ibmDevice, mountedDevices map[string]bool, stagedDevices map[string]bool, kubeletVolumes map[string]bool) string {
+	names := []string{device.Name}
+	if device.MultipathMap != "" {
+		names = append(names, device.MultipathMap)
+	}
+	for _, name := range names {
+		if mountedDevices[name] {
+			return fmt.Sprintf("%s is mounted", name)
+		}
+		if stagedDevices[name] {
+			return fmt.Sprintf("%s belongs to a staged volume", name)
+		}
+	}
+	if device.Wwid != "" && stagedDevices[normalizeWwid(device.Wwid)] {
+		return fmt.Sprintf("wwid %s belongs to a staged volume", device.Wwid)
+	}
+	if device.Wwid != "" && kubeletVolumes[normalizeWwid(device.Wwid)] {
+		return fmt.Sprintf("wwid %s belongs to a volume kubelet tracks on the node", device.Wwid)
+	}
+	if mountedDevices[d.readSysBlockAttr(device.Name, "dev")] {
+		return fmt.Sprintf("%s is mounted by its device number", device.Name)
+	}
+	if holders := d.listSysBlockDir(device.Name, "holders"); len(holders) > 0 {
+		return fmt.Sprintf("held by %v", holders)
+	}
+	for _, scsiDevice := range device.ScsiDevices {
+		if mountedDevices[scsiDevice] || mountedDevices[d.readSysBlockAttr(scsiDevice, "dev")] {
+			return fmt.Sprintf("path %s is mounted", scsiDevice)
+		}
+		for _, holder := range d.listSysBlockDir(scsiDevice, "holders") {
+			if holder != device.Name {
+				return fmt.Sprintf("path %s is held by %s", scsiDevice, holder)
+			}
+		}
+		if device.MultipathMap == "" && d.hasPartitions(scsiDevice) {
+			return fmt.Sprintf("%s has partitions", scsiDevice)
+		}
+	}
+	return ""
+}
+
+// mountedDevices returns the base names of the devices in the host mount table, e.g. sdb, dm-3 or
+// mpathb, and the device numbers of the mounted file systems, e.g. 253:3.
+func (d *nodeService) mountedDevices() (map[string]bool, error) {
+	mounts, err := d.readMounts()
+	if err != nil {
+		return nil, err
+	}
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		if strings.HasPrefix(mount.Device, "/dev/") {
+			mounted[filepath.Base(mount.Device)] = true
+		}
+		if mount.MajorMinor != "" {
+			mounted[mount.MajorMinor] = true
+		}
+	}
+	return mounted, nil
+}
+
+// stagedDevices returns the device names, multipath map names and WWNs of the persisted stage infos of
+// all the volumes but the excepted one, "" for none.
+func (d *nodeService) stagedDevices(exceptVolumeId string) map[string]bool {
+	staged := map[string]bool{}
+	for _, info := range d.listStageInfos() {
+		if exceptVolumeId != "" && info.VolumeId == exceptVolumeId {
+			continue
+		}
+		if info.DevicePath != "" {
+			staged[filepath.Base(info.DevicePath)] = true
+		}
+		if info.MultipathMap != "" {
+			staged[info.MultipathMap] = true
+		}
+		if info.Wwn != "" {
+			staged[normalizeWwid(info.Wwn)] = true
+		}
+	}
+	return staged
+}
+
+// kubeletVolumeWwns returns the WWNs of the volumes of this driver that kubelet tracks on the node, but
+// the excepted one, "" for none. Kubelet writes the vol_data.json file of a volume before it calls
+// NodeStageVolume or NodePublishVolume and removes it after NodeUnstageVolume or NodeUnpublishVolume,
+// so it covers the volumes published to the node whose stage info is not written yet.
+func (d *nodeService) kubeletVolumeWwns(exceptVolumeId string) map[string]bool {
+	wwns := map[string]bool{}
+	for _, pattern := range []string{
+		filepath.Join(d.kubeletDir(), kubeletCsiStagingDir, "*", kubeletVolDataFile),
+		filepath.Join(d.kubeletDir(), kubeletCsiPodVolumesDir, "*", kubeletVolDataFile),
+	} {
+		volDataFiles, err := filepath.Glob(pattern)
+		if err != nil {
+			logging.Errorf("Failed to list %s: %v", pattern, err)
+			continue
+		}
+		for _, volDataFile := range volDataFiles {
+			volData, ok := d.readDriverVolData(volDataFile)
+			if !ok || volData.VolumeHandle == exceptVolumeId {
+				continue
+			}
+			if wwn := volumeWwn(volData.VolumeHandle); wwn != "" {
+				wwns[wwn] = true
+			}
+		}
+	}
+	return wwns
+}
+
+// removeStaleDevice flushes the multipath map of the device and deletes its SCSI devices. It checks
+// again that the device is unused right before, and records every step in the journal.
+func (d *nodeService) removeStaleDevice(ctx context.Context, device ibmDevice) error {
+	if err := d.verifyStaleDevice(ctx, device, ""); err != nil {
+		return fmt.Errorf("refusing to remove it: %v", err)
+	}
+
+	op, err := d.beginOperation(operationRemoveStaleDevice, device.Wwid, deviceRemovalSteps(device), map[string]string{
+		operationParamDevice:       device.Name,
+		operationParamMultipathMap: device.MultipathMap,
+		operationParamScsiDevices:  strings.Join(device.ScsiDevices, ","),
+	})
+	if err != nil {
+		return err
+	}
+	// A failed removal is not left pending in the journal, the next garbage collection run finds
+	// what is left of the device and retries. Only a removal interrupted by a restart is recovered.
+	defer d.finishOperation(op)
+	return d.runDeviceRemoval(ctx, op, device)
+}
+
+func deviceRemovalSteps(device ibmDevice) []string {
+	var steps []string
+	if device.MultipathMap != "" {
+		steps = append(steps, stepFlushMultipath)
+	}
+	for _, scsiDevice := range device.ScsiDevices {
+		steps = append(steps, deviceStep(stepFlushBuffers, scsiDevice), deviceStep(stepDeleteDevice, scsiDevice))
+	}
+	return steps
+}
+
+// runDeviceRemoval runs the steps of the removal of a device that are not done in the journal yet.
+func (d *nodeService) runDeviceRemoval(ctx context.Context, op *journal.Operation, device ibmDevice) error {
+	if device.MultipathMap != "" {
+		if err := d.runStep(op, stepFlushMultipath, func() error {
+			_, err := d.executor.Execute(ctx, "multipath", "-f", device.MultipathMap)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	for _, scsiDevice := range device.ScsiDevices {
+		if err := d.runStep(op, deviceStep(stepFlushBuffers, scsiDevice), func() error {
+			_, err := d.executor.Execute(ctx, "blockdev", "--flushbufs", "/dev/"+scsiDevice)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := d.runStep(op, deviceStep(stepDeleteDevice, scsiDevice), func() error {
+			deletePath := filepath.Join(d.hostRoot.Path(sysBlockPath), scsiDevice, "device", "delete")
+			if err := ioutil.WriteFile(deletePath, []byte("1"), 0200); err != nil {
+				return fmt.Errorf("failed to delete scsi device %s: %v", scsiDevice, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyStaleDevice checks that the device is still unused: not in the host mount table, held by
+// nothing but its multipath map, not staged or tracked by kubelet for any volume but the excepted one
+// and, for a multipath map, not open.
+func (d *nodeService) verifyStaleDevice(ctx context.Context, device ibmDevice, exceptVolumeId string) error {
+	mountedDevices, err := d.mountedDevices()
+	if err != nil {
+		return err
+	}
+	if reason := d.deviceInUse(device, mountedDevices, d.stagedDevices(exceptVolumeId), d.kubeletVolumeWwns(exceptVolumeId)); reason != "" {
+		return fmt.Errorf("device is in use: %s", reason)
+	}
+	if device.MultipathMap == "" {
+		return nil
+	}
+	out, err := d.executor.Execute(ctx, "dmsetup", "info", "-c", "--noheadings", "-o", "open", device.MultipathMap)
+	if err != nil {
+		return err
+	}
+	openCount := strings.TrimSpace(string(out))
+	if openCount != "0" {
+		return fmt.Errorf("multipath map %s is open %s times", device.MultipathMap, openCount)
+	}
+	return nil
+}
+
+func (d *nodeService) isIbmScsiDevice(name string) bool {
+	if d.readSysBlockAttr(name, "device/vendor") != ibmScsiVendor {
+		return false
+	}
+	model := d.readSysBlockAttr(name, "device/model")
+	for _, prefix := range ibmScsiModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *nodeService) hasPartitions(name string) bool {
+	for _, entry := range d.listSysBlockDir(name, "") {
+		if strings.HasPrefix(entry, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *nodeService) readSysBlockAttr(name string, attr string) string {
+	content, err := ioutil.ReadFile(filepath.Join(d.hostRoot.Path(sysBlockPath), name, attr))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.V(4).Infof("Failed to read %s of %s: %v", attr, name, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func (d *nodeService) listSysBlockDir(name string, dir string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(d.hostRoot.Path(sysBlockPath), name, dir))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// normalizeWwid returns the bare lower case WWN of a SCSI wwid (naa.6005...), a multipath
+// wwid (36005...) or a WWN.
+func normalizeWwid(wwid string) string {
+	wwid = strings.ToLower(strings.TrimSpace(wwid))
+	wwid = strings.TrimPrefix(wwid, "naa.")
+	if len(wwid) == 33 && strings.HasPrefix(wwid, "3") {
+		wwid = wwid[1:]
+	}
+	return wwid
+}
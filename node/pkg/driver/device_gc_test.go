@@ -0,0 +1,369 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	util "github.com/ibm/ibm-block-csi-driver/node/util"
+)
+
+// fakeHost is a synthetic host root file system for tests.
+type fakeHost struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeHost(t *testing.T) *fakeHost {
+	root, err := ioutil.TempDir("", "fake-host-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary host root : %v", err)
+	}
+	return &fakeHost{t: t, root: root}
+}
+
+func (h *fakeHost) cleanup() {
+	os.RemoveAll(h.root)
+}
+
+func (h *fakeHost) writeFile(path string, content string) {
+	fullPath := filepath.Join(h.root, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		h.t.Fatalf("Cannot create %s : %v", filepath.Dir(fullPath), err)
+	}
+	if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		h.t.Fatalf("Cannot write %s : %v", fullPath, err)
+	}
+}
+
+func (h *fakeHost) mkdir(path string) {
+	if err := os.MkdirAll(filepath.Join(h.root, path), 0755); err != nil {
+		h.t.Fatalf("Cannot create %s : %v", path, err)
+	}
+}
+
+func (h *fakeHost) addScsiDevice(name string, vendor string, model string, wwid string) {
+	h.writeFile("/sys/block/"+name+"/device/vendor", vendor+"     \n")
+	h.writeFile("/sys/block/"+name+"/device/model", model+"            \n")
+	h.writeFile("/sys/block/"+name+"/device/wwid", wwid+"\n")
+	h.mkdir("/sys/block/" + name + "/holders")
+}
+
+func (h *fakeHost) addMultipathDevice(dm string, mapName string, wwid string, slaves ...string) {
+	h.writeFile("/sys/block/"+dm+"/dm/name", mapName+"\n")
+	h.writeFile("/sys/block/"+dm+"/dm/uuid", "mpath-"+wwid+"\n")
+	h.mkdir("/sys/block/" + dm + "/holders")
+	for _, slave := range slaves {
+		h.mkdir("/sys/block/" + dm + "/slaves/" + slave)
+		h.mkdir("/sys/block/" + slave + "/holders/" + dm)
+	}
+}
+
+func newTestNodeServiceWithHost(host *fakeHost, exec executor.Executor) nodeService {
+	d := newTestNodeService(nil)
+	d.hostRoot = util.HostRoot(host.root)
+	d.executor = exec
+	d.configYaml.Node.Kubelet_dir = filepath.Join(host.root, "var/lib/kubelet")
+	return d
+}
+
+func TestFindStaleDevices(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+
+	// stale multipath map with two paths
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb", "sdc")
+	// mounted multipath map
+	host.addScsiDevice("sdd", "IBM", "2810XIV", "naa.6001738cfc9035e80000000000000002")
+	host.addMultipathDevice("dm-1", "mpathb", "36001738cfc9035e80000000000000002", "sdd")
+	// multipath map of a staged volume
+	host.addScsiDevice("sde", "IBM", "2145", "naa.6005076810830198a800000000000003")
+	host.addMultipathDevice("dm-2", "mpathc", "36005076810830198a800000000000003", "sde")
+	host.writeFile(filepath.Join(DefaultStageInfoDir, stageInfoFileName("vol-3")),
+		`{"version": 1, "volumeId": "vol-3", "wwn": "6005076810830198A800000000000003"}`)
+	// stale single path device
+	host.addScsiDevice("sdf", "IBM", "2145", "naa.6005076810830198a800000000000004")
+	// single path device held by LVM
+	host.addScsiDevice("sdg", "IBM", "2145", "naa.6005076810830198a800000000000005")
+	host.mkdir("/sys/block/sdg/holders/dm-5")
+	// device of another vendor and the local disk
+	host.addScsiDevice("sdh", "NETAPP", "LUN", "naa.600a098000000000000000000000006")
+	host.addScsiDevice("sda", "ATA", "SAMSUNG", "t10.ATA")
+	// multipath map of a volume kubelet is staging, before its stage info is written
+	host.addScsiDevice("sdj", "IBM", "2145", "naa.6005076810830198a800000000000008")
+	host.addMultipathDevice("dm-4", "mpathe", "36005076810830198a800000000000008", "sdj")
+	host.writeFile(filepath.Join("/var/lib/kubelet", kubeletCsiStagingDir, "pv-8", kubeletVolDataFile),
+		`{"driverName": "`+testDriverName+`", "volumeHandle": "SVC:6005076810830198A800000000000008"}`)
+	// multipath map mounted on the host outside of the kubelet directories, by its device number
+	host.addScsiDevice("sdi", "IBM", "2145", "naa.6005076810830198a800000000000007")
+	host.addMultipathDevice("dm-3", "mpathd", "36005076810830198a800000000000007", "sdi")
+	host.writeFile("/sys/block/dm-3/dev", "253:3\n")
+	host.writeFile("/proc/1/mountinfo",
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+			"40 22 253:1 / /var/lib/kubelet/pods/x rw,relatime shared:2 - ext4 /dev/mapper/mpathb rw\n"+
+			"41 22 253:3 / /data rw,relatime shared:3 - xfs /dev/disk/by-id/dm-name-data rw\n")
+
+	d := newTestNodeServiceWithHost(host, executor.NewFakeExecutor())
+	d.configYaml.Identity.Name = testDriverName
+
+	stale, err := d.findStaleDevices()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expStale := []ibmDevice{
+		{Name: "dm-0", MultipathMap: "mpatha", Wwid: "36005076810830198a800000000000001", ScsiDevices: []string{"sdb", "sdc"}},
+		{Name: "sdf", Wwid: "naa.6005076810830198a800000000000004", ScsiDevices: []string{"sdf"}},
+	}
+	if !reflect.DeepEqual(stale, expStale) {
+		t.Fatalf("stale devices mismatch: expected %v, got %v", expStale, stale)
+	}
+}
+
+func TestCollectStaleDevices(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb")
+	host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000002")
+	host.writeFile("/proc/1/mountinfo", "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+
+	start := time.Now()
+	now := start
+	testCases := []struct {
+		name       string
+		mode       string
+		dryRun     bool
+		maxRemoval int
+		runs       []time.Duration
+		pending    []string
+		script     []executor.FakeCommand
+		expDeleted []string
+	}{
+		{
+			name: "report mode never removes",
+			mode: GCModeReport,
+			runs: []time.Duration{0, time.Hour},
+		},
+		{
+			name: "remove mode waits for min stale age",
+			mode: GCModeRemove,
+			runs: []time.Duration{0, 10 * time.Minute},
+		},
+		{
+			name:   "dry run does not remove",
+			mode:   GCModeRemove,
+			dryRun: true,
+			runs:   []time.Duration{0, time.Hour},
+		},
+		{
+			name:       "remove mode is rate limited",
+			mode:       GCModeRemove,
+			maxRemoval: 1,
+			runs:       []time.Duration{0, time.Hour},
+			script: []executor.FakeCommand{
+				{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+				{Name: "multipath", Args: []string{"-f", "mpatha"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+			},
+			expDeleted: []string{"sdb"},
+		},
+		{
+			name: "remove mode removes stale devices",
+			mode: GCModeRemove,
+			runs: []time.Duration{0, time.Hour},
+			script: []executor.FakeCommand{
+				{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+				{Name: "multipath", Args: []string{"-f", "mpatha"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdb", "sdc"},
+		},
+		{
+			name:    "remove mode skips the devices of pending operations",
+			mode:    GCModeRemove,
+			runs:    []time.Duration{0, time.Hour},
+			pending: []string{"SVC:6005076810830198A800000000000001"},
+			script: []executor.FakeCommand{
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdc"},
+		},
+		{
+			name: "remove mode keeps open multipath maps",
+			mode: GCModeRemove,
+			runs: []time.Duration{0, time.Hour},
+			script: []executor.FakeCommand{
+				{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "1\n"},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, disk := range []string{"sdb", "sdc"} {
+				os.Remove(filepath.Join(host.root, "sys/block", disk, "device/delete"))
+			}
+			journalDir, err := ioutil.TempDir("", "journal-")
+			if err != nil {
+				t.Fatalf("Cannot create temporary dir : %v", err)
+			}
+			defer os.RemoveAll(journalDir)
+			fakeExec := executor.NewFakeExecutor(tc.script...)
+			d := newTestNodeServiceWithHost(host, fakeExec)
+			d.journal, err = journal.NewJournal(journalDir)
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			for _, volumeId := range tc.pending {
+				if _, err := d.journal.Begin(operationUnstage, volumeId, []string{stepUnmount}, nil); err != nil {
+					t.Fatalf("err is not nil. got: %v", err)
+				}
+			}
+			gc := newDeviceGC(tc.mode, tc.dryRun, 30*time.Minute, tc.maxRemoval)
+			gc.clock = func() time.Time { return now }
+
+			for _, offset := range tc.runs {
+				now = start.Add(offset)
+				if err := d.collectStaleDevices(context.TODO(), gc); err != nil {
+					t.Fatalf("err is not nil. got: %v", err)
+				}
+			}
+
+			if err := fakeExec.Verify(); err != nil {
+				t.Fatalf("%v", err)
+			}
+			var deleted []string
+			for _, disk := range []string{"sdb", "sdc"} {
+				content, err := ioutil.ReadFile(filepath.Join(host.root, "sys/block", disk, "device/delete"))
+				if err == nil && string(content) == "1" {
+					deleted = append(deleted, disk)
+				}
+			}
+			if !reflect.DeepEqual(deleted, tc.expDeleted) {
+				t.Fatalf("deleted devices mismatch: expected %v, got %v", tc.expDeleted, deleted)
+			}
+			if pending, err := d.journal.Pending(); err != nil || len(pending) != len(tc.pending) {
+				t.Fatalf("Expected %d pending operations, got %v, err %v", len(tc.pending), pending, err)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleDeviceRefusesWithoutHostMounts(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+
+	d := newTestNodeServiceWithHost(host, executor.NewFakeExecutor())
+	if _, err := d.findStaleDevices(); err == nil {
+		t.Fatalf("Expected an error without the host mount table")
+	}
+	device := ibmDevice{Name: "sdb", Wwid: "naa.6005076810830198a800000000000001", ScsiDevices: []string{"sdb"}}
+	if err := d.removeStaleDevice(context.TODO(), device); err == nil {
+		t.Fatalf("Expected an error without the host mount table")
+	}
+	if _, err := os.Stat(filepath.Join(host.root, "sys/block/sdb/device/delete")); !os.IsNotExist(err) {
+		t.Fatalf("Expected sdb to be kept, got %v", err)
+	}
+}
+
+func TestRemoveStaleDeviceJournal(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb", "sdc")
+	host.writeFile("/proc/1/mountinfo", "")
+	journalDir, err := ioutil.TempDir("", "journal-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(journalDir)
+
+	// deleting sdc fails, the record of the steps done so far is kept until the removal returns
+	host.mkdir("/sys/block/sdc/device/delete")
+	var recorded []string
+	var d nodeService
+	fakeExec := executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+		executor.FakeCommand{Name: "multipath", Args: []string{"-f", "mpatha"}},
+		executor.FakeCommand{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+		executor.FakeCommand{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+	)
+	d = newTestNodeServiceWithHost(host, &journalRecorder{Executor: fakeExec, record: func() {
+		pending, _ := d.journal.Pending()
+		if len(pending) == 1 {
+			recorded = pending[0].CompletedSteps()
+		}
+	}})
+	d.journal, err = journal.NewJournal(journalDir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	device := ibmDevice{Name: "dm-0", MultipathMap: "mpatha", Wwid: "36005076810830198a800000000000001", ScsiDevices: []string{"sdb", "sdc"}}
+	if err := d.removeStaleDevice(context.TODO(), device); err == nil {
+		t.Fatalf("Expected an error deleting sdc")
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expRecorded := []string{stepFlushMultipath, deviceStep(stepFlushBuffers, "sdb"), deviceStep(stepDeleteDevice, "sdb")}
+	if !reflect.DeepEqual(recorded, expRecorded) {
+		t.Fatalf("journaled steps mismatch: expected %v, got %v", expRecorded, recorded)
+	}
+	if pending, err := d.journal.Pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("Expected no pending operations, got %v, err %v", pending, err)
+	}
+}
+
+// journalRecorder calls record before every command, to capture the journal in the middle of an operation.
+type journalRecorder struct {
+	executor.Executor
+	record func()
+}
+
+func (r *journalRecorder) Execute(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.record()
+	return r.Executor.Execute(ctx, name, args...)
+}
+
+func TestNormalizeWwid(t *testing.T) {
+	for wwid, expWwid := range map[string]string{
+		"naa.6005076810830198a800000000000001": "6005076810830198a800000000000001",
+		"36005076810830198a800000000000001":    "6005076810830198a800000000000001",
+		"6005076810830198A800000000000001":     "6005076810830198a800000000000001",
+	} {
+		if normalized := normalizeWwid(wwid); normalized != expWwid {
+			t.Fatalf("wwid mismatches: expected %v, got %v", expWwid, normalized)
+		}
+	}
+}
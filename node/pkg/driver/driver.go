@@ -19,123 +19,418 @@ package driver
 import (
 	"context"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	tracing "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/tracing"
 	util "github.com/ibm/ibm-block-csi-driver/node/util"
-	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
-	"gopkg.in/yaml.v2"
-	"k8s.io/klog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type Driver struct {
 	nodeService
-	srv      *grpc.Server
-	endpoint string
-	config   ConfigFile
+	srv         *grpc.Server
+	endpoint    string
+	stopCh      chan struct{}
+	healthPort  int
+	metricsPort int
+	httpServers []*http.Server
+	tracer      *tracing.Tracer
+	// certs serves the TLS certificates of a tcp:// endpoint, nil for plaintext
+	certs *certReloader
+	// socketPath is the unix socket of the endpoint, removed on shutdown
+	socketPath  string
+	socketMode  os.FileMode
+	socketGroup string
+	// mu guards srv and socketPath, which Shutdown may read while Run creates them
+	mu sync.Mutex
+	// shuttingDown is set to 1 once Shutdown was called
+	shuttingDown int32
+	// reconciled is set to 1 once the startup reconciliation finished
+	reconciled int32
+	// configSources are read again by ReloadConfig, which reloadMu serializes
+	configSources       ConfigSources
+	configWatchInterval time.Duration
+	// flagLogVerbosity is the level of the V logs of the -v flag, restored when a reloaded config
+	// no longer sets node.log_verbosity
+	flagLogVerbosity int
+	// configFiles are the states of the config files when the config was loaded
+	configFiles map[string]fileState
+	reloadMu    sync.Mutex
 }
 
-func NewDriver(endpoint string, configFilePath string, hostname string) (*Driver, error) {
-	configFile, err := ReadConfigFile(configFilePath)
+// DriverOptions holds the command line settings of the node driver.
+type DriverOptions struct {
+	Endpoint       string
+	ConfigFilePath string
+	// ConfigDropInDir holds per-node config files applied over ConfigFilePath, empty means conf.d
+	// next to it
+	ConfigDropInDir string
+	// ConfigOverrides are path=value settings applied over all other config layers
+	ConfigOverrides []string
+	// ConfigWatchInterval is how often the config files are checked for changes, 0 disables the watch
+	ConfigWatchInterval time.Duration
+	// LogVerbosity is the level of the V logs of the -v flag, node.log_verbosity overrides it
+	LogVerbosity int
+	Hostname            string
+	// ExecMode is how host tools are run, one of executor.ExecModeDirect, ExecModeNsenter or ExecModeChroot
+	ExecMode      string
+	ExecChrootDir string
+	// HostRoot overrides node.host_root of the config file when set
+	HostRoot string
+	// HealthPort is the HTTP port of /healthz and /readyz, 0 disables them
+	HealthPort int
+	// MetricsPort is the HTTP port of /metrics, 0 disables the metrics
+	MetricsPort int
+	// TracingExporter is tracing.ExporterFile, or empty or ExporterNone for no tracing
+	TracingExporter string
+	// TracingEndpoint is the file of the file exporter
+	TracingEndpoint string
+	// TLSCertFile and TLSKeyFile enable TLS on a tcp:// endpoint, TLSClientCAFile adds client
+	// certificate verification
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// InsecureTCP allows a plaintext tcp:// endpoint
+	InsecureTCP bool
+	// SocketMode and SocketGroup are the permissions of a unix socket endpoint, 0 and empty keep the
+	// defaults of the process
+	SocketMode  os.FileMode
+	SocketGroup string
+}
+
+// ConfigSources returns the config layers of the options and the process environment.
+func (options DriverOptions) ConfigSources() ConfigSources {
+	return ConfigSources{
+		File:      options.ConfigFilePath,
+		DropInDir: options.ConfigDropInDir,
+		Environ:   os.Environ(),
+		Overrides: options.ConfigOverrides,
+	}
+}
+
+func NewDriver(options DriverOptions) (*Driver, error) {
+	configSources := options.ConfigSources()
+	configFiles := configFileStates(configSources)
+	configFile, err := LoadConfig(configSources)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("Driver: %v Version: %v", configFile.Identity.Name, configFile.Identity.Version)
+	logging.Infof("Effective config:\n%s", redactedConfig(configFile))
+	if err := applyLogVerbosity(configFile, options.LogVerbosity); err != nil {
+		return nil, err
+	}
+
+	certs, err := newEndpointCerts(options)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeName := options.Hostname
+	if nodeName == "" {
+		if nodeName, err = detectNodeName(os.Getenv, os.Hostname); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := arrayHostName(nodeName, configFile)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("Node %s has the array host name %s", nodeName, hostname)
+
+	hostRoot := util.HostRoot(configFile.Node.Host_root)
+	if options.HostRoot != "" {
+		hostRoot = util.HostRoot(options.HostRoot)
+	}
+	logging.V(4).Infof("Host root is %q", hostRoot)
+
+	chrootDir := options.ExecChrootDir
+	if chrootDir == "" {
+		chrootDir = string(hostRoot)
+	}
+	exec, err := executor.NewExecutorWithMode(options.ExecMode, chrootDir, configFile.Node.Command_timeouts)
+	if err != nil {
+		return nil, err
+	}
+	var driverMetrics *metrics.Metrics
+	if options.MetricsPort > 0 {
+		driverMetrics = metrics.NewMetrics()
+		exec = &instrumentedExecutor{Executor: exec, metrics: driverMetrics}
+	}
+
+	journalDir := configFile.Node.Journal_dir
+	if journalDir == "" {
+		journalDir = DefaultJournalDir
+	}
+	operationJournal, err := journal.NewJournal(hostRoot.Path(journalDir))
 	if err != nil {
 		return nil, err
 	}
-	klog.Infof("Driver: %v Version: %v", configFile.Identity.Name, configFile.Identity.Version)
+
+	var tracer *tracing.Tracer
+	if options.TracingExporter != "" && options.TracingExporter != tracing.ExporterNone {
+		exporter, err := tracing.NewExporter(options.TracingExporter, options.TracingEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		tracer = tracing.NewTracer(configFile.Identity.Name, exporter)
+		tracing.SetTracer(tracer)
+		logging.Infof("Tracing with the %s exporter to %s", options.TracingExporter, options.TracingEndpoint)
+	}
+
+	node := NewNodeService(configFile, hostname, *NewNodeUtils(), exec, hostRoot, operationJournal)
+	node.metrics = driverMetrics
 
 	return &Driver{
-		endpoint:    endpoint,
-		config:      configFile,
-		nodeService: NewNodeService(configFile, hostname, *NewNodeUtils()),
+		endpoint:    options.Endpoint,
+		stopCh:      make(chan struct{}),
+		healthPort:  options.HealthPort,
+		metricsPort: options.MetricsPort,
+		tracer:      tracer,
+		certs:       certs,
+		socketMode:  options.SocketMode,
+		socketGroup: options.SocketGroup,
+		nodeService: node,
+
+		configSources:       configSources,
+		configWatchInterval: options.ConfigWatchInterval,
+		flagLogVerbosity:    options.LogVerbosity,
+		configFiles:         configFiles,
 	}, nil
 }
 
 func (d *Driver) Run() error {
-	scheme, addr, err := util.ParseEndpoint(d.endpoint)
-	if err != nil {
+	if err := d.startHTTPServers(); err != nil {
 		return err
 	}
 
-	listener, err := net.Listen(scheme, addr)
-	if err != nil {
+	if err := d.reconcile(context.Background()); err != nil {
 		return err
 	}
+	d.setReconciled()
+	go d.runStaleDeviceGC(d.stopCh)
+	go d.runJournalRecovery(d.stopCh)
+	go d.runOrphanDirCleanup(d.stopCh)
+	go d.runMetricsCollector(d.stopCh)
+	go d.runReachabilityChecker(d.stopCh)
+	go d.runConfigWatcher(d.stopCh)
 
-	logErr := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			klog.Errorf("GRPC error: %v", err)
-		}
-		return resp, err
+	scheme, addr, err := util.ParseEndpoint(d.endpoint)
+	if err != nil {
+		return err
 	}
+
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logErr),
+		grpc.UnaryInterceptor(chainUnaryInterceptors(
+			logging.UnaryServerInterceptor(d.hostname),
+			tracing.UnaryServerInterceptor(),
+			d.metrics.UnaryServerInterceptor(),
+			d.shutdownInterceptor,
+			recoveryInterceptor,
+		)),
+	}
+	if d.certs != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(d.certs.TLSConfig())))
+	} else if scheme == "tcp" {
+		logging.Warningf("Serving plaintext gRPC on TCP endpoint %s", addr)
+	}
+	d.mu.Lock()
+	if d.isShuttingDown() {
+		d.mu.Unlock()
+		return nil
+	}
+	listener, err := d.listen(scheme, addr)
+	if err != nil {
+		d.mu.Unlock()
+		return err
 	}
 	d.srv = grpc.NewServer(opts...)
+	d.mu.Unlock()
 
 	csi.RegisterIdentityServer(d.srv, d)
 	csi.RegisterNodeServer(d.srv, d)
 
-	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	logging.Infof("Listening for connections on address: %#v", listener.Addr())
 	return d.srv.Serve(listener)
 }
 
+// listen opens the endpoint. A unix socket left behind by a previous server is removed first, and
+// the new socket gets the configured mode and group.
+func (d *Driver) listen(scheme string, addr string) (net.Listener, error) {
+	if scheme != "unix" {
+		return net.Listen(scheme, addr)
+	}
+
+	if err := util.RemoveStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	if d.socketMode == 0 && d.socketGroup == "" {
+		listener, err := net.Listen(scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+		d.socketPath = addr
+		return listener, nil
+	}
+
+	mode := d.socketMode
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	// the socket never exists at addr with the permissions of the umask
+	listener, err := util.ListenUnixSocket(addr, mode, d.socketGroup)
+	if err != nil {
+		return nil, err
+	}
+	d.socketPath = addr
+	return listener, nil
+}
+
+// chainUnaryInterceptors returns an interceptor that runs the interceptors in order, the first one
+// is the outermost.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// recoveryInterceptor turns a panic of an RPC handler into an Internal error instead of crashing the
+// node plugin, and converts the errors of the handlers to gRPC status errors.
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.FromContext(ctx).Errorf("Panic in %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			resp, err = nil, status.Errorf(codes.Internal, "internal error in %s: %v", info.FullMethod, r)
+		}
+	}()
+	resp, err = handler(ctx, req)
+	return resp, toStatusError(err)
+}
+
+// Stop stops the driver without waiting for the in-flight RPCs.
 func (d *Driver) Stop() {
-	klog.Infof("Stopping server")
-	d.srv.Stop()
+	logging.Infof("Stopping server")
+	d.Shutdown(0)
 }
 
 type ConfigFile struct {
 	Identity struct {
 		Name    string
 		Version string
-		// TODO missing capabilities
+		// Plugin service capabilities of the controller plugin by their CSI enum names, e.g. CONTROLLER_SERVICE
+		Capabilities []string
+		// Volume expansion type ONLINE or OFFLINE, empty when volumes cannot be expanded
+		Volume_expansion string
 	}
 	Controller struct {
 		Publish_context_lun_parameter          string
 		Publish_context_connectivity_parameter string
 	}
+	Node struct {
+		// Node RPC capabilities by their CSI enum names, defaults to STAGE_UNSTAGE_VOLUME
+		Capabilities []string
+		// Plugin service capabilities of the node plugin by their CSI enum names, e.g. VOLUME_ACCESSIBILITY_CONSTRAINTS
+		Plugin_capabilities []string
+		// Level of the V logs, unset keeps the -v flag
+		Log_verbosity *int
+		// Name of the host object on the storage array, by default the Kubernetes node name
+		Host_name struct {
+			// Array host name by Kubernetes node name, wins over the template
+			Mapping map[string]string
+			// Go template with .NodeName and .ShortName, and the functions lower, upper, replace,
+			// trimPrefix, trimSuffix and trunc
+			Template string
+		}
+		Topology struct {
+			// Static segments such as site or rack, keys without a prefix get TopologyKeyPrefix
+			Segments map[string]string
+		}
+		// Storage arrays to probe, published as topology segments and metrics
+		Reachability ReachabilityConfig
+		// Type of the storage arrays of the node, SVC or A9000, for the LUN IDs of a host
+		Array_type  string
+		Max_volumes struct {
+			// How NodeGetInfo computes MaxVolumesPerNode: "" (no limit), static, array_type or
+			// remaining_lun_ids
+			Source string
+			Static int64
+		}
+		// Timeout per host command name, the "default" entry applies to all other commands
+		Command_timeouts map[string]time.Duration
+		// Directory the host root file system is mounted on in the container, empty means "/"
+		Host_root string
+		// Host directory of the operation journal, must survive restarts of the node plugin
+		Journal_dir string
+		// Host directory of the stage info records of the staged volumes, must survive restarts
+		// of the node plugin
+		Stage_info_dir string
+		// Kubelet root directory as mounted in the node container
+		Kubelet_dir     string
+		Stale_device_gc struct {
+			// disabled, report or remove
+			Mode    string
+			Dry_run bool
+			// Time between garbage collection runs
+			Interval time.Duration
+			// A device is removed only after it was stale for this long
+			Min_stale_age time.Duration
+			// Maximum number of devices removed in one run
+			Max_removals_per_run int
+		}
+		Journal_recovery struct {
+			// Time between retries of the journal operations whose recovery failed
+			Retry_interval time.Duration
+			// Unfinished operations older than this are moved out of the journal
+			Max_age time.Duration
+		}
+		Orphan_dir_cleanup struct {
+			// disabled, report or remove
+			Policy string
+			// Time between scans of the kubelet directories
+			Interval time.Duration
+			// An unmounted directory is orphaned only if it was not modified for this long
+			Min_age time.Duration
+		}
+		Health struct {
+			Check_iscsid     bool
+			Check_multipathd bool
+			// Kernel modules that must be loaded, defaults to iscsi_tcp and dm_multipath
+			Required_kernel_modules []string
+		}
+		Metrics struct {
+			// Time between updates of the staged volume and multipath path metrics
+			Collect_interval time.Duration
+		}
+	}
 }
 
 const (
 	DefualtConfigFile     string = "config.yaml"
 	EnvNameDriverConfFile string = "DRIVER_CONFIG_YML"
-)
+	DefaultJournalDir     string = "/var/lib/ibm-block-csi-driver/journal"
+	DefaultStageInfoDir   string = "/var/lib/ibm-block-csi-driver/stage-info"
 
-func ReadConfigFile(configFilePath string) (ConfigFile, error) {
-	var configFile ConfigFile
+	tracerShutdownTimeout = 10 * time.Second
 
-	configYamlPath := configFilePath
-	if configYamlPath == "" {
-		configYamlPath = DefualtConfigFile
-		klog.V(4).Infof("Not found config file environment variable %s. Set default value %s.", EnvNameDriverConfFile, configYamlPath)
-	} else {
-		klog.V(4).Infof("Config file environment variable %s=%s", EnvNameDriverConfFile, configYamlPath)
-	}
-
-	yamlFile, err := ioutil.ReadFile(configYamlPath)
-	if err != nil {
-		klog.Errorf("failed to read file %q: %v", yamlFile, err)
-		return ConfigFile{}, err
-	}
-
-	err = yaml.Unmarshal(yamlFile, &configFile)
-	if err != nil {
-		klog.Errorf("error unmarshaling yaml: %v", err)
-		return ConfigFile{}, err
-	}
-
-	// Verify mandatory attributes in config file
-	if configFile.Identity.Name == "" {
-		err := &ConfigYmlEmptyAttribute{"Identity.Name"}
-		klog.Errorf("%v", err)
-		return ConfigFile{}, err
-	}
-
-	if configFile.Identity.Version == "" {
-		err := &ConfigYmlEmptyAttribute{"Identity.Version"}
-		klog.Errorf("%v", err)
-		return ConfigFile{}, err
-	}
-
-	return configFile, nil
-}
+	// DefaultSocketMode is the unix socket mode when only a socket group is configured
+	DefaultSocketMode os.FileMode = 0660
+)
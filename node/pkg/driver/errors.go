@@ -17,15 +17,24 @@
 package driver
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-type ConfigYmlEmptyAttribute struct {
-	Attr string
+// ConfigValidationError lists all problems of the config file, each prefixed with its YAML path
+// or line.
+type ConfigValidationError struct {
+	Problems []string
 }
 
-func (e *ConfigYmlEmptyAttribute) Error() string {
-	return fmt.Sprintf("Missing attribute [%s] in driver config yaml file", e.Attr)
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("%d config file problem(s): %s", len(e.Problems), strings.Join(e.Problems, "; "))
 }
 
 type RequestValidationError struct {
@@ -35,3 +44,98 @@ type RequestValidationError struct {
 func (e *RequestValidationError) Error() string {
 	return fmt.Sprintf("Request Validation Error: %s", e.Msg)
 }
+
+// VolumeNotFoundError means the device of a volume is not on the node, for example no SCSI device
+// appeared for the LUN of the publish context.
+type VolumeNotFoundError struct {
+	VolumeId string
+	Msg      string
+}
+
+func (e *VolumeNotFoundError) Error() string {
+	return fmt.Sprintf("Volume [%s] not found: %s", e.VolumeId, e.Msg)
+}
+
+// PreconditionError means the node state does not allow the operation, for example the staging
+// path is already mounted from another device.
+type PreconditionError struct {
+	Msg string
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("Failed Precondition: %s", e.Msg)
+}
+
+// OperationInProgressError means another operation on the same volume is still running.
+type OperationInProgressError struct {
+	VolumeId  string
+	Operation string
+}
+
+func (e *OperationInProgressError) Error() string {
+	return fmt.Sprintf("Operation %s of volume [%s] is already in progress", e.Operation, e.VolumeId)
+}
+
+// TimeoutError means a host operation did not finish in time, for example waiting for the multipath
+// device of a volume.
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %v waiting for %s", e.Timeout, e.Operation)
+}
+
+// ResourceExhaustedError means the node has no room for another volume, for example all the LUN IDs
+// or volume slots are in use.
+type ResourceExhaustedError struct {
+	Msg string
+}
+
+func (e *ResourceExhaustedError) Error() string {
+	return fmt.Sprintf("Resource Exhausted: %s", e.Msg)
+}
+
+// toStatusError converts an error of the node service to the gRPC status error returned to the
+// container orchestrator. Status errors are returned unchanged and unknown errors are Internal.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(errorCode(err), err.Error())
+}
+
+func errorCode(err error) codes.Code {
+	switch e := err.(type) {
+	case *RequestValidationError:
+		return codes.InvalidArgument
+	case *VolumeNotFoundError:
+		return codes.NotFound
+	case *PreconditionError:
+		return codes.FailedPrecondition
+	case *OperationInProgressError:
+		return codes.Aborted
+	case *TimeoutError:
+		return codes.DeadlineExceeded
+	case *ResourceExhaustedError:
+		return codes.ResourceExhausted
+	case *executor.CommandError:
+		if e.TimedOut || e.Err == context.DeadlineExceeded {
+			return codes.DeadlineExceeded
+		}
+		if e.Err == context.Canceled {
+			return codes.Canceled
+		}
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case context.Canceled:
+		return codes.Canceled
+	}
+	return codes.Internal
+}
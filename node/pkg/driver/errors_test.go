@@ -0,0 +1,86 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToStatusError(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		expCode codes.Code
+	}{
+		{name: "validation", err: &RequestValidationError{"Volume ID not provided"}, expCode: codes.InvalidArgument},
+		{name: "volume not found", err: &VolumeNotFoundError{VolumeId: "vol-1", Msg: "no device for LUN 3"}, expCode: codes.NotFound},
+		{name: "precondition", err: &PreconditionError{"staging path is mounted from another device"}, expCode: codes.FailedPrecondition},
+		{name: "in progress", err: &OperationInProgressError{VolumeId: "vol-1", Operation: "stage"}, expCode: codes.Aborted},
+		{name: "timeout", err: &TimeoutError{Operation: "multipath device", Timeout: time.Minute}, expCode: codes.DeadlineExceeded},
+		{name: "exhausted", err: &ResourceExhaustedError{"no free LUN IDs"}, expCode: codes.ResourceExhausted},
+		{name: "command timeout", err: &executor.CommandError{Command: "iscsiadm", TimedOut: true}, expCode: codes.DeadlineExceeded},
+		{name: "command canceled", err: &executor.CommandError{Command: "iscsiadm", Err: context.Canceled}, expCode: codes.Canceled},
+		{name: "command failure", err: &executor.CommandError{Command: "iscsiadm", ExitCode: 1}, expCode: codes.Internal},
+		{name: "context deadline", err: context.DeadlineExceeded, expCode: codes.DeadlineExceeded},
+		{name: "status error", err: status.Error(codes.Unimplemented, "not yet"), expCode: codes.Unimplemented},
+		{name: "unknown error", err: fmt.Errorf("some error"), expCode: codes.Internal},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srvErr, ok := status.FromError(toStatusError(tc.err))
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expCode {
+				t.Fatalf("Expected error code %d, got %d message %s", tc.expCode, srvErr.Code(), srvErr.Message())
+			}
+		})
+	}
+
+	if toStatusError(nil) != nil {
+		t.Fatalf("Expected no error for a nil error")
+	}
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	panicking := func(ctx context.Context, req interface{}) (interface{}, error) {
+		var stageInfo *StageInfo
+		return stageInfo.VolumeId, nil
+	}
+	resp, err := recoveryInterceptor(context.TODO(), nil, info, panicking)
+	if resp != nil || status.Code(err) != codes.Internal {
+		t.Fatalf("Expected an Internal error after a panic, got %v, %v", resp, err)
+	}
+
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, &OperationInProgressError{VolumeId: "vol-1", Operation: "stage"}
+	}
+	if _, err := recoveryInterceptor(context.TODO(), nil, info, failing); status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected an Aborted error, got %v", err)
+	}
+}
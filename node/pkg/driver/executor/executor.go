@@ -0,0 +1,251 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	tracing "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/tracing"
+)
+
+const (
+	// DefaultTimeoutKey is the key in the timeouts map that applies to every command without its own entry.
+	DefaultTimeoutKey string = "default"
+
+	DefaultCommandTimeout time.Duration = 30 * time.Second
+
+	// ExecModeDirect runs the host tools shipped in the driver container image.
+	ExecModeDirect string = "direct"
+	// ExecModeNsenter runs the host tools in the mount namespace of the host PID 1 (requires hostPID).
+	ExecModeNsenter string = "nsenter"
+	// ExecModeChroot runs the host tools after a chroot into the host root file system mounted in the container.
+	ExecModeChroot string = "chroot"
+
+	DefaultChrootDir string = "/host"
+	nsenterTargetPid string = "1"
+)
+
+// Executor runs host tools (iscsiadm, multipath, mkfs, blkid, resize2fs, xfs_growfs, fsck ...) on behalf of the node service.
+type Executor interface {
+	// Execute runs the command with the given args and returns its stdout.
+	// The command is killed when ctx is done or when its configured timeout expires.
+	// On failure the returned error is a *CommandError.
+	Execute(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// CommandError describes a host command that failed, timed out or was canceled.
+type CommandError struct {
+	Command  string
+	Args     []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	TimedOut bool
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	cmdLine := strings.TrimSpace(e.Command + " " + strings.Join(e.Args, " "))
+	if e.TimedOut {
+		return fmt.Sprintf("command [%s] timed out: %v", cmdLine, e.Err)
+	}
+	msg := fmt.Sprintf("command [%s] failed with exit code %d: %v", cmdLine, e.ExitCode, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg = fmt.Sprintf("%s, stderr: %s", msg, stderr)
+	}
+	return msg
+}
+
+// IsTimeout returns true if err is a *CommandError of a command killed by its timeout.
+func IsTimeout(err error) bool {
+	cmdErr, ok := err.(*CommandError)
+	return ok && cmdErr.TimedOut
+}
+
+// TimeoutSetter is implemented by executors whose command timeouts can change while they run.
+type TimeoutSetter interface {
+	SetTimeouts(timeouts map[string]time.Duration)
+}
+
+// ToolFinder is implemented by executors that can tell whether a host tool is installed where they
+// run it.
+type ToolFinder interface {
+	HasTool(name string) bool
+}
+
+// chrootToolDirs are the directories of the host root file system searched for a host tool in
+// ExecModeChroot
+var chrootToolDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+type executor struct {
+	// mu guards timeouts, which SetTimeouts replaces on a config reload
+	mu        sync.RWMutex
+	timeouts  map[string]time.Duration
+	mode      string
+	chrootDir string
+}
+
+// NewExecutor returns an Executor that runs commands directly in the driver container.
+// timeouts maps a command name (e.g. "iscsiadm", "mkfs") to its timeout, DefaultTimeoutKey sets the
+// timeout for all other commands.
+func NewExecutor(timeouts map[string]time.Duration) Executor {
+	return &executor{timeouts: timeouts, mode: ExecModeDirect}
+}
+
+// NewExecutorWithMode returns an Executor that runs commands according to mode, one of
+// ExecModeDirect, ExecModeNsenter or ExecModeChroot. chrootDir is only used by ExecModeChroot.
+func NewExecutorWithMode(mode string, chrootDir string, timeouts map[string]time.Duration) (Executor, error) {
+	switch mode {
+	case "", ExecModeDirect:
+		return NewExecutor(timeouts), nil
+	case ExecModeNsenter:
+		if _, err := os.Stat(fmt.Sprintf("/proc/%s/ns/mnt", nsenterTargetPid)); err != nil {
+			return nil, fmt.Errorf("exec mode %s requires access to the host PID namespace (hostPID): %v", mode, err)
+		}
+	case ExecModeChroot:
+		if chrootDir == "" || chrootDir == "/" {
+			chrootDir = DefaultChrootDir
+		}
+		info, err := os.Stat(chrootDir)
+		if err != nil {
+			return nil, fmt.Errorf("exec mode %s requires the host root directory %q: %v", mode, chrootDir, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("exec mode %s requires the host root directory %q, but it is not a directory", mode, chrootDir)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported exec mode %q, supported modes are %s, %s and %s", mode, ExecModeDirect, ExecModeNsenter, ExecModeChroot)
+	}
+
+	logging.Infof("Host commands will run in %s mode", mode)
+	return &executor{timeouts: timeouts, mode: mode, chrootDir: chrootDir}, nil
+}
+
+func (e *executor) Execute(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx, "exec "+name)
+	defer span.Finish()
+	span.SetAttribute(tracing.AttrCommand, strings.Join(append([]string{name}, args...), " "))
+
+	e.mu.RLock()
+	timeout := CommandTimeout(e.timeouts, name)
+	e.mu.RUnlock()
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmdName, cmdArgs := e.wrapCommand(name, args)
+	cmd := exec.CommandContext(cmdCtx, cmdName, cmdArgs...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logging.FromContext(ctx).V(5).Infof("Executing command: %s %s (timeout %v)", cmdName, strings.Join(cmdArgs, " "), timeout)
+	start := time.Now()
+	err := cmd.Run()
+	logging.FromContext(ctx).V(5).Infof("Command %s finished after %v", name, time.Since(start))
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+
+	cmdErr := &CommandError{
+		Command:  name,
+		Args:     args,
+		ExitCode: -1,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Err:      err,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		cmdErr.ExitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		// The caller (usually the RPC) was canceled or reached its own deadline.
+		cmdErr.Err = ctx.Err()
+	} else if cmdCtx.Err() == context.DeadlineExceeded {
+		cmdErr.TimedOut = true
+		cmdErr.Err = fmt.Errorf("exceeded timeout of %v", timeout)
+	}
+	span.RecordError(cmdErr)
+	return stdout.Bytes(), cmdErr
+}
+
+// wrapCommand returns the command line that runs name with args in the executor mode.
+func (e *executor) wrapCommand(name string, args []string) (string, []string) {
+	switch e.mode {
+	case ExecModeNsenter:
+		wrapped := []string{"--target", nsenterTargetPid, "--mount", "--uts", "--ipc", "--net", "--", name}
+		return "nsenter", append(wrapped, args...)
+	case ExecModeChroot:
+		return "chroot", append([]string{e.chrootDir, name}, args...)
+	default:
+		return name, args
+	}
+}
+
+// SetTimeouts replaces the command timeouts, commands that are running keep their timeout.
+func (e *executor) SetTimeouts(timeouts map[string]time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timeouts = timeouts
+}
+
+// HasTool returns false if the host tool is not installed where the commands run. In ExecModeNsenter
+// the tools run in the host mount namespace, which the container cannot search, so they are assumed
+// to be installed.
+func (e *executor) HasTool(name string) bool {
+	switch e.mode {
+	case ExecModeNsenter:
+		return true
+	case ExecModeChroot:
+		for _, dir := range chrootToolDirs {
+			if info, err := os.Stat(filepath.Join(e.chrootDir, dir, name)); err == nil && !info.IsDir() {
+				return true
+			}
+		}
+		return false
+	default:
+		_, err := exec.LookPath(name)
+		return err == nil
+	}
+}
+
+// CommandTimeout returns the timeout configured for the command.
+// Lookup order is the exact base name (mkfs.ext4), the name before the first dot (mkfs), the
+// DefaultTimeoutKey entry and finally DefaultCommandTimeout.
+func CommandTimeout(timeouts map[string]time.Duration, name string) time.Duration {
+	base := filepath.Base(name)
+	if timeout, ok := timeouts[base]; ok && timeout > 0 {
+		return timeout
+	}
+	if i := strings.Index(base, "."); i > 0 {
+		if timeout, ok := timeouts[base[:i]]; ok && timeout > 0 {
+			return timeout
+		}
+	}
+	if timeout, ok := timeouts[DefaultTimeoutKey]; ok && timeout > 0 {
+		return timeout
+	}
+	return DefaultCommandTimeout
+}
@@ -0,0 +1,281 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecute(t *testing.T) {
+	testCases := []struct {
+		name        string
+		command     string
+		args        []string
+		timeouts    map[string]time.Duration
+		expStdout   string
+		expErr      bool
+		expExitCode int
+		expStderr   string
+		expTimedOut bool
+	}{
+		{
+			name:      "success with stdout",
+			command:   "echo",
+			args:      []string{"-n", "hello"},
+			expStdout: "hello",
+		},
+		{
+			name:        "failure captures stderr and exit code",
+			command:     "sh",
+			args:        []string{"-c", "echo -n out; echo err >&2; exit 3"},
+			expStdout:   "out",
+			expErr:      true,
+			expExitCode: 3,
+			expStderr:   "err\n",
+		},
+		{
+			name:        "command timeout",
+			command:     "sleep",
+			args:        []string{"5"},
+			timeouts:    map[string]time.Duration{"sleep": 50 * time.Millisecond},
+			expErr:      true,
+			expExitCode: -1,
+			expTimedOut: true,
+		},
+		{
+			name:        "non existing command",
+			command:     "/non/existent/command",
+			expErr:      true,
+			expExitCode: -1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewExecutor(tc.timeouts)
+
+			out, err := e.Execute(context.TODO(), tc.command, tc.args...)
+
+			if string(out) != tc.expStdout {
+				t.Fatalf("stdout mismatches: expected %q, got %q", tc.expStdout, string(out))
+			}
+			if !tc.expErr {
+				if err != nil {
+					t.Fatalf("err is not nil. got: %v", err)
+				}
+				return
+			}
+			cmdErr, ok := err.(*CommandError)
+			if !ok {
+				t.Fatalf("Expected *CommandError, got %T: %v", err, err)
+			}
+			if cmdErr.ExitCode != tc.expExitCode {
+				t.Fatalf("exit code mismatches: expected %d, got %d", tc.expExitCode, cmdErr.ExitCode)
+			}
+			if cmdErr.Stderr != tc.expStderr {
+				t.Fatalf("stderr mismatches: expected %q, got %q", tc.expStderr, cmdErr.Stderr)
+			}
+			if IsTimeout(err) != tc.expTimedOut {
+				t.Fatalf("timeout mismatches: expected %v, got %v", tc.expTimedOut, IsTimeout(err))
+			}
+		})
+	}
+}
+
+func TestExecuteContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := NewExecutor(nil).Execute(ctx, "sleep", "5")
+	if time.Since(start) > 3*time.Second {
+		t.Fatalf("command was not killed when the context was canceled")
+	}
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		t.Fatalf("Expected *CommandError, got %T: %v", err, err)
+	}
+	if cmdErr.Err != context.Canceled || cmdErr.TimedOut {
+		t.Fatalf("Expected canceled error, got %v", err)
+	}
+}
+
+func TestNewExecutorWithMode(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mode      string
+		chrootDir string
+		expErr    bool
+	}{
+		{name: "default mode", mode: ""},
+		{name: "direct mode", mode: ExecModeDirect},
+		{name: "chroot mode", mode: ExecModeChroot, chrootDir: os.TempDir()},
+		{name: "chroot mode with missing dir", mode: ExecModeChroot, chrootDir: "/non/existent/path", expErr: true},
+		{name: "unsupported mode", mode: "ssh", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewExecutorWithMode(tc.mode, tc.chrootDir, nil)
+			if tc.expErr && err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+			if !tc.expErr && err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+		})
+	}
+}
+
+func TestHasTool(t *testing.T) {
+	chrootDir, err := ioutil.TempDir("", "chroot-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+	if err := os.MkdirAll(filepath.Join(chrootDir, "usr/sbin"), 0755); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(chrootDir, "usr/sbin/multipathd"), nil, 0755); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	testCases := []struct {
+		mode    string
+		tool    string
+		expHave bool
+	}{
+		{mode: ExecModeDirect, tool: "sh", expHave: true},
+		{mode: ExecModeDirect, tool: "no-such-tool-ibm-csi"},
+		{mode: ExecModeChroot, tool: "multipathd", expHave: true},
+		{mode: ExecModeChroot, tool: "iscsiadm"},
+		{mode: ExecModeNsenter, tool: "no-such-tool-ibm-csi", expHave: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode+" "+tc.tool, func(t *testing.T) {
+			e := &executor{mode: tc.mode, chrootDir: chrootDir}
+			if have := e.HasTool(tc.tool); have != tc.expHave {
+				t.Fatalf("Expected HasTool(%s) %v, got %v", tc.tool, tc.expHave, have)
+			}
+		})
+	}
+}
+
+func TestWrapCommand(t *testing.T) {
+	testCases := []struct {
+		mode    string
+		expName string
+		expArgs []string
+	}{
+		{
+			mode:    ExecModeDirect,
+			expName: "iscsiadm",
+			expArgs: []string{"-m", "session"},
+		},
+		{
+			mode:    ExecModeNsenter,
+			expName: "nsenter",
+			expArgs: []string{"--target", "1", "--mount", "--uts", "--ipc", "--net", "--", "iscsiadm", "-m", "session"},
+		},
+		{
+			mode:    ExecModeChroot,
+			expName: "chroot",
+			expArgs: []string{"/host", "iscsiadm", "-m", "session"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			e := &executor{mode: tc.mode, chrootDir: DefaultChrootDir}
+
+			name, args := e.wrapCommand("iscsiadm", []string{"-m", "session"})
+			if name != tc.expName {
+				t.Fatalf("command mismatches: expected %v, got %v", tc.expName, name)
+			}
+			if !reflect.DeepEqual(args, tc.expArgs) {
+				t.Fatalf("args mismatches: expected %v, got %v", tc.expArgs, args)
+			}
+		})
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	timeouts := map[string]time.Duration{
+		DefaultTimeoutKey: 10 * time.Second,
+		"mkfs":            5 * time.Minute,
+		"mkfs.xfs":        time.Minute,
+	}
+	testCases := []struct {
+		command    string
+		timeouts   map[string]time.Duration
+		expTimeout time.Duration
+	}{
+		{command: "mkfs.xfs", timeouts: timeouts, expTimeout: time.Minute},
+		{command: "mkfs.ext4", timeouts: timeouts, expTimeout: 5 * time.Minute},
+		{command: "/sbin/mkfs", timeouts: timeouts, expTimeout: 5 * time.Minute},
+		{command: "iscsiadm", timeouts: timeouts, expTimeout: 10 * time.Second},
+		{command: "iscsiadm", timeouts: nil, expTimeout: DefaultCommandTimeout},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.command, func(t *testing.T) {
+			if timeout := CommandTimeout(tc.timeouts, tc.command); timeout != tc.expTimeout {
+				t.Fatalf("timeout mismatches: expected %v, got %v", tc.expTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestFakeExecutor(t *testing.T) {
+	scriptedErr := &CommandError{Command: "iscsiadm", ExitCode: 21, Err: fmt.Errorf("exit status 21")}
+	fake := NewFakeExecutor(
+		FakeCommand{Name: "multipath", Args: []string{"-ll"}, Stdout: "mpatha"},
+		FakeCommand{Name: "iscsiadm", Args: []string{"-m", "session"}, Err: scriptedErr},
+	)
+
+	out, err := fake.Execute(context.TODO(), "multipath", "-ll")
+	if err != nil || string(out) != "mpatha" {
+		t.Fatalf("Expected scripted output, got %q, %v", out, err)
+	}
+	if _, err := fake.Execute(context.TODO(), "iscsiadm", "-m", "session"); err != scriptedErr {
+		t.Fatalf("Expected scripted error, got %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatalf("Expected script to be fully consumed, got %v", err)
+	}
+
+	if _, err := fake.Execute(context.TODO(), "blkid"); err == nil {
+		t.Fatalf("Expected error for unexpected command")
+	}
+	if err := fake.Verify(); err == nil || !strings.Contains(err.Error(), "unexpected command [blkid ]") {
+		t.Fatalf("Expected verify to report unexpected command, got %v", err)
+	}
+	if len(fake.Calls) != 3 {
+		t.Fatalf("Expected 3 recorded calls, got %d", len(fake.Calls))
+	}
+}
@@ -0,0 +1,105 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// FakeCommand is one scripted step of a FakeExecutor.
+type FakeCommand struct {
+	Name   string
+	Args   []string
+	Stdout string
+	// Err is returned as is when set, use a *CommandError to simulate a failing host tool.
+	Err error
+}
+
+// FakeExecutor is an Executor for tests. It expects the scripted commands to be executed in order,
+// returns their scripted output and records every call it gets.
+type FakeExecutor struct {
+	mu       sync.Mutex
+	script   []FakeCommand
+	Calls    []FakeCommand
+	failures []string
+}
+
+func NewFakeExecutor(script ...FakeCommand) *FakeExecutor {
+	return &FakeExecutor{script: script}
+}
+
+// AddCommand appends a step to the script.
+func (f *FakeExecutor) AddCommand(cmd FakeCommand) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, cmd)
+}
+
+func (f *FakeExecutor) Execute(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Calls = append(f.Calls, FakeCommand{Name: name, Args: args})
+
+	if ctx.Err() != nil {
+		return nil, &CommandError{Command: name, Args: args, ExitCode: -1, Err: ctx.Err()}
+	}
+
+	if len(f.script) == 0 {
+		msg := fmt.Sprintf("unexpected command [%s %s]", name, strings.Join(args, " "))
+		f.failures = append(f.failures, msg)
+		return nil, &CommandError{Command: name, Args: args, ExitCode: -1, Err: errors.New(msg)}
+	}
+
+	expected := f.script[0]
+	f.script = f.script[1:]
+	if expected.Name != name || !equalArgs(expected.Args, args) {
+		msg := fmt.Sprintf("expected command [%s %s], got [%s %s]",
+			expected.Name, strings.Join(expected.Args, " "), name, strings.Join(args, " "))
+		f.failures = append(f.failures, msg)
+		return nil, &CommandError{Command: name, Args: args, ExitCode: -1, Err: errors.New(msg)}
+	}
+
+	return []byte(expected.Stdout), expected.Err
+}
+
+// Verify returns an error if a call did not match the script or if scripted commands were not executed.
+func (f *FakeExecutor) Verify() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failures := f.failures
+	for _, cmd := range f.script {
+		failures = append(failures, fmt.Sprintf("command [%s %s] was not executed", cmd.Name, strings.Join(cmd.Args, " ")))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("fake executor: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func equalArgs(expected, actual []string) bool {
+	if len(expected) == 0 && len(actual) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(expected, actual)
+}
@@ -0,0 +1,181 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+const (
+	sysModulePath = "/sys/module"
+
+	// iscsiadm exit code when iscsid is reachable but there are no sessions
+	iscsiadmErrNoObjsFound = 21
+
+	// healthCheckTimeout bounds each check, so a hung host command fails the check before the
+	// livenessprobe sidecar gives up on the Probe call
+	healthCheckTimeout = 2 * time.Second
+)
+
+var (
+	DefaultRequiredKernelModules = []string{"iscsi_tcp", "dm_multipath"}
+	// iscsiKernelModules are required only on nodes that use iSCSI
+	iscsiKernelModules = map[string]bool{"iscsi_tcp": true}
+)
+
+// healthCheck is one check of the node health, it returns an error with the reason of a failure.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkHealth runs all the configured health checks and returns the reasons of the failed ones. The
+// metrics get the result of every check that ran.
+func (d *nodeService) checkHealth(ctx context.Context) []string {
+	var failures []string
+	failedByCheck := map[string]bool{}
+	for _, hc := range d.healthChecks() {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := hc.check(checkCtx)
+		cancel()
+		failedByCheck[hc.name] = err != nil
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", hc.name, err))
+		}
+	}
+	d.metrics.SetHealthChecks(failedByCheck)
+	return failures
+}
+
+func (d *nodeService) healthChecks() []healthCheck {
+	healthConfig := d.currentConfig().Node.Health
+	usesIscsi := d.usesIscsi()
+	checks := []healthCheck{
+		{name: "host root", check: d.checkHostRoot},
+	}
+	if usesIscsi {
+		checks = append(checks, healthCheck{name: "initiator identity", check: d.checkInitiatorIdentity})
+	}
+	checks = append(checks, healthCheck{name: "kernel modules", check: func(ctx context.Context) error {
+		return d.checkKernelModules(ctx, usesIscsi)
+	}})
+	if healthConfig.Check_iscsid && usesIscsi && d.hasTool("iscsiadm") {
+		checks = append(checks, healthCheck{name: "iscsid", check: d.checkIscsid})
+	}
+	if healthConfig.Check_multipathd && d.hasTool("multipathd") {
+		checks = append(checks, healthCheck{name: "multipathd", check: d.checkMultipathd})
+	}
+	return checks
+}
+
+// hasTool tells if the host tool is installed where the host commands run, executors that cannot
+// tell are assumed to have it. The daemon checks are skipped without their tool, e.g. in the direct
+// exec mode with an image that does not ship it.
+func (d *nodeService) hasTool(name string) bool {
+	finder, ok := d.executor.(executor.ToolFinder)
+	if !ok || finder.HasTool(name) {
+		return true
+	}
+	logging.V(4).Infof("Skipping the health check of %s, it is not installed where host commands run", name)
+	return false
+}
+
+// checkHostRoot verifies that the host root file system is mounted, an empty mount point means the
+// host path volume is missing.
+func (d *nodeService) checkHostRoot(ctx context.Context) error {
+	if d.hostRoot == "" || d.hostRoot == "/" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(string(d.hostRoot))
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("host root %s is empty, the host file system is not mounted", d.hostRoot)
+	}
+	return nil
+}
+
+// usesIscsi tells if the node attaches volumes over iSCSI: it has an iSCSI initiator name, or no
+// FC host ports to attach them otherwise.
+func (d *nodeService) usesIscsi() bool {
+	if _, err := os.Stat(d.hostRoot.Path(iscsiInitiatorNamePath)); err == nil {
+		return true
+	}
+	_, err := readFcPortNames(d.hostRoot.Path(fcHostPath))
+	return err != nil
+}
+
+func (d *nodeService) checkInitiatorIdentity(ctx context.Context) error {
+	_, err := d.nodeUtils.ParseIscsiInitiators(d.hostRoot.Path(iscsiInitiatorNamePath))
+	return err
+}
+
+func (d *nodeService) checkKernelModules(ctx context.Context, usesIscsi bool) error {
+	modules := d.currentConfig().Node.Health.Required_kernel_modules
+	if modules == nil {
+		modules = DefaultRequiredKernelModules
+	}
+	var missing []string
+	for _, module := range modules {
+		if iscsiKernelModules[module] && !usesIscsi {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.hostRoot.Path(sysModulePath), module)); err != nil {
+			missing = append(missing, module)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("modules %s are not loaded", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (d *nodeService) checkIscsid(ctx context.Context) error {
+	_, err := d.executor.Execute(ctx, "iscsiadm", "-m", "session")
+	if cmdErr, ok := err.(*executor.CommandError); ok && cmdErr.ExitCode == iscsiadmErrNoObjsFound {
+		return nil
+	}
+	return err
+}
+
+func (d *nodeService) checkMultipathd(ctx context.Context) error {
+	out, err := d.executor.Execute(ctx, "multipathd", "show", "daemon")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(out), "running") {
+		return fmt.Errorf("multipathd is not running: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// logHealthFailures logs the reasons of a failed health check.
+func logHealthFailures(failures []string) {
+	for _, failure := range failures {
+		logging.Warningf("Health check failed: %s", failure)
+	}
+}
@@ -0,0 +1,264 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	gomock "github.com/golang/mock/gomock"
+	mocks "github.com/ibm/ibm-block-csi-driver/node/mocks"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbe(t *testing.T) {
+	testCases := []struct {
+		name           string
+		modules        []string
+		initiatorErr   error
+		checkDaemons   bool
+		fcOnly         bool
+		script         []executor.FakeCommand
+		expReady       bool
+		expFailedCheck int
+	}{
+		{
+			name:     "healthy without daemon checks",
+			modules:  []string{"iscsi_tcp", "dm_multipath"},
+			expReady: true,
+		},
+		{
+			name:         "healthy with daemon checks and no iscsi sessions",
+			modules:      []string{"iscsi_tcp", "dm_multipath"},
+			checkDaemons: true,
+			script: []executor.FakeCommand{
+				{Name: "iscsiadm", Args: []string{"-m", "session"}, Err: &executor.CommandError{ExitCode: 21, Err: fmt.Errorf("exit status 21")}},
+				{Name: "multipathd", Args: []string{"show", "daemon"}, Stdout: "pid 1234 running\n"},
+			},
+			expReady: true,
+		},
+		{
+			name:           "unreadable initiator identity",
+			modules:        []string{"iscsi_tcp", "dm_multipath"},
+			initiatorErr:   fmt.Errorf("no such file"),
+			expFailedCheck: 1,
+		},
+		{
+			name:           "missing kernel module",
+			modules:        []string{"iscsi_tcp"},
+			expFailedCheck: 1,
+		},
+		{
+			name:         "unreachable daemons",
+			modules:      []string{"iscsi_tcp", "dm_multipath"},
+			checkDaemons: true,
+			script: []executor.FakeCommand{
+				{Name: "iscsiadm", Args: []string{"-m", "session"}, Err: &executor.CommandError{ExitCode: 20, Err: fmt.Errorf("exit status 20")}},
+				{Name: "multipathd", Args: []string{"show", "daemon"}, Stdout: "pid 0 idle\n"},
+			},
+			expFailedCheck: 2,
+		},
+		{
+			name:         "fc only node skips the iscsi checks",
+			modules:      []string{"dm_multipath"},
+			checkDaemons: true,
+			fcOnly:       true,
+			script: []executor.FakeCommand{
+				{Name: "multipathd", Args: []string{"show", "daemon"}, Stdout: "pid 1234 running\n"},
+			},
+			expReady: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			defer host.cleanup()
+			for _, module := range tc.modules {
+				host.mkdir("/sys/module/" + module)
+			}
+			initiatorCalls := 2
+			if tc.fcOnly {
+				host.writeFile(fcHostPath+"/host1/port_name", "0x10000000c9a1b2c3\n")
+				initiatorCalls = 0
+			}
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtrl)
+			fakeNodeUtils.EXPECT().ParseIscsiInitiators(host.root+iscsiInitiatorNamePath).Return("iqn.1994-07.com.redhat:e123456789", tc.initiatorErr).Times(initiatorCalls)
+
+			d := &Driver{nodeService: newTestNodeServiceWithHost(host, nil)}
+			d.nodeUtils = fakeNodeUtils
+			d.configYaml.Node.Health.Check_iscsid = tc.checkDaemons
+			d.configYaml.Node.Health.Check_multipathd = tc.checkDaemons
+
+			fakeExec := executor.NewFakeExecutor(tc.script...)
+			d.executor = fakeExec
+			if failures := d.checkHealth(context.TODO()); len(failures) != tc.expFailedCheck {
+				t.Fatalf("Expected %d failed checks, got %v", tc.expFailedCheck, failures)
+			}
+			if err := fakeExec.Verify(); err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			d.executor = executor.NewFakeExecutor(tc.script...)
+			resp, err := d.Probe(context.TODO(), &csi.ProbeRequest{})
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if resp.GetReady().GetValue() != tc.expReady {
+				t.Fatalf("Expected ready %v, got %v", tc.expReady, resp.GetReady().GetValue())
+			}
+		})
+	}
+}
+
+// missingTools is a fake executor without some host tools.
+type missingTools struct {
+	executor.Executor
+	tools map[string]bool
+}
+
+func (m *missingTools) HasTool(name string) bool {
+	return !m.tools[name]
+}
+
+func TestHealthChecksWithoutTools(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.writeFile(iscsiInitiatorNamePath, "InitiatorName=iqn.1994-07.com.redhat:e123456789\n")
+	for _, module := range DefaultRequiredKernelModules {
+		host.mkdir("/sys/module/" + module)
+	}
+
+	// only the multipathd check runs, the image has no iscsiadm
+	fakeExec := executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "multipathd", Args: []string{"show", "daemon"}, Stdout: "pid 0 idle\n"},
+	)
+	d := newTestNodeServiceWithHost(host, &missingTools{Executor: fakeExec, tools: map[string]bool{"iscsiadm": true}})
+	d.nodeUtils = NewNodeUtils()
+	d.configYaml.Node.Health.Check_iscsid = true
+	d.configYaml.Node.Health.Check_multipathd = true
+	d.metrics = metrics.NewMetrics()
+
+	failures := d.checkHealth(context.TODO())
+	if len(failures) != 1 || !strings.HasPrefix(failures[0], "multipathd:") {
+		t.Fatalf("Expected only the multipathd check to fail, got %v", failures)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `
+# HELP ibm_block_csi_node_health_check_failed Whether the health check failed in the last Probe or health request, 1 or 0, by check.
+# TYPE ibm_block_csi_node_health_check_failed gauge
+ibm_block_csi_node_health_check_failed{check="host root"} 0
+ibm_block_csi_node_health_check_failed{check="initiator identity"} 0
+ibm_block_csi_node_health_check_failed{check="kernel modules"} 0
+ibm_block_csi_node_health_check_failed{check="multipathd"} 1
+`
+	if err := testutil.GatherAndCompare(d.metrics.Registry(), strings.NewReader(expected), "ibm_block_csi_node_health_check_failed"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// deadlineRecorder is a fake executor that records the deadline of the commands it runs.
+type deadlineRecorder struct {
+	executor.Executor
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) Execute(ctx context.Context, name string, args ...string) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	r.deadlines = append(r.deadlines, deadline)
+	return r.Executor.Execute(ctx, name, args...)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.writeFile(fcHostPath+"/host1/port_name", "0x10000000c9a1b2c3\n")
+	host.mkdir("/sys/module/dm_multipath")
+
+	recorder := &deadlineRecorder{Executor: executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "multipathd", Args: []string{"show", "daemon"}, Stdout: "pid 1234 running\n"},
+	)}
+	d := newTestNodeServiceWithHost(host, recorder)
+	d.configYaml.Node.Health.Check_multipathd = true
+
+	start := time.Now()
+	if failures := d.checkHealth(context.TODO()); len(failures) != 0 {
+		t.Fatalf("Expected no failed checks, got %v", failures)
+	}
+	if len(recorder.deadlines) != 1 || recorder.deadlines[0].IsZero() || recorder.deadlines[0].After(start.Add(healthCheckTimeout+time.Second)) {
+		t.Fatalf("Expected the check to run within %v, got deadlines %v", healthCheckTimeout, recorder.deadlines)
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	for _, module := range DefaultRequiredKernelModules {
+		host.mkdir("/sys/module/" + module)
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtrl)
+	fakeNodeUtils.EXPECT().ParseIscsiInitiators(host.root+iscsiInitiatorNamePath).Return("iqn.1994-07.com.redhat:e123456789", nil).AnyTimes()
+
+	d := &Driver{nodeService: newTestNodeServiceWithHost(host, executor.NewFakeExecutor())}
+	d.nodeUtils = fakeNodeUtils
+
+	get := func(handler http.HandlerFunc, path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, body := get(d.serveHealthz, healthzPath); code != http.StatusOK {
+		t.Fatalf("Expected healthz status %d, got %d: %s", http.StatusOK, code, body)
+	}
+	if code, body := get(d.serveReadyz, readyzPath); code != http.StatusServiceUnavailable || !strings.Contains(body, "reconciliation") {
+		t.Fatalf("Expected readyz status %d before reconciliation, got %d: %s", http.StatusServiceUnavailable, code, body)
+	}
+
+	d.setReconciled()
+	if code, body := get(d.serveReadyz, readyzPath); code != http.StatusOK {
+		t.Fatalf("Expected readyz status %d, got %d: %s", http.StatusOK, code, body)
+	}
+
+	if err := os.RemoveAll(filepath.Join(host.root, sysModulePath, "dm_multipath")); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if code, body := get(d.serveHealthz, healthzPath); code != http.StatusInternalServerError || !strings.Contains(body, "dm_multipath") {
+		t.Fatalf("Expected healthz status %d, got %d: %s", http.StatusInternalServerError, code, body)
+	}
+	if code, _ := get(d.serveReadyz, readyzPath); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected readyz status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
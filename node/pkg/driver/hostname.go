@@ -0,0 +1,122 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	// EnvNameNodeName and EnvNameKubeNodeName carry the Kubernetes node name, usually set from
+	// spec.nodeName with the downward API
+	EnvNameNodeName     = "NODE_NAME"
+	EnvNameKubeNodeName = "KUBE_NODE_NAME"
+
+	// MaxArrayHostNameLength is the longest host object name the storage arrays accept
+	MaxArrayHostNameLength = 63
+)
+
+var (
+	// arrayHostNamePattern are the characters the storage arrays accept in host object names, it also
+	// keeps the node ID delimiter out of the name
+	arrayHostNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+	hostNameTemplateFuncs = template.FuncMap{
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"trunc": func(length int, s string) string {
+			if len(s) > length {
+				return s[:length]
+			}
+			return s
+		},
+	}
+)
+
+// hostNameTemplateData are the fields of the host name template.
+type hostNameTemplateData struct {
+	// NodeName is the Kubernetes node name
+	NodeName string
+	// ShortName is the node name up to the first dot
+	ShortName string
+}
+
+// detectNodeName returns the Kubernetes node name from the environment, or the host name of the OS.
+func detectNodeName(getenv func(string) string, osHostname func() (string, error)) (string, error) {
+	for _, env := range []string{EnvNameNodeName, EnvNameKubeNodeName} {
+		if name := strings.TrimSpace(getenv(env)); name != "" {
+			return name, nil
+		}
+	}
+	name, err := osHostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to detect the node name, set %s or --hostname: %v", EnvNameNodeName, err)
+	}
+	return name, nil
+}
+
+// parseHostNameTemplate parses the host name template of the config, nil if there is none.
+func parseHostNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("host_name").Funcs(hostNameTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// arrayHostName returns the name of the host object on the storage array for the node: the entry of
+// the mapping table, else the result of the template, else the node name itself.
+func arrayHostName(nodeName string, config ConfigFile) (string, error) {
+	hostNameConfig := config.Node.Host_name
+	name, ok := hostNameConfig.Mapping[nodeName]
+	if !ok {
+		name = nodeName
+		tmpl, err := parseHostNameTemplate(hostNameConfig.Template)
+		if err != nil {
+			return "", fmt.Errorf("invalid node.host_name.template: %v", err)
+		}
+		if tmpl != nil {
+			var out bytes.Buffer
+			data := hostNameTemplateData{NodeName: nodeName, ShortName: strings.SplitN(nodeName, ".", 2)[0]}
+			if err := tmpl.Execute(&out, data); err != nil {
+				return "", fmt.Errorf("failed to apply node.host_name.template to node %s: %v", nodeName, err)
+			}
+			name = strings.TrimSpace(out.String())
+		}
+	}
+	if err := validateArrayHostName(name); err != nil {
+		return "", fmt.Errorf("host name of node %s: %v", nodeName, err)
+	}
+	return name, nil
+}
+
+// validateArrayHostName verifies that the storage arrays accept the name for a host object.
+func validateArrayHostName(name string) error {
+	if len(name) > MaxArrayHostNameLength {
+		return fmt.Errorf("%q is longer than %d characters", name, MaxArrayHostNameLength)
+	}
+	if !arrayHostNamePattern.MatchString(name) {
+		return fmt.Errorf("%q must start with a letter or digit and contain only letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetectNodeName(t *testing.T) {
+	testCases := []struct {
+		name        string
+		env         map[string]string
+		hostnameErr error
+		expName     string
+		expErr      bool
+	}{
+		{name: "node name", env: map[string]string{"NODE_NAME": "worker-1", "KUBE_NODE_NAME": "worker-2"}, expName: "worker-1"},
+		{name: "kube node name", env: map[string]string{"NODE_NAME": " ", "KUBE_NODE_NAME": "worker-2"}, expName: "worker-2"},
+		{name: "os host name", expName: "os-host"},
+		{name: "os host name fails", hostnameErr: errors.New("no uts"), expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			getenv := func(key string) string { return tc.env[key] }
+			osHostname := func() (string, error) { return "os-host", tc.hostnameErr }
+			name, err := detectNodeName(getenv, osHostname)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got name %q", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if name != tc.expName {
+				t.Fatalf("Expected name %q, got %q", tc.expName, name)
+			}
+		})
+	}
+}
+
+func TestArrayHostName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		nodeName string
+		mapping  map[string]string
+		template string
+		expName  string
+		expErr   bool
+	}{
+		{name: "node name", nodeName: "worker-1.example.com", expName: "worker-1.example.com"},
+		{name: "mapping", nodeName: "worker-1", mapping: map[string]string{"worker-1": "k8s_w1"}, template: "{{ upper .NodeName }}", expName: "k8s_w1"},
+		{name: "template", nodeName: "Worker-1.example.com", mapping: map[string]string{"worker-2": "k8s_w2"}, template: "k8s_{{ .ShortName | lower }}", expName: "k8s_worker-1"},
+		{name: "template functions", nodeName: "ip-10-0-0-1.ec2.internal", template: `{{ .NodeName | trimSuffix ".ec2.internal" | replace "-" "_" | trunc 8 }}`, expName: "ip_10_0_"},
+		{name: "too long", nodeName: strings.Repeat("a", MaxArrayHostNameLength+1), expErr: true},
+		{name: "truncated", nodeName: strings.Repeat("a", MaxArrayHostNameLength+1), template: "{{ trunc 63 .NodeName }}", expName: strings.Repeat("a", MaxArrayHostNameLength)},
+		{name: "node id delimiter", nodeName: "worker;1", expErr: true},
+		{name: "leading dash", nodeName: "worker", template: "-{{ .NodeName }}", expErr: true},
+		{name: "empty", nodeName: "worker", template: "{{ if false }}x{{ end }}", expErr: true},
+		{name: "invalid mapping", nodeName: "worker", mapping: map[string]string{"worker": "k8s worker"}, expErr: true},
+		{name: "unknown field", nodeName: "worker", template: "{{ .Zone }}", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var config ConfigFile
+			config.Node.Host_name.Mapping = tc.mapping
+			config.Node.Host_name.Template = tc.template
+			name, err := arrayHostName(tc.nodeName, config)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got name %q", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if name != tc.expName {
+				t.Fatalf("Expected name %q, got %q", tc.expName, name)
+			}
+		})
+	}
+}
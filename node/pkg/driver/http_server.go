@@ -0,0 +1,123 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	metricsPath = "/metrics"
+)
+
+// startHTTPServers serves the health endpoints on the health port and the metrics on the metrics
+// port in the background, both share one server when the ports are the same.
+func (d *Driver) startHTTPServers() error {
+	muxByPort := map[int]*http.ServeMux{}
+	portMux := func(port int) *http.ServeMux {
+		if muxByPort[port] == nil {
+			muxByPort[port] = http.NewServeMux()
+		}
+		return muxByPort[port]
+	}
+	if d.healthPort > 0 {
+		portMux(d.healthPort).HandleFunc(healthzPath, d.serveHealthz)
+		portMux(d.healthPort).HandleFunc(readyzPath, d.serveReadyz)
+	}
+	if d.metricsPort > 0 && d.metrics != nil {
+		portMux(d.metricsPort).Handle(metricsPath, d.metrics.Handler())
+	}
+
+	for port, mux := range muxByPort {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Errorf("failed to listen for HTTP on port %d: %v", port, err)
+		}
+		server := &http.Server{Handler: mux}
+		d.httpServers = append(d.httpServers, server)
+
+		logging.Infof("Serving HTTP on address: %#v", listener.Addr().String())
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logging.Errorf("HTTP server failed: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (d *Driver) stopHTTPServers() {
+	for _, server := range d.httpServers {
+		server.Close()
+	}
+}
+
+// serveHealthz reports whether the node is healthy, with the same checks as the identity Probe.
+func (d *Driver) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	failures := d.checkHealth(r.Context())
+	if len(failures) > 0 {
+		logHealthFailures(failures)
+		writeHealthResponse(w, http.StatusInternalServerError, failures)
+		return
+	}
+	writeHealthResponse(w, http.StatusOK, nil)
+}
+
+// serveReadyz reports whether the node can serve requests: the startup reconciliation finished, the
+// shutdown did not start and the node is healthy.
+func (d *Driver) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if d.isShuttingDown() {
+		writeHealthResponse(w, http.StatusServiceUnavailable, []string{"the node plugin is shutting down"})
+		return
+	}
+	if !d.isReconciled() {
+		writeHealthResponse(w, http.StatusServiceUnavailable, []string{"startup reconciliation is in progress"})
+		return
+	}
+	failures := d.checkHealth(r.Context())
+	if len(failures) > 0 {
+		writeHealthResponse(w, http.StatusServiceUnavailable, failures)
+		return
+	}
+	writeHealthResponse(w, http.StatusOK, nil)
+}
+
+func writeHealthResponse(w http.ResponseWriter, statusCode int, failures []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if len(failures) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	fmt.Fprintln(w, strings.Join(failures, "\n"))
+}
+
+func (d *Driver) setReconciled() {
+	atomic.StoreInt32(&d.reconciled, 1)
+}
+
+func (d *Driver) isReconciled() bool {
+	return atomic.LoadInt32(&d.reconciled) == 1
+}
@@ -20,38 +20,42 @@ import (
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"k8s.io/klog"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	klog.V(5).Infof("GetPluginInfo: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("GetPluginInfo: called with args %+v", *req)
 	resp := &csi.GetPluginInfoResponse{
-		Name:          d.config.Identity.Name,
-		VendorVersion: d.config.Identity.Version,
+		Name:          d.currentConfig().Identity.Name,
+		VendorVersion: d.currentConfig().Identity.Version,
 	}
 
 	return resp, nil
 }
 
 func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	// TODO take it from ini file
-	klog.V(5).Infof("GetPluginCapabilities: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("GetPluginCapabilities: called with args %+v", *req)
+	caps, err := pluginCapabilities(d.currentConfig())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	resp := &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
-				},
-			},
-		},
+		Capabilities: caps,
 	}
 
 	return resp, nil
 }
 
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	klog.V(5).Infof("Probe: called with args %+v", *req)
-	return &csi.ProbeResponse{}, nil
+	logging.FromContext(ctx).V(5).Infof("Probe: called with args %+v", *req)
+
+	failures := d.checkHealth(ctx)
+	if len(failures) > 0 {
+		logHealthFailures(failures)
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
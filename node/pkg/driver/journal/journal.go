@@ -0,0 +1,348 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	util "github.com/ibm/ibm-block-csi-driver/node/util"
+)
+
+const (
+	recordVersion    = 1
+	recordFileSuffix = ".json"
+	// Records of operations that were not recovered in time are moved there for an operator to inspect
+	expiredDir = "expired"
+)
+
+// Step is one host change of a multi-step operation, e.g. "rescan", "mkfs" or "mount".
+type Step struct {
+	Name      string     `json:"name"`
+	Done      bool       `json:"done"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// Operation is the intent record of a multi-step node operation. It is persisted before the first
+// step starts and updated after every completed step, so an operation interrupted by a crash can be
+// replayed or rolled back when the node plugin starts again.
+type Operation struct {
+	Version  int               `json:"version"`
+	Id       string            `json:"id"`
+	Type     string            `json:"type"`
+	VolumeId string            `json:"volumeId"`
+	Started  time.Time         `json:"started"`
+	Params   map[string]string `json:"params,omitempty"`
+	Steps    []Step            `json:"steps"`
+	// Failed recovery attempts and the error of the last one
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// CompletedSteps returns the names of the steps that were done, in order.
+func (op *Operation) CompletedSteps() []string {
+	var done []string
+	for _, step := range op.Steps {
+		if step.Done {
+			done = append(done, step.Name)
+		}
+	}
+	return done
+}
+
+// StepDone tells if the step of the operation was done.
+func (op *Operation) StepDone(name string) bool {
+	for _, step := range op.Steps {
+		if step.Name == name {
+			return step.Done
+		}
+	}
+	return false
+}
+
+// Journal persists operation records as one JSON file per operation in a directory that survives
+// restarts of the node plugin.
+type Journal struct {
+	dir   string
+	mu    sync.Mutex
+	seq   int
+	clock func() time.Time
+	// IDs of the operations begun by this process and not finished yet
+	active map[string]bool
+}
+
+func NewJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory %s: %v", dir, err)
+	}
+	return &Journal{dir: dir, clock: time.Now, active: map[string]bool{}}, nil
+}
+
+// Begin records the intent to run the steps of the operation and returns the persisted operation.
+func (j *Journal) Begin(opType string, volumeId string, steps []string, params map[string]string) (*Operation, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.clock()
+	j.seq++
+	op := &Operation{
+		Version:  recordVersion,
+		Id:       fmt.Sprintf("%d-%d-%s", now.UnixNano(), j.seq, opType),
+		Type:     opType,
+		VolumeId: volumeId,
+		Started:  now,
+		Params:   params,
+	}
+	for _, name := range steps {
+		op.Steps = append(op.Steps, Step{Name: name})
+	}
+
+	if err := j.write(op); err != nil {
+		return nil, err
+	}
+	j.active[op.Id] = true
+	logging.V(4).Infof("Journal: began %s operation %s of volume %s", op.Type, op.Id, op.VolumeId)
+	return op, nil
+}
+
+// CompleteStep marks the step of the operation as done.
+func (j *Journal) CompleteStep(op *Operation, stepName string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := range op.Steps {
+		if op.Steps[i].Name == stepName {
+			now := j.clock()
+			op.Steps[i].Done = true
+			op.Steps[i].Completed = &now
+			return j.write(op)
+		}
+	}
+	return fmt.Errorf("operation %s has no step %q", op.Id, stepName)
+}
+
+// Finish removes the record of an operation that completed, or that was fully rolled back.
+func (j *Journal) Finish(op *Operation) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.Remove(j.recordPath(op.Id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove journal record of operation %s: %v", op.Id, err)
+	}
+	delete(j.active, op.Id)
+	logging.V(4).Infof("Journal: finished %s operation %s of volume %s", op.Type, op.Id, op.VolumeId)
+	return nil
+}
+
+// Pending returns the operations that did not finish, oldest first.
+func (j *Journal) Pending() ([]*Operation, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal directory %s: %v", j.dir, err)
+	}
+
+	var ops []*Operation
+	for _, file := range files {
+		// Leftovers of an interrupted atomic write have a ".tmp-" suffix and are ignored
+		if file.IsDir() || !strings.HasSuffix(file.Name(), recordFileSuffix) {
+			continue
+		}
+		path := filepath.Join(j.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		op := &Operation{}
+		if err := json.Unmarshal(data, op); err != nil {
+			logging.Warningf("Journal: ignoring corrupted record %s: %v", path, err)
+			continue
+		}
+		if op.Version != recordVersion {
+			logging.Warningf("Journal: ignoring record %s with unsupported version %d", path, op.Version)
+			continue
+		}
+		ops = append(ops, op)
+	}
+
+	sort.Slice(ops, func(i, k int) bool {
+		if ops[i].Started.Equal(ops[k].Started) {
+			return ops[i].Id < ops[k].Id
+		}
+		return ops[i].Started.Before(ops[k].Started)
+	})
+	return ops, nil
+}
+
+// Expire moves the records of the operations that started more than maxAge ago, and are not in
+// progress in this process, out of the journal into its expired directory, and returns them.
+func (j *Journal) Expire(maxAge time.Duration) ([]*Operation, error) {
+	ops, err := j.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var expired []*Operation
+	for _, op := range ops {
+		if j.active[op.Id] || j.clock().Sub(op.Started) < maxAge {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(j.dir, expiredDir), 0700); err != nil {
+			return expired, fmt.Errorf("failed to create expired journal directory: %v", err)
+		}
+		if err := os.Rename(j.recordPath(op.Id), filepath.Join(j.dir, expiredDir, op.Id+recordFileSuffix)); err != nil {
+			return expired, fmt.Errorf("failed to expire journal record of operation %s: %v", op.Id, err)
+		}
+		logging.Warningf("Journal: expired %s operation %s of volume %s after %d failed recoveries, last error: %s",
+			op.Type, op.Id, op.VolumeId, op.Attempts, op.LastError)
+		expired = append(expired, op)
+	}
+	return expired, nil
+}
+
+func (j *Journal) recordPath(id string) string {
+	return filepath.Join(j.dir, id+recordFileSuffix)
+}
+
+func (j *Journal) write(op *Operation) error {
+	data, err := json.MarshalIndent(op, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(j.recordPath(op.Id), data, 0600); err != nil {
+		return fmt.Errorf("failed to write journal record of operation %s: %v", op.Id, err)
+	}
+	return nil
+}
+
+// RecoveryAction is what reconciliation did with an unfinished operation.
+type RecoveryAction string
+
+const (
+	ActionReplayed   RecoveryAction = "replayed"
+	ActionRolledBack RecoveryAction = "rolled back"
+	ActionFailed     RecoveryAction = "failed"
+	ActionSkipped    RecoveryAction = "skipped"
+)
+
+// RecoveryFunc replays the remaining steps or rolls back the completed steps of an unfinished
+// operation, and returns which of the two it did.
+type RecoveryFunc func(ctx context.Context, op *Operation) (RecoveryAction, error)
+
+// ReportEntry is the outcome of the reconciliation of one operation.
+type ReportEntry struct {
+	Operation *Operation
+	Action    RecoveryAction
+	Err       error
+}
+
+// Report is the outcome of Reconcile.
+type Report []ReportEntry
+
+func (r Report) String() string {
+	if len(r) == 0 {
+		return "no unfinished operations"
+	}
+	lines := []string{fmt.Sprintf("%d unfinished operations", len(r))}
+	for _, entry := range r {
+		line := fmt.Sprintf("%s operation %s of volume %s (started %s, completed steps %v): %s",
+			entry.Operation.Type, entry.Operation.Id, entry.Operation.VolumeId,
+			entry.Operation.Started.Format(time.RFC3339), entry.Operation.CompletedSteps(), entry.Action)
+		if entry.Err != nil {
+			line = fmt.Sprintf("%s: %v", line, entry.Err)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reconcile recovers every unfinished operation with the RecoveryFunc of its type, except the
+// operations in progress in this process. Records of recovered operations are removed, records of
+// failed or unknown operations are kept with the failed attempt for the next Reconcile.
+func (j *Journal) Reconcile(ctx context.Context, recoveries map[string]RecoveryFunc) (Report, error) {
+	ops, err := j.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	for _, op := range ops {
+		if j.isActive(op) {
+			continue
+		}
+		entry := ReportEntry{Operation: op}
+		recoverOperation, ok := recoveries[op.Type]
+		if !ok {
+			entry.Action = ActionSkipped
+			entry.Err = fmt.Errorf("no recovery for operation type %q", op.Type)
+			report = append(report, entry)
+			continue
+		}
+
+		entry.Action, entry.Err = recoverOperation(ctx, op)
+		if entry.Err != nil {
+			entry.Action = ActionFailed
+			j.recordFailure(op, entry.Err)
+		} else if err := j.Finish(op); err != nil {
+			entry.Err = err
+		}
+		report = append(report, entry)
+	}
+	return report, nil
+}
+
+func (j *Journal) isActive(op *Operation) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.active[op.Id]
+}
+
+// recordFailure persists a failed recovery attempt of the operation.
+func (j *Journal) recordFailure(op *Operation, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	op.Attempts++
+	op.LastError = err.Error()
+	if writeErr := j.write(op); writeErr != nil {
+		logging.Errorf("%v", writeErr)
+	}
+}
+
+// Failed returns the number of operations by type that failed their recovery in the report, or
+// have no recovery.
+func (r Report) Failed() map[string]int {
+	failed := map[string]int{}
+	for _, entry := range r {
+		if entry.Action == ActionFailed || entry.Action == ActionSkipped {
+			failed[entry.Operation.Type]++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,241 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package journal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestJournal(t *testing.T) (*Journal, func()) {
+	dir, err := ioutil.TempDir("", "journal-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	j, err := NewJournal(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	return j, func() { os.RemoveAll(dir) }
+}
+
+func TestJournalLifecycle(t *testing.T) {
+	j, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	op, err := j.Begin("stage", "vol-test", []string{"rescan", "mkfs", "mount"}, map[string]string{"stagingPath": "/test/path"})
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := j.CompleteStep(op, "rescan"); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := j.CompleteStep(op, "no-such-step"); err == nil {
+		t.Fatalf("Expected error for unknown step")
+	}
+
+	// Simulate a restart: a new journal on the same directory sees the unfinished operation
+	restarted, err := NewJournal(j.dir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	pending, err := restarted.Pending()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending operation, got %d", len(pending))
+	}
+	if pending[0].Id != op.Id || pending[0].VolumeId != "vol-test" || pending[0].Params["stagingPath"] != "/test/path" {
+		t.Fatalf("pending operation mismatches: expected %+v, got %+v", *op, *pending[0])
+	}
+	if done := pending[0].CompletedSteps(); !reflect.DeepEqual(done, []string{"rescan"}) {
+		t.Fatalf("completed steps mismatches: expected [rescan], got %v", done)
+	}
+	if !pending[0].StepDone("rescan") || pending[0].StepDone("mount") {
+		t.Fatalf("Expected only the rescan step to be done, got %+v", pending[0].Steps)
+	}
+
+	if err := j.Finish(op); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	pending, err = j.Pending()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending operations, got %d", len(pending))
+	}
+}
+
+func TestJournalPendingIgnoresBrokenRecords(t *testing.T) {
+	j, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"corrupted.json":         `{"version": 1, "id"`,
+		"future.json":            `{"version": 2, "id": "future"}`,
+		"op.json.tmp-1234":       `{"version": 1, "id": "tmp"}`,
+		"valid.json":             `{"version": 1, "id": "valid", "type": "stage"}`,
+		"not-a-record.something": `{}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(j.dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Id != "valid" {
+		t.Fatalf("Expected only the valid operation, got %+v", pending)
+	}
+}
+
+func TestJournalReconcile(t *testing.T) {
+	j, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	for _, opType := range []string{"stage", "unstage", "broken", "unknown"} {
+		if _, err := j.Begin(opType, "vol-"+opType, []string{"step"}, nil); err != nil {
+			t.Fatalf("err is not nil. got: %v", err)
+		}
+	}
+
+	recoveries := map[string]RecoveryFunc{
+		"stage": func(ctx context.Context, op *Operation) (RecoveryAction, error) {
+			return ActionRolledBack, nil
+		},
+		"unstage": func(ctx context.Context, op *Operation) (RecoveryAction, error) {
+			return ActionReplayed, nil
+		},
+		"broken": func(ctx context.Context, op *Operation) (RecoveryAction, error) {
+			return ActionRolledBack, fmt.Errorf("device busy")
+		},
+	}
+
+	// the operations are in progress in this process
+	if report, err := j.Reconcile(context.TODO(), recoveries); err != nil || len(report) != 0 {
+		t.Fatalf("Expected the operations in progress to be skipped, got %s, err %v", report, err)
+	}
+
+	// Simulate a restart
+	j, err := NewJournal(j.dir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	report, err := j.Reconcile(context.TODO(), recoveries)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	expActions := map[string]RecoveryAction{
+		"stage":   ActionRolledBack,
+		"unstage": ActionReplayed,
+		"broken":  ActionFailed,
+		"unknown": ActionSkipped,
+	}
+	if len(report) != len(expActions) {
+		t.Fatalf("Expected %d report entries, got %d:\n%s", len(expActions), len(report), report)
+	}
+	for _, entry := range report {
+		if entry.Action != expActions[entry.Operation.Type] {
+			t.Fatalf("action of %s mismatches: expected %s, got %s", entry.Operation.Type, expActions[entry.Operation.Type], entry.Action)
+		}
+	}
+
+	// Failed and unknown operations are kept for the next reconciliation
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	var pendingTypes []string
+	for _, op := range pending {
+		pendingTypes = append(pendingTypes, op.Type)
+	}
+	if !reflect.DeepEqual(pendingTypes, []string{"broken", "unknown"}) {
+		t.Fatalf("Expected broken and unknown operations to stay pending, got %v", pendingTypes)
+	}
+	if pending[0].Attempts != 1 || pending[0].LastError != "device busy" {
+		t.Fatalf("Expected the failed attempt to be recorded, got %d attempts, last error %q", pending[0].Attempts, pending[0].LastError)
+	}
+	if failed := report.Failed(); !reflect.DeepEqual(failed, map[string]int{"broken": 1, "unknown": 1}) {
+		t.Fatalf("Expected the broken and unknown operations to be failed, got %v", failed)
+	}
+
+	// the next reconciliation retries the failed operation
+	if _, err := j.Reconcile(context.TODO(), recoveries); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if pending, err := j.Pending(); err != nil || pending[0].Attempts != 2 {
+		t.Fatalf("Expected a second failed attempt, got %+v, err %v", pending, err)
+	}
+}
+
+func TestJournalExpire(t *testing.T) {
+	j, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	now := time.Now()
+	j.clock = func() time.Time { return now.Add(-2 * time.Hour) }
+	active, err := j.Begin("stage", "vol-active", []string{"step"}, nil)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	restarted, err := NewJournal(j.dir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	restarted.clock = j.clock
+	if _, err := restarted.Begin("unstage", "vol-old", []string{"step"}, nil); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	restarted.clock = func() time.Time { return now }
+	if _, err := restarted.Begin("unstage", "vol-new", []string{"step"}, nil); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	// only the old operation of the previous process expires
+	j.clock = func() time.Time { return now }
+	j.active = map[string]bool{active.Id: true}
+	expired, err := j.Expire(time.Hour)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(expired) != 1 || expired[0].VolumeId != "vol-old" {
+		t.Fatalf("Expected the old operation to expire, got %+v", expired)
+	}
+	if _, err := os.Stat(filepath.Join(j.dir, expiredDir, expired[0].Id+recordFileSuffix)); err != nil {
+		t.Fatalf("Expected the expired record to be kept for inspection, got %v", err)
+	}
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(pending) != 2 || pending[0].VolumeId != "vol-active" || pending[1].VolumeId != "vol-new" {
+		t.Fatalf("Expected the active and the new operation to stay pending, got %+v", pending)
+	}
+}
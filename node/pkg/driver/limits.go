@@ -0,0 +1,141 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+// Array types, named as the controller names them
+const (
+	ArrayTypeSvc   = "SVC"
+	ArrayTypeA9000 = "A9000"
+)
+
+// Sources of the MaxVolumesPerNode of NodeGetInfo
+const (
+	MaxVolumesSourceNone            = ""
+	MaxVolumesSourceStatic          = "static"
+	MaxVolumesSourceArrayType       = "array_type"
+	MaxVolumesSourceRemainingLunIds = "remaining_lun_ids"
+)
+
+// lunRange are the LUN IDs an array maps volumes to on a host, both ends included.
+type lunRange struct {
+	Min int
+	Max int
+}
+
+func (r lunRange) size() int {
+	return r.Max - r.Min + 1
+}
+
+func (r lunRange) contains(lun int) bool {
+	return lun >= r.Min && lun <= r.Max
+}
+
+var (
+	// arrayTypeLunRanges are the LUN IDs of a host on each array type
+	arrayTypeLunRanges = map[string]lunRange{
+		ArrayTypeSvc:   {Min: 0, Max: 511},
+		ArrayTypeA9000: {Min: 1, Max: 511},
+	}
+	// anyLunRange is used without an array type: the LUNs of flat space addressing
+	anyLunRange = lunRange{Min: 0, Max: 16383}
+)
+
+// arrayLunRange returns the LUN IDs of a host on the array type of the config.
+func arrayLunRange(config ConfigFile) lunRange {
+	if lunRange, ok := arrayTypeLunRanges[config.Node.Array_type]; ok {
+		return lunRange
+	}
+	return anyLunRange
+}
+
+// maxVolumesPerNode returns the MaxVolumesPerNode of NodeGetInfo by the source of the config, 0 for
+// no limit.
+func (d *nodeService) maxVolumesPerNode(config ConfigFile) (int64, error) {
+	maxVolumes := config.Node.Max_volumes
+	switch maxVolumes.Source {
+	case MaxVolumesSourceNone:
+		return 0, nil
+	case MaxVolumesSourceStatic:
+		return maxVolumes.Static, nil
+	case MaxVolumesSourceArrayType:
+		return int64(arrayLunRange(config).size()), nil
+	case MaxVolumesSourceRemainingLunIds:
+		lunRange := arrayLunRange(config)
+		taken, err := d.takenLunIds()
+		if err != nil {
+			return 0, err
+		}
+		remaining := 0
+		for lun := lunRange.Min; lun <= lunRange.Max; lun++ {
+			if !taken[lun] {
+				remaining++
+			}
+		}
+		logging.V(4).Infof("%d of %d LUN IDs are taken by volumes not staged by the driver", lunRange.size()-remaining, lunRange.size())
+		if remaining == 0 {
+			// 0 would mean no limit
+			logging.Warningf("No LUN IDs are left for volumes of the driver, reporting a limit of 1")
+			remaining = 1
+		}
+		return int64(remaining), nil
+	}
+	return 0, fmt.Errorf("unknown node.max_volumes.source %q", maxVolumes.Source)
+}
+
+// takenLunIds returns the LUN IDs of the IBM SCSI devices on the host that belong to no staged
+// volume, such as boot volumes and volumes mapped by hand.
+func (d *nodeService) takenLunIds() (map[int]bool, error) {
+	entries, err := ioutil.ReadDir(d.hostRoot.Path(sysBlockPath))
+	if err != nil {
+		return nil, err
+	}
+	staged := d.stagedDevices("")
+	taken := map[int]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "sd") || !d.isIbmScsiDevice(name) {
+			continue
+		}
+		if staged[normalizeWwid(d.readSysBlockAttr(name, "device/wwid"))] {
+			continue
+		}
+		if lun, ok := d.scsiDeviceLun(name); ok {
+			taken[lun] = true
+		}
+	}
+	return taken, nil
+}
+
+// scsiDeviceLun returns the LUN of a SCSI device by its host:channel:target:lun address.
+func (d *nodeService) scsiDeviceLun(name string) (int, bool) {
+	for _, address := range d.listSysBlockDir(name, "device/scsi_device") {
+		parts := strings.Split(address, ":")
+		if lun, err := strconv.Atoi(parts[len(parts)-1]); err == nil && len(parts) == 4 {
+			return lun, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,86 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"path/filepath"
+	"testing"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+)
+
+func TestMaxVolumesPerNode(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	// boot volume on two paths, LUN 0
+	host.addScsiDevice("sda", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.mkdir("/sys/block/sda/device/scsi_device/1:0:0:0")
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.mkdir("/sys/block/sdb/device/scsi_device/2:0:0:0")
+	// volume mapped by hand, LUN 7
+	host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000002")
+	host.mkdir("/sys/block/sdc/device/scsi_device/1:0:0:7")
+	// staged volume, LUN 3
+	host.addScsiDevice("sdd", "IBM", "2145", "naa.6005076810830198a800000000000003")
+	host.mkdir("/sys/block/sdd/device/scsi_device/1:0:0:3")
+	host.writeFile(filepath.Join(DefaultStageInfoDir, stageInfoFileName("vol-3")),
+		`{"version": 1, "volumeId": "vol-3", "wwn": "6005076810830198A800000000000003"}`)
+	// local disk
+	host.addScsiDevice("sde", "ATA", "SAMSUNG", "t10.ATA")
+	host.mkdir("/sys/block/sde/device/scsi_device/0:0:0:1")
+
+	testCases := []struct {
+		name          string
+		arrayType     string
+		source        string
+		static        int64
+		expMaxVolumes int64
+		expErr        bool
+	}{
+		{name: "no limit", arrayType: ArrayTypeSvc, expMaxVolumes: 0},
+		{name: "static", source: MaxVolumesSourceStatic, static: 100, expMaxVolumes: 100},
+		{name: "svc", arrayType: ArrayTypeSvc, source: MaxVolumesSourceArrayType, expMaxVolumes: 512},
+		{name: "a9000", arrayType: ArrayTypeA9000, source: MaxVolumesSourceArrayType, expMaxVolumes: 511},
+		{name: "remaining svc", arrayType: ArrayTypeSvc, source: MaxVolumesSourceRemainingLunIds, expMaxVolumes: 510},
+		// LUN 0 is not in the LUN IDs of A9000
+		{name: "remaining a9000", arrayType: ArrayTypeA9000, source: MaxVolumesSourceRemainingLunIds, expMaxVolumes: 510},
+		{name: "unknown source", source: "lun_ids", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestNodeServiceWithHost(host, executor.NewFakeExecutor())
+			d.configYaml.Node.Array_type = tc.arrayType
+			d.configYaml.Node.Max_volumes.Source = tc.source
+			d.configYaml.Node.Max_volumes.Static = tc.static
+
+			maxVolumes, err := d.maxVolumesPerNode(d.configYaml)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %d", maxVolumes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if maxVolumes != tc.expMaxVolumes {
+				t.Fatalf("Expected max volumes %d, got %d", tc.expMaxVolumes, maxVolumes)
+			}
+		})
+	}
+}
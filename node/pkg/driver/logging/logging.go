@@ -0,0 +1,271 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logging writes the node driver logs either as klog text or as JSON lines, with the
+// request fields of the context on every line.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+	levelFatal   = "fatal"
+)
+
+var (
+	// mu guards format and the writes to output
+	mu sync.Mutex
+
+	format           = FormatText
+	output io.Writer = os.Stderr
+	now              = time.Now
+)
+
+// SetFormat selects the log format, FormatText logs through klog.
+func SetFormat(logFormat string) error {
+	switch logFormat {
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", logFormat, FormatText, FormatJSON)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	format = logFormat
+	return nil
+}
+
+// SetVerbosity changes the level of the V logs, like the -v flag of klog.
+func SetVerbosity(level int) error {
+	var verbosity klog.Level
+	return verbosity.Set(strconv.Itoa(level))
+}
+
+// Fields identify the request a log line belongs to, empty fields are left out.
+type Fields struct {
+	RequestId string `json:"requestId,omitempty"`
+	Rpc       string `json:"rpc,omitempty"`
+	VolumeId  string `json:"volumeId,omitempty"`
+	NodeId    string `json:"nodeId,omitempty"`
+}
+
+func (f Fields) String() string {
+	var parts []string
+	for _, field := range []struct{ name, value string }{
+		{"requestId", f.RequestId}, {"rpc", f.Rpc}, {"volumeId", f.VolumeId}, {"nodeId", f.NodeId},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+"="+field.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+type fieldsKey struct{}
+
+// WithFields returns a context whose loggers carry the fields.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// FieldsFromContext returns the fields of the context.
+func FieldsFromContext(ctx context.Context) Fields {
+	if ctx == nil {
+		return Fields{}
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// NewRequestId returns a random id for a request.
+func NewRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Logger logs with the fields of a request.
+type Logger struct {
+	fields Fields
+}
+
+// FromContext returns a logger with the fields of the context.
+func FromContext(ctx context.Context) Logger {
+	return Logger{fields: FieldsFromContext(ctx)}
+}
+
+func (l Logger) Infof(msgFormat string, args ...interface{}) {
+	l.log(levelInfo, fmt.Sprintf(msgFormat, args...))
+}
+
+func (l Logger) Warningf(msgFormat string, args ...interface{}) {
+	l.log(levelWarning, fmt.Sprintf(msgFormat, args...))
+}
+
+func (l Logger) Errorf(msgFormat string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(msgFormat, args...))
+}
+
+// Fatalf logs and exits the process.
+func (l Logger) Fatalf(msgFormat string, args ...interface{}) {
+	l.log(levelFatal, fmt.Sprintf(msgFormat, args...))
+}
+
+// V returns a logger that logs only if the klog verbosity is at least the level.
+func (l Logger) V(level klog.Level) Verbose {
+	return Verbose{logger: l, enabled: bool(klog.V(level))}
+}
+
+// Verbose is a logger of a verbosity level.
+type Verbose struct {
+	logger  Logger
+	enabled bool
+}
+
+func (v Verbose) Infof(msgFormat string, args ...interface{}) {
+	if v.enabled {
+		v.logger.log(levelInfo, fmt.Sprintf(msgFormat, args...))
+	}
+}
+
+// Infof, Warningf, Errorf, Fatalf and V log without request fields, like their klog counterparts.
+func Infof(msgFormat string, args ...interface{}) {
+	Logger{}.log(levelInfo, fmt.Sprintf(msgFormat, args...))
+}
+
+func Warningf(msgFormat string, args ...interface{}) {
+	Logger{}.log(levelWarning, fmt.Sprintf(msgFormat, args...))
+}
+
+func Errorf(msgFormat string, args ...interface{}) {
+	Logger{}.log(levelError, fmt.Sprintf(msgFormat, args...))
+}
+
+func Fatalf(msgFormat string, args ...interface{}) {
+	Logger{}.log(levelFatal, fmt.Sprintf(msgFormat, args...))
+}
+
+func V(level klog.Level) Verbose {
+	return Logger{}.V(level)
+}
+
+// jsonLine is one line of the JSON log format.
+type jsonLine struct {
+	Time   string `json:"ts"`
+	Level  string `json:"level"`
+	Caller string `json:"caller,omitempty"`
+	Msg    string `json:"msg"`
+	Fields
+}
+
+// callerDepth is the number of frames between the caller of a logging function and log.
+const callerDepth = 3
+
+func (l Logger) log(level string, msg string) {
+	mu.Lock()
+	logFormat := format
+	mu.Unlock()
+
+	if logFormat == FormatText {
+		l.logText(level, msg)
+		return
+	}
+
+	line := jsonLine{Time: now().UTC().Format(time.RFC3339Nano), Level: level, Msg: msg, Fields: l.fields}
+	if _, file, lineNo, ok := runtime.Caller(callerDepth - 1); ok {
+		line.Caller = fmt.Sprintf("%s:%d", filepath.Base(file), lineNo)
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":%q,"msg":%q}`, levelError, "failed to encode log line: "+err.Error()))
+	}
+
+	mu.Lock()
+	output.Write(append(data, '\n'))
+	mu.Unlock()
+	if level == levelFatal {
+		os.Exit(255)
+	}
+}
+
+func (l Logger) logText(level string, msg string) {
+	if prefix := l.fields.String(); prefix != "" {
+		msg = "[" + prefix + "] " + msg
+	}
+	switch level {
+	case levelInfo:
+		klog.InfoDepth(callerDepth, msg)
+	case levelWarning:
+		klog.WarningDepth(callerDepth, msg)
+	case levelError:
+		klog.ErrorDepth(callerDepth, msg)
+	case levelFatal:
+		klog.FatalDepth(callerDepth, msg)
+	}
+}
+
+// volumeRequest is implemented by the CSI requests of a volume.
+type volumeRequest interface {
+	GetVolumeId() string
+}
+
+// UnaryServerInterceptor adds a new request id, the RPC name, the volume id of the request and the
+// node id to the context of every RPC and logs the RPC errors with them.
+func UnaryServerInterceptor(nodeId string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		fields := Fields{
+			RequestId: NewRequestId(),
+			Rpc:       info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:],
+			NodeId:    nodeId,
+		}
+		if volumeReq, ok := req.(volumeRequest); ok {
+			fields.VolumeId = volumeReq.GetVolumeId()
+		}
+		ctx = WithFields(ctx, fields)
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			FromContext(ctx).Errorf("GRPC error: %v", err)
+		}
+		return resp, err
+	}
+}
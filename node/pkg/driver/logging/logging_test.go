@@ -0,0 +1,123 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+)
+
+func captureJSON(t *testing.T) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	origOutput, origNow := output, now
+	output = &buf
+	now = func() time.Time { return time.Date(2019, 7, 1, 10, 0, 0, 0, time.UTC) }
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	return &buf, func() {
+		output, now = origOutput, origNow
+		SetFormat(FormatText)
+	}
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []jsonLine {
+	var lines []jsonLine
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line jsonLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("Cannot decode log line %q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf, restore := captureJSON(t)
+	defer restore()
+
+	ctx := WithFields(context.TODO(), Fields{RequestId: "abc", Rpc: "NodeStageVolume", VolumeId: "vol-1", NodeId: "node-1"})
+	FromContext(ctx).Warningf("device %s is slow", "sdb")
+	Infof("no request")
+
+	lines := decodeLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	expLine := jsonLine{
+		Time:   "2019-07-01T10:00:00Z",
+		Level:  levelWarning,
+		Msg:    "device sdb is slow",
+		Fields: Fields{RequestId: "abc", Rpc: "NodeStageVolume", VolumeId: "vol-1", NodeId: "node-1"},
+	}
+	if !strings.HasPrefix(lines[0].Caller, "logging_test.go:") {
+		t.Fatalf("Expected the caller in logging_test.go, got %s", lines[0].Caller)
+	}
+	lines[0].Caller = ""
+	if lines[0] != expLine {
+		t.Fatalf("line mismatch: expected %+v, got %+v", expLine, lines[0])
+	}
+	if lines[1].Fields != (Fields{}) || lines[1].Msg != "no request" {
+		t.Fatalf("Expected a line without fields, got %+v", lines[1])
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	if err := SetFormat("xml"); err == nil {
+		t.Fatalf("Expected an error for an unknown format")
+	}
+	if err := SetFormat(FormatText); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	buf, restore := captureJSON(t)
+	defer restore()
+
+	var handlerFields Fields
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handlerFields = FieldsFromContext(ctx)
+		return nil, fmt.Errorf("failed")
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeUnstageVolume"}
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1"}
+	if _, err := UnaryServerInterceptor("node-1")(context.TODO(), req, info, handler); err == nil {
+		t.Fatalf("Expected the handler error")
+	}
+
+	if handlerFields.RequestId == "" {
+		t.Fatalf("Expected a request id")
+	}
+	expFields := Fields{RequestId: handlerFields.RequestId, Rpc: "NodeUnstageVolume", VolumeId: "vol-1", NodeId: "node-1"}
+	if handlerFields != expFields {
+		t.Fatalf("fields mismatch: expected %+v, got %+v", expFields, handlerFields)
+	}
+	lines := decodeLines(t, buf)
+	if len(lines) != 1 || lines[0].Fields != expFields || lines[0].Level != levelError {
+		t.Fatalf("Expected an error line with the request fields, got %s", buf.String())
+	}
+}
@@ -0,0 +1,133 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+)
+
+const (
+	DefaultMetricsCollectInterval = time.Minute
+
+	// multipathd prints one line per path with the device name and the device mapper path state
+	multipathdPathsFormat = "%d %t"
+)
+
+// instrumentedExecutor observes the duration of the host commands that are host operations with a
+// metric of their own.
+type instrumentedExecutor struct {
+	executor.Executor
+	metrics *metrics.Metrics
+}
+
+func (e *instrumentedExecutor) Execute(ctx context.Context, name string, args ...string) ([]byte, error) {
+	operation := commandHostOperation(name)
+	if operation == "" {
+		return e.Executor.Execute(ctx, name, args...)
+	}
+	start := time.Now()
+	out, err := e.Executor.Execute(ctx, name, args...)
+	e.metrics.ObserveHostOperation(operation, start, err)
+	return out, err
+}
+
+// SetTimeouts forwards a config reload of the command timeouts to the wrapped executor.
+func (e *instrumentedExecutor) SetTimeouts(timeouts map[string]time.Duration) {
+	if setter, ok := e.Executor.(executor.TimeoutSetter); ok {
+		setter.SetTimeouts(timeouts)
+	}
+}
+
+// HasTool forwards the lookup of a host tool to the wrapped executor.
+func (e *instrumentedExecutor) HasTool(name string) bool {
+	finder, ok := e.Executor.(executor.ToolFinder)
+	return !ok || finder.HasTool(name)
+}
+
+// commandHostOperation returns the host operation a command is, or "" for other commands.
+func commandHostOperation(name string) string {
+	switch strings.SplitN(name, ".", 2)[0] {
+	case "mkfs":
+		return metrics.HostOpMkfs
+	case "mount":
+		return metrics.HostOpMount
+	}
+	return ""
+}
+
+// runMetricsCollector updates the node state metrics every interval until stopCh is closed.
+func (d *nodeService) runMetricsCollector(stopCh <-chan struct{}) {
+	if d.metrics == nil {
+		return
+	}
+	for {
+		d.collectMetrics(context.Background())
+		// read on every run, so a config reload changes the interval
+		interval := d.currentConfig().Node.Metrics.Collect_interval
+		if interval <= 0 {
+			interval = DefaultMetricsCollectInterval
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// collectMetrics updates the number of staged volumes and multipath paths.
+func (d *nodeService) collectMetrics(ctx context.Context) {
+	d.metrics.SetStagedVolumes(len(d.listStageInfos()))
+
+	paths, err := d.countMultipathPaths(ctx)
+	if err != nil {
+		logging.V(4).Infof("Failed to count multipath paths: %v", err)
+		return
+	}
+	d.metrics.SetMultipathPaths(paths)
+}
+
+// countMultipathPaths returns the number of multipath paths by device mapper state.
+func (d *nodeService) countMultipathPaths(ctx context.Context) (map[string]int, error) {
+	out, err := d.executor.Execute(ctx, "multipathd", "show", "paths", "format", multipathdPathsFormat)
+	if err != nil {
+		return nil, err
+	}
+	return parseMultipathPaths(string(out)), nil
+}
+
+func parseMultipathPaths(out string) map[string]int {
+	countByState := map[string]int{}
+	for i, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if i == 0 && fields[0] == "dev" {
+			// header line
+			continue
+		}
+		countByState[fields[1]]++
+	}
+	return countByState
+}
@@ -0,0 +1,276 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	namespace = "ibm_block_csi"
+	subsystem = "node"
+)
+
+// Host operations with a duration histogram
+const (
+	HostOpRescanWait    = "rescan_wait"
+	HostOpMultipathWait = "multipath_wait"
+	HostOpMkfs          = "mkfs"
+	HostOpMount         = "mount"
+)
+
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Metrics holds the Prometheus metrics of the node driver. All the methods can be called on a nil
+// *Metrics, they do nothing then.
+type Metrics struct {
+	registry       *prometheus.Registry
+	rpcTotal       *prometheus.CounterVec
+	rpcDuration    *prometheus.HistogramVec
+	hostOpDuration *prometheus.HistogramVec
+	stagedVolumes  prometheus.Gauge
+	multipathPaths *prometheus.GaugeVec
+	configReloads  *prometheus.CounterVec
+	configReloaded prometheus.Gauge
+	arrayReachable *prometheus.GaugeVec
+	arrayEndpoints *prometheus.GaugeVec
+	healthFailed   *prometheus.GaugeVec
+	journalFailed  *prometheus.GaugeVec
+	journalExpired *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics in a registry of their own.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rpcTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rpc_total",
+			Help:      "Number of CSI RPCs by method and gRPC status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rpc_duration_seconds",
+			Help:      "Latency of CSI RPCs by method.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"method"}),
+		hostOpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "host_operation_duration_seconds",
+			Help:      "Duration of host operations such as device rescans, multipath waits, mkfs and mount.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		}, []string{"operation", "result"}),
+		stagedVolumes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "staged_volumes",
+			Help:      "Number of volumes staged on the node.",
+		}),
+		multipathPaths: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "multipath_paths",
+			Help:      "Number of multipath paths on the node by device mapper state.",
+		}, []string{"state"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "config_reloads_total",
+			Help:      "Number of config reloads by result.",
+		}, []string{"result"}),
+		configReloaded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful config reload.",
+		}),
+		arrayReachable: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "array_reachable",
+			Help:      "Whether the node reached the storage array on any endpoint in the last probe, 1 or 0.",
+		}, []string{"array"}),
+		arrayEndpoints: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "array_reachable_endpoints",
+			Help:      "Number of iSCSI portals and FC target ports of the storage array the node reached in the last probe.",
+		}, []string{"array"}),
+		healthFailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "health_check_failed",
+			Help:      "Whether the health check failed in the last Probe or health request, 1 or 0, by check.",
+		}, []string{"check"}),
+		journalFailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "journal_failed_operations",
+			Help:      "Number of unfinished node operations in the journal whose last recovery failed, by operation type.",
+		}, []string{"type"}),
+		journalExpired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "journal_expired_operations_total",
+			Help:      "Number of unfinished node operations moved out of the journal after their maximum age, by operation type.",
+		}, []string{"type"}),
+	}
+	m.registry.MustRegister(m.rpcTotal, m.rpcDuration, m.hostOpDuration, m.stagedVolumes, m.multipathPaths, m.configReloads, m.configReloaded,
+		m.arrayReachable, m.arrayEndpoints, m.healthFailed, m.journalFailed, m.journalExpired)
+	return m
+}
+
+// Registry returns the registry of the metrics, to add more collectors to it.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// UnaryServerInterceptor counts the RPCs and observes their latency.
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.ObserveRPC(info.FullMethod, status.Code(err), time.Since(start))
+		return resp, err
+	}
+}
+
+// ObserveRPC records one RPC, the method is either the full gRPC method name or the bare RPC name.
+func (m *Metrics) ObserveRPC(method string, code codes.Code, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	method = method[strings.LastIndex(method, "/")+1:]
+	m.rpcTotal.WithLabelValues(method, code.String()).Inc()
+	m.rpcDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// ObserveHostOperation records the duration of a host operation that started at start and ended with err.
+func (m *Metrics) ObserveHostOperation(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	m.hostOpDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// SetStagedVolumes sets the number of volumes staged on the node.
+func (m *Metrics) SetStagedVolumes(count int) {
+	if m == nil {
+		return
+	}
+	m.stagedVolumes.Set(float64(count))
+}
+
+// SetMultipathPaths replaces the multipath path counts by state.
+func (m *Metrics) SetMultipathPaths(countByState map[string]int) {
+	if m == nil {
+		return
+	}
+	m.multipathPaths.Reset()
+	for state, count := range countByState {
+		m.multipathPaths.WithLabelValues(state).Set(float64(count))
+	}
+}
+
+// ObserveConfigReload records a config reload that ended with err.
+func (m *Metrics) ObserveConfigReload(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.configReloads.WithLabelValues(resultError).Inc()
+		return
+	}
+	m.configReloads.WithLabelValues(resultSuccess).Inc()
+	m.configReloaded.SetToCurrentTime()
+}
+
+// SetArrayReachability replaces the reachability of the storage arrays by the number of endpoints
+// of each array the node reached.
+func (m *Metrics) SetArrayReachability(reachableEndpoints map[string]int) {
+	if m == nil {
+		return
+	}
+	m.arrayReachable.Reset()
+	m.arrayEndpoints.Reset()
+	for array, count := range reachableEndpoints {
+		reachable := 0.0
+		if count > 0 {
+			reachable = 1
+		}
+		m.arrayReachable.WithLabelValues(array).Set(reachable)
+		m.arrayEndpoints.WithLabelValues(array).Set(float64(count))
+	}
+}
+
+// SetJournalFailures replaces the numbers of failed journal operations by type.
+func (m *Metrics) SetJournalFailures(failedByType map[string]int) {
+	if m == nil {
+		return
+	}
+	m.journalFailed.Reset()
+	for opType, count := range failedByType {
+		m.journalFailed.WithLabelValues(opType).Set(float64(count))
+	}
+}
+
+// ObserveJournalExpiry counts a journal operation of the type that expired.
+func (m *Metrics) ObserveJournalExpiry(opType string) {
+	if m == nil {
+		return
+	}
+	m.journalExpired.WithLabelValues(opType).Inc()
+}
+
+// SetHealthChecks replaces the results of the health checks by whether each check failed.
+func (m *Metrics) SetHealthChecks(failedByCheck map[string]bool) {
+	if m == nil {
+		return
+	}
+	m.healthFailed.Reset()
+	for check, failed := range failedByCheck {
+		value := 0.0
+		if failed {
+			value = 1
+		}
+		m.healthFailed.WithLabelValues(check).Set(value)
+	}
+}
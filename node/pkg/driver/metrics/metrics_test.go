@@ -0,0 +1,177 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	m := NewMetrics()
+	interceptor := m.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	for _, err := range []error{nil, status.Error(codes.InvalidArgument, "bad"), status.Error(codes.InvalidArgument, "bad")} {
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, err }
+		if _, gotErr := interceptor(context.TODO(), nil, info, handler); gotErr != err {
+			t.Fatalf("Expected error %v, got %v", err, gotErr)
+		}
+	}
+
+	expected := `
+# HELP ibm_block_csi_node_rpc_total Number of CSI RPCs by method and gRPC status code.
+# TYPE ibm_block_csi_node_rpc_total counter
+ibm_block_csi_node_rpc_total{code="InvalidArgument",method="NodeStageVolume"} 2
+ibm_block_csi_node_rpc_total{code="OK",method="NodeStageVolume"} 1
+`
+	if err := testutil.CollectAndCompare(m.rpcTotal, strings.NewReader(expected), "ibm_block_csi_node_rpc_total"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHostOperationAndNodeState(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveHostOperation(HostOpMkfs, time.Now(), nil)
+	m.ObserveHostOperation(HostOpMkfs, time.Now(), fmt.Errorf("failed"))
+	m.SetStagedVolumes(3)
+	m.SetMultipathPaths(map[string]int{"active": 4, "failed": 1})
+	m.SetMultipathPaths(map[string]int{"active": 5})
+
+	if count := testutil.ToFloat64(m.stagedVolumes); count != 3 {
+		t.Fatalf("Expected 3 staged volumes, got %v", count)
+	}
+	expected := `
+# HELP ibm_block_csi_node_multipath_paths Number of multipath paths on the node by device mapper state.
+# TYPE ibm_block_csi_node_multipath_paths gauge
+ibm_block_csi_node_multipath_paths{state="active"} 5
+`
+	if err := testutil.CollectAndCompare(m.multipathPaths, strings.NewReader(expected), "ibm_block_csi_node_multipath_paths"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "ibm_block_csi_node_host_operation_duration_seconds" && len(family.GetMetric()) != 2 {
+			t.Fatalf("Expected a success and an error histogram, got %v", family.GetMetric())
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveConfigReload(nil)
+	m.ObserveConfigReload(fmt.Errorf("invalid config"))
+	m.ObserveConfigReload(nil)
+
+	expected := `
+# HELP ibm_block_csi_node_config_reloads_total Number of config reloads by result.
+# TYPE ibm_block_csi_node_config_reloads_total counter
+ibm_block_csi_node_config_reloads_total{result="error"} 1
+ibm_block_csi_node_config_reloads_total{result="success"} 2
+`
+	if err := testutil.CollectAndCompare(m.configReloads, strings.NewReader(expected), "ibm_block_csi_node_config_reloads_total"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if timestamp := testutil.ToFloat64(m.configReloaded); timestamp < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Fatalf("Expected the time of the last reload, got %v", timestamp)
+	}
+}
+
+func TestArrayReachability(t *testing.T) {
+	m := NewMetrics()
+	m.SetArrayReachability(map[string]int{"fs-dal": 2, "fs-wdc": 1})
+	m.SetArrayReachability(map[string]int{"fs-dal": 3, "fs-fra": 0})
+
+	expected := `
+# HELP ibm_block_csi_node_array_reachable Whether the node reached the storage array on any endpoint in the last probe, 1 or 0.
+# TYPE ibm_block_csi_node_array_reachable gauge
+ibm_block_csi_node_array_reachable{array="fs-dal"} 1
+ibm_block_csi_node_array_reachable{array="fs-fra"} 0
+# HELP ibm_block_csi_node_array_reachable_endpoints Number of iSCSI portals and FC target ports of the storage array the node reached in the last probe.
+# TYPE ibm_block_csi_node_array_reachable_endpoints gauge
+ibm_block_csi_node_array_reachable_endpoints{array="fs-dal"} 3
+ibm_block_csi_node_array_reachable_endpoints{array="fs-fra"} 0
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(expected), "ibm_block_csi_node_array_reachable", "ibm_block_csi_node_array_reachable_endpoints"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	m := NewMetrics()
+	m.SetHealthChecks(map[string]bool{"kernel modules": false, "iscsid": true})
+	m.SetHealthChecks(map[string]bool{"kernel modules": false, "multipathd": true})
+
+	expected := `
+# HELP ibm_block_csi_node_health_check_failed Whether the health check failed in the last Probe or health request, 1 or 0, by check.
+# TYPE ibm_block_csi_node_health_check_failed gauge
+ibm_block_csi_node_health_check_failed{check="kernel modules"} 0
+ibm_block_csi_node_health_check_failed{check="multipathd"} 1
+`
+	if err := testutil.CollectAndCompare(m.healthFailed, strings.NewReader(expected), "ibm_block_csi_node_health_check_failed"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestJournalOperations(t *testing.T) {
+	m := NewMetrics()
+	m.SetJournalFailures(map[string]int{"stage": 1, "unstage": 2})
+	m.SetJournalFailures(map[string]int{"unstage": 1})
+	m.ObserveJournalExpiry("unstage")
+
+	expected := `
+# HELP ibm_block_csi_node_journal_expired_operations_total Number of unfinished node operations moved out of the journal after their maximum age, by operation type.
+# TYPE ibm_block_csi_node_journal_expired_operations_total counter
+ibm_block_csi_node_journal_expired_operations_total{type="unstage"} 1
+# HELP ibm_block_csi_node_journal_failed_operations Number of unfinished node operations in the journal whose last recovery failed, by operation type.
+# TYPE ibm_block_csi_node_journal_failed_operations gauge
+ibm_block_csi_node_journal_failed_operations{type="unstage"} 1
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(expected), "ibm_block_csi_node_journal_failed_operations", "ibm_block_csi_node_journal_expired_operations_total"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveRPC("NodeGetInfo", codes.OK, time.Second)
+	m.ObserveConfigReload(nil)
+	m.ObserveHostOperation(HostOpMount, time.Now(), nil)
+	m.SetStagedVolumes(1)
+	m.SetMultipathPaths(map[string]int{"active": 1})
+	m.SetArrayReachability(map[string]int{"fs-dal": 1})
+	m.SetHealthChecks(map[string]bool{"iscsid": true})
+	m.SetJournalFailures(map[string]int{"stage": 1})
+	m.ObserveJournalExpiry("stage")
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "resp", nil }
+	resp, err := m.UnaryServerInterceptor()(context.TODO(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeGetInfo"}, handler)
+	if err != nil || resp != "resp" {
+		t.Fatalf("Expected the handler response, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,117 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	"google.golang.org/grpc"
+)
+
+func TestStageHostOperationMetrics(t *testing.T) {
+	host := newStageTestHost(t)
+	defer host.cleanup()
+	stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+	fakeExec := executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "iscsiadm", Args: []string{"-m", "session", "--rescan"}},
+		executor.FakeCommand{Name: "blkid", Args: []string{"-p", "-s", "TYPE", "-o", "value", "/dev/dm-0"},
+			Err: &executor.CommandError{Command: "blkid", ExitCode: blkidNoMatchExitCode, Err: errors.New("exit status 2")}},
+		executor.FakeCommand{Name: "mkfs.ext4", Args: []string{"-F", "/dev/dm-0"}},
+		executor.FakeCommand{Name: "mount", Args: []string{"-t", "ext4", "-o", "noatime", "/dev/dm-0", stagingPath}},
+	)
+	d := newTestNodeServiceWithHost(host, nil)
+	d.metrics = metrics.NewMetrics()
+	d.executor = &instrumentedExecutor{Executor: fakeExec, metrics: d.metrics}
+
+	if _, err := d.NodeStageVolume(context.TODO(), newStageRequest(stagingPath, ConnectivityIscsi)); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	families, err := d.metrics.Registry().Gather()
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	var observed []string
+	for _, family := range families {
+		if family.GetName() != "ibm_block_csi_node_host_operation_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "operation" && metric.GetHistogram().GetSampleCount() == 1 {
+					observed = append(observed, label.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(observed)
+	expObserved := []string{metrics.HostOpMkfs, metrics.HostOpMount, metrics.HostOpMultipathWait, metrics.HostOpRescanWait}
+	if !reflect.DeepEqual(observed, expObserved) {
+		t.Fatalf("observed host operations mismatch: expected %v, got %v", expObserved, observed)
+	}
+}
+
+func TestCountMultipathPaths(t *testing.T) {
+	fakeExec := executor.NewFakeExecutor(executor.FakeCommand{
+		Name:   "multipathd",
+		Args:   []string{"show", "paths", "format", multipathdPathsFormat},
+		Stdout: "dev dm_st\nsdb active\nsdc active\nsdd failed\n\n",
+	})
+	d := newTestNodeService(nil)
+	d.executor = fakeExec
+
+	paths, err := d.countMultipathPaths(context.TODO())
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expPaths := map[string]int{"active": 2, "failed": 1}
+	if !reflect.DeepEqual(paths, expPaths) {
+		t.Fatalf("paths mismatch: expected %v, got %v", expPaths, paths)
+	}
+}
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	}
+
+	resp, err := chainUnaryInterceptors(interceptor("first"), interceptor("second"))(context.TODO(), "req", &grpc.UnaryServerInfo{}, handler)
+	if err != nil || resp != "req" {
+		t.Fatalf("Expected the handler response, got %v, %v", resp, err)
+	}
+	if expCalls := []string{"first", "second", "handler"}; !reflect.DeepEqual(calls, expCalls) {
+		t.Fatalf("calls mismatch: expected %v, got %v", expCalls, calls)
+	}
+}
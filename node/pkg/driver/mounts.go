@@ -0,0 +1,101 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	// hostMountInfoPath is the mount table of the host init process. The node plugin runs in the host
+	// PID namespace, so this is the mount namespace of the host and not the one of the container,
+	// which misses the host mounts outside of the directories mounted into the container.
+	hostMountInfoPath = "/proc/1/mountinfo"
+
+	mountInfoSeparator = "-"
+)
+
+// mountEntry is one mount of the host mount table.
+type mountEntry struct {
+	Device     string
+	MountPoint string
+	FsType     string
+	Options    string
+	// MajorMinor is the device number of the mounted file system, e.g. 253:3
+	MajorMinor string
+}
+
+// readMounts returns the mount table of the host. It fails rather than falling back to another
+// mount table, callers must not assume a device is unused when the host mounts are unknown.
+func (d *nodeService) readMounts() ([]mountEntry, error) {
+	path := d.hostRoot.Path(hostMountInfoPath)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the host mount table %s, does the node plugin run with hostPID? %v", path, err)
+	}
+	return parseMountInfo(string(content)), nil
+}
+
+// parseMountInfo parses the lines of /proc/<pid>/mountinfo:
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(content string) []mountEntry {
+	var mounts []mountEntry
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		separator := -1
+		// the optional fields before the separator start at the 7th field
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == mountInfoSeparator {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+3 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Device:     unescapeMountField(fields[separator+2]),
+			MountPoint: unescapeMountField(fields[4]),
+			FsType:     fields[separator+1],
+			Options:    fields[5],
+			MajorMinor: fields[2],
+		})
+	}
+	return mounts
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space, \011 for tab ...) of the mount table.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
@@ -21,17 +21,22 @@ import (
 	"context"
 	"fmt"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	util "github.com/ibm/ibm-block-csi-driver/node/util"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog"
+	"sync"
 	//"k8s.io/kubernetes/pkg/util/mount" // TODO since there is error "loading module requirements" I comment it out for now.
 )
 
-var (
-	nodeCaps = []csi.NodeServiceCapability_RPC_Type{
-		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-	}
+const (
+	iscsiInitiatorNamePath = "/etc/iscsi/initiatorname.iscsi"
+)
 
+var (
 	// volumeCaps represents how the volume could be accessed.
 	// It is SINGLE_NODE_WRITER since EBS volume could only be
 	// attached to a single node at any given time.
@@ -45,37 +50,73 @@ var (
 // nodeService represents the node service of CSI driver
 type nodeService struct {
 	//mounter  *mount.SafeFormatAndMount  // TODO fix k8s mount import
+	// configMu guards configYaml, which a config reload replaces, read it with currentConfig
+	configMu   *sync.RWMutex
 	configYaml ConfigFile
 	hostname   string
 	nodeUtils  NodeUtilsInterface
+	executor   executor.Executor
+	hostRoot   util.HostRoot
+	journal    *journal.Journal
+	// metrics is nil when the node driver runs without metrics
+	metrics *metrics.Metrics
+	// reachability holds the latest probe of the storage arrays of the config
+	reachability *reachabilityChecker
 }
 
 // newNodeService creates a new node service
 // it panics if failed to create the service
-func NewNodeService(configYaml ConfigFile, hostname string, nodeUtils NodeUtilsInterface) nodeService {
+func NewNodeService(configYaml ConfigFile, hostname string, nodeUtils NodeUtilsInterface, executor executor.Executor, hostRoot util.HostRoot, journal *journal.Journal) nodeService {
 	return nodeService{
-		configYaml: configYaml,
-		hostname:   hostname,
-		nodeUtils:  nodeUtils,
+		configMu:     &sync.RWMutex{},
+		configYaml:   configYaml,
+		hostname:     hostname,
+		nodeUtils:    nodeUtils,
+		executor:     executor,
+		hostRoot:     hostRoot,
+		journal:      journal,
+		reachability: newReachabilityChecker(),
 
 		//		mounter:  newSafeMounter(),
 	}
 }
 
+// currentConfig returns the latest config. The copy stays consistent when the config is reloaded.
+func (d *nodeService) currentConfig() ConfigFile {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.configYaml
+}
+
+// setConfig replaces the config at once for all readers.
+func (d *nodeService) setConfig(config ConfigFile) {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	d.configYaml = config
+}
+
 func (d *nodeService) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.V(5).Infof("NodeStageVolume: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodeStageVolume: called with args %+v", *req)
 
 	err := d.nodeStageVolumeRequestValidation(req)
 	if err != nil {
-		switch err.(type) {
-		case *RequestValidationError:
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		default:
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, toStatusError(err)
 	}
 
-	return nil, status.Errorf(codes.Unimplemented, "NodeStageVolume - Not implemented yet") // TODO
+	// A volume that is already staged gets its stage info persisted, for NodeUnstageVolume,
+	// NodeGetVolumeStats and NodeExpandVolume after a restart of the node plugin
+	staged, err := d.persistStagedVolume(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if staged {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := d.stageVolume(ctx, req); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (d *nodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeRequest) error {
@@ -84,6 +125,9 @@ func (d *nodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeR
 	if len(volumeID) == 0 {
 		return &RequestValidationError{"Volume ID not provided"}
 	}
+	if volumeWwn(volumeID) == "" {
+		return &RequestValidationError{fmt.Sprintf("Volume ID %s has no volume WWN", volumeID)}
+	}
 
 	target := req.GetStagingTargetPath()
 	if len(target) == 0 {
@@ -104,14 +148,19 @@ func (d *nodeService) nodeStageVolumeRequestValidation(req *csi.NodeStageVolumeR
 	case *csi.VolumeCapability_Block:
 		return &RequestValidationError{"Volume Access Type Block is not supported yet"}
 	}
+	if fsType := volCap.GetMount().GetFsType(); fsType != "" && !isSupportedFsType(fsType) {
+		return &RequestValidationError{fmt.Sprintf("Volume fs type %s is not supported, expected one of %v", fsType, supportedFsTypes)}
+	}
 
-	// TODO add check if its a mount volume and publish context
+	if _, err := parsePublishContext(req.GetPublishContext(), d.currentConfig()); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.V(5).Infof("NodeUnstageVolume: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodeUnstageVolume: called with args %+v", *req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -122,53 +171,22 @@ func (d *nodeService) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
 
-	/*
-		TODO: fix issue with k8s mount in the import section and then uncomment this one.
-		// Check if target directory is a mount point. GetDeviceNameFromMount
-		// given a mnt point, finds the device from /proc/mounts
-		// returns the device name, reference count, and error code
-		dev, refCount, err := mount.GetDeviceNameFromMount(d.mounter, target)
-		// TODO but its not enough for idempotancy, need to add additional find of the device even if the mountpoint not exist.
-		if err != nil {
-			msg := fmt.Sprintf("failed to check if volume is mounted: %v", err)
-			return nil, status.Error(codes.Internal, msg)
-		}
-
-
-		// From the spec: If the volume corresponding to the volume_id
-		// is not staged to the staging_target_path, the Plugin MUST
-		// reply 0 OK.
-		if refCount == 0 {
-			klog.V(5).Infof("NodeUnstageVolume: %s target not mounted", target)
-			return &csi.NodeUnstageVolumeResponse{}, nil
-		}
-
-		if refCount > 1 {
-			klog.Warningf("NodeUnstageVolume: found %d references to device %s mounted at target path %s", refCount, dev, target)
-		}
-
-		klog.V(5).Infof("NodeUnstageVolume: unmounting %s", target)
-		err = d.mounter.Unmount(target)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Could not unmount target %q: %v", target, err)
-		}
-		return &csi.NodeUnstageVolumeResponse{}, nil
-	*/
-
-	return nil, status.Errorf(codes.Unimplemented, "NodeUnstageVolume - Not implemented yet") // TODO
+	stageInfo := d.getStageInfo(ctx, volumeID)
+	if stageInfo != nil {
+		logging.FromContext(ctx).V(5).Infof("NodeUnstageVolume: volume %s was staged with %+v", volumeID, *stageInfo)
+	}
+	if err := d.unstageVolume(ctx, volumeID, target); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (d *nodeService) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.V(5).Infof("NodePublishVolume: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodePublishVolume: called with args %+v", *req)
 
 	err := d.nodePublishVolumeRequestValidation(req)
 	if err != nil {
-		switch err.(type) {
-		case *RequestValidationError:
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		default:
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, toStatusError(err)
 	}
 
 	if err := d.nodePublishVolumeForFileSystem(req); err != nil {
@@ -209,7 +227,7 @@ func (d *nodeService) nodePublishVolumeRequestValidation(req *csi.NodePublishVol
 }
 
 func (d *nodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.V(5).Infof("NodeUnpublishVolume: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodeUnpublishVolume: called with args %+v", *req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -222,7 +240,7 @@ func (d *nodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	// TODO fix k8s mount import and then uncomment this section
 	/*
-		klog.V(5).Infof("NodeUnpublishVolume: unmounting %s", target)
+		logging.FromContext(ctx).V(5).Infof("NodeUnpublishVolume: unmounting %s", target)
 		err := d.mounter.Unmount(target)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "Could not unmount %q: %v", target, err)
@@ -235,15 +253,51 @@ func (d *nodeService) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 }
 
 func (d *nodeService) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	logging.FromContext(ctx).V(5).Infof("NodeGetVolumeStats: called with args %+v", *req)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	stageInfo := d.getStageInfo(ctx, volumeID)
+	if stageInfo != nil {
+		logging.FromContext(ctx).V(5).Infof("NodeGetVolumeStats: volume %s was staged with %+v", volumeID, *stageInfo)
+	}
+
 	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not implemented yet")
 }
 
 func (d *nodeService) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	logging.FromContext(ctx).V(5).Infof("NodeExpandVolume: called with args %+v", *req)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	stageInfo := d.getStageInfo(ctx, volumeID)
+	if stageInfo != nil {
+		logging.FromContext(ctx).V(5).Infof("NodeExpandVolume: volume %s was staged with %+v", volumeID, *stageInfo)
+	}
+
 	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("NodeExpandVolume is not yet implemented"))
 }
 
 func (d *nodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.V(5).Infof("NodeGetCapabilities: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodeGetCapabilities: called with args %+v", *req)
+	nodeCaps, err := nodeCapabilities(d.currentConfig())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	var caps []*csi.NodeServiceCapability
 	for _, cap := range nodeCaps {
 		c := &csi.NodeServiceCapability{
@@ -259,20 +313,49 @@ func (d *nodeService) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 }
 
 func (d *nodeService) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	klog.V(5).Infof("NodeGetInfo: called with args %+v", *req)
+	logging.FromContext(ctx).V(5).Infof("NodeGetInfo: called with args %+v", *req)
 
-	iscsiIQN, err := d.nodeUtils.ParseIscsiInitiators("/etc/iscsi/initiatorname.iscsi")
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	iscsiIQN, iscsiErr := d.nodeUtils.ParseIscsiInitiators(d.hostRoot.Path(iscsiInitiatorNamePath))
+	if iscsiErr != nil {
+		iscsiIQN = ""
+		logging.FromContext(ctx).V(4).Infof("No iSCSI initiator: %v", iscsiErr)
+	}
+	fcPorts, fcErr := readFcPortNames(d.hostRoot.Path(fcHostPath))
+	if fcErr != nil {
+		logging.FromContext(ctx).V(4).Infof("No FC host ports: %v", fcErr)
+	} else {
+		logging.FromContext(ctx).V(4).Infof("FC host ports : %v", fcPorts)
+	}
+	if iscsiErr != nil && fcErr != nil {
+		return nil, status.Error(codes.Internal, iscsiErr.Error())
+	}
+	if iscsiErr != nil {
+		// TODO: the node ID carries the iSCSI initiator only, the controller cannot map FC WWPNs to a host yet
+		return nil, status.Errorf(codes.FailedPrecondition, "FC-only nodes are not supported, the node has FC host ports %v and no iSCSI initiator: %v", fcPorts, iscsiErr)
 	}
 
 	delimiter := ";"
 
 	nodeId := d.hostname + delimiter + iscsiIQN
-	klog.V(4).Infof("node id is : %s", nodeId)
+	logging.FromContext(ctx).V(4).Infof("node id is : %s", nodeId)
+
+	config := d.currentConfig()
+	segments := topologySegments(config)
+	for key, value := range d.reachabilitySegments(ctx) {
+		segments[key] = value
+	}
+	logging.FromContext(ctx).V(4).Infof("node topology is : %v", segments)
+
+	maxVolumes, err := d.maxVolumesPerNode(config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logging.FromContext(ctx).V(4).Infof("max volumes per node is : %d", maxVolumes)
 
 	return &csi.NodeGetInfoResponse{
-		NodeId: nodeId,
+		NodeId:             nodeId,
+		MaxVolumesPerNode:  maxVolumes,
+		AccessibleTopology: &csi.Topology{Segments: segments},
 	}, nil
 }
 
@@ -281,12 +364,12 @@ func (d *nodeService) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeR
 		target := req.GetTargetPath()
 		source := req.GetStagingTargetPath()
 
-		klog.V(5).Infof("NodePublishVolume: creating dir %s", target)
+		logging.V(5).Infof("NodePublishVolume: creating dir %s", target)
 		if err := d.mounter.MakeDir(target); err != nil {
 			return status.Errorf(codes.Internal, "Could not create dir %q: %v", target, err)
 		}
 
-		klog.V(5).Infof("NodePublishVolume: mounting %s at %s", source, target)
+		logging.V(5).Infof("NodePublishVolume: mounting %s at %s", source, target)
 		if err := d.mounter.Mount(source, target, ""); err != nil { // TODO add support for mountOptions
 			return status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, target, err)
 		}
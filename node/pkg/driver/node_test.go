@@ -21,16 +21,23 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	gomock "github.com/golang/mock/gomock"
 	mocks "github.com/ibm/ibm-block-csi-driver/node/mocks"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	util "github.com/ibm/ibm-block-csi-driver/node/util"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"reflect"
 	"testing"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 )
 
-const (
-	PublishContextParamLun          string = "PUBLISH_CONTEXT_LUN" // TODO for some reason I coun't take it from config.yaml
-	PublishContextParamConnectivity string = "PUBLISH_CONTEXT_CONNECTIVITY"
+var (
+	// publish context keys of the default controller config, which the shared config file has too
+	PublishContextParamLun          = defaultConfig().Controller.Publish_context_lun_parameter
+	PublishContextParamConnectivity = defaultConfig().Controller.Publish_context_connectivity_parameter
 )
 
 func TestNodeStageVolume(t *testing.T) {
@@ -106,14 +113,61 @@ func TestNodeStageVolume(t *testing.T) {
 			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "fail because not implemented yet - but pass all basic verifications",
+			name: "fail no LUN in PublishContext",
+			req: &csi.NodeStageVolumeRequest{
+				PublishContext:    map[string]string{PublishContextParamConnectivity: "iSCSI"},
+				StagingTargetPath: "/test/path",
+				VolumeCapability:  stdVolCap,
+				VolumeId:          "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail invalid LUN in PublishContext",
+			req: &csi.NodeStageVolumeRequest{
+				PublishContext:    map[string]string{PublishContextParamLun: "one", PublishContextParamConnectivity: "iSCSI"},
+				StagingTargetPath: "/test/path",
+				VolumeCapability:  stdVolCap,
+				VolumeId:          "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail unsupported connectivity in PublishContext",
+			req: &csi.NodeStageVolumeRequest{
+				PublishContext:    map[string]string{PublishContextParamLun: "1", PublishContextParamConnectivity: "nvme"},
+				StagingTargetPath: "/test/path",
+				VolumeCapability:  stdVolCap,
+				VolumeId:          "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail VolumeId without a volume WWN",
 			req: &csi.NodeStageVolumeRequest{
 				PublishContext:    map[string]string{PublishContextParamLun: "1", PublishContextParamConnectivity: "iSCSI"},
 				StagingTargetPath: "/test/path",
 				VolumeCapability:  stdVolCap,
 				VolumeId:          "vol-test",
 			},
-			expErrCode: codes.Unimplemented,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail unsupported fs type",
+			req: &csi.NodeStageVolumeRequest{
+				PublishContext:    map[string]string{PublishContextParamLun: "1", PublishContextParamConnectivity: "iSCSI"},
+				StagingTargetPath: "/test/path",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs"},
+					},
+				},
+				VolumeId: "SVC:6005076810830198A800000000000001",
+			},
+			expErrCode: codes.InvalidArgument,
 		},
 	}
 
@@ -141,9 +195,11 @@ func TestNodeStageVolume(t *testing.T) {
 
 func newTestNodeService(nodeUtils NodeUtilsInterface) nodeService {
 	return nodeService{
+		configMu:   &sync.RWMutex{},
 		hostname:   "test-host",
-		configYaml: ConfigFile{},
+		configYaml: ConfigFile{Controller: defaultConfig().Controller},
 		nodeUtils:  nodeUtils,
+		executor:   executor.NewFakeExecutor(),
 	}
 }
 
@@ -168,12 +224,12 @@ func TestNodeUnstageVolume(t *testing.T) {
 			expErrCode: codes.InvalidArgument,
 		},
 		{
-			name: "fail because not implemented yet - but pass all basic verifications",
+			name: "success volume not staged",
 			req: &csi.NodeUnstageVolumeRequest{
 				VolumeId:          "vol-test",
 				StagingTargetPath: "/test/path",
 			},
-			expErrCode: codes.Unimplemented,
+			expErrCode: codes.OK,
 		},
 	}
 
@@ -352,23 +408,51 @@ func TestNodeUnpublishVolume(t *testing.T) {
 }
 
 func TestNodeGetVolumeStats(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.NodeGetVolumeStatsRequest
+		expErrCode codes.Code
+	}{
+		{
+			name: "fail no VolumeId",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumePath: "/test/path",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no VolumePath",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumeId: "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail because not implemented yet - but pass all basic verifications",
+			req: &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "vol-test",
+				VolumePath: "/test/path",
+			},
+			expErrCode: codes.Unimplemented,
+		},
+	}
 
-	req := &csi.NodeGetVolumeStatsRequest{}
-
-	d := newTestNodeService(nil)
-
-	expErrCode := codes.Unimplemented
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestNodeService(nil)
 
-	_, err := d.NodeGetVolumeStats(context.TODO(), req)
-	if err == nil {
-		t.Fatalf("Expected error code %d, got nil", expErrCode)
-	}
-	srvErr, ok := status.FromError(err)
-	if !ok {
-		t.Fatalf("Could not get error status code from error: %v", srvErr)
-	}
-	if srvErr.Code() != expErrCode {
-		t.Fatalf("Expected error code %d, got %d message %s", expErrCode, srvErr.Code(), srvErr.Message())
+			_, err := d.NodeGetVolumeStats(context.TODO(), tc.req)
+			if err == nil {
+				t.Fatalf("Expected error code %d, got nil", tc.expErrCode)
+			}
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d message %s", tc.expErrCode, srvErr.Code(), srvErr.Message())
+			}
+		})
 	}
 }
 
@@ -426,13 +510,17 @@ func TestNodeGetInfo(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			req := &csi.NodeGetInfoRequest{}
 
+			host := newFakeHost(t)
+			defer host.cleanup()
+
 			mockCtrl := gomock.NewController(t)
 			defer mockCtrl.Finish()
 
 			fake_nodeutils := mocks.NewMockNodeUtilsInterface(mockCtrl)
-			fake_nodeutils.EXPECT().ParseIscsiInitiators("/etc/iscsi/initiatorname.iscsi").Return(tc.returned_iqn, tc.returned_error)
+			fake_nodeutils.EXPECT().ParseIscsiInitiators(host.root+iscsiInitiatorNamePath).Return(tc.returned_iqn, tc.returned_error)
 
-			d := newTestNodeService(fake_nodeutils)
+			d := newTestNodeServiceWithHost(host, nil)
+			d.nodeUtils = fake_nodeutils
 
 			expReponse := &csi.NodeGetInfoResponse{NodeId: tc.expNodeId}
 
@@ -456,3 +544,32 @@ func TestNodeGetInfo(t *testing.T) {
 	}
 }
 
+
+func TestNodeGetInfoWithHostRoot(t *testing.T) {
+	hostRoot, err := ioutil.TempDir("", "fake-host-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary host root : %v", err)
+	}
+	defer os.RemoveAll(hostRoot)
+
+	iscsiDir := filepath.Join(hostRoot, "etc", "iscsi")
+	if err := os.MkdirAll(iscsiDir, 0755); err != nil {
+		t.Fatalf("Cannot create %s : %v", iscsiDir, err)
+	}
+	initiatorName := []byte("InitiatorName=iqn.1994-07.com.redhat:e123456789\n")
+	if err := ioutil.WriteFile(filepath.Join(iscsiDir, "initiatorname.iscsi"), initiatorName, 0644); err != nil {
+		t.Fatalf("Cannot write initiator name file : %v", err)
+	}
+
+	d := newTestNodeService(NewNodeUtils())
+	d.hostRoot = util.HostRoot(hostRoot)
+
+	res, err := d.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expNodeId := "test-host;iqn.1994-07.com.redhat:e123456789"
+	if res.NodeId != expNodeId {
+		t.Fatalf("Expected node id %s, got %s", expNodeId, res.NodeId)
+	}
+}
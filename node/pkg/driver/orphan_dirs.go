@@ -0,0 +1,267 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+// Policies of the orphaned directory cleanup
+const (
+	CleanupPolicyDisabled = "disabled"
+	CleanupPolicyReport   = "report"
+	CleanupPolicyRemove   = "remove"
+
+	DefaultCleanupInterval = 10 * time.Minute
+	DefaultCleanupMinAge   = time.Hour
+)
+
+const (
+	// Kubelet creates the publish path of a volume at <kubelet dir>/pods/<pod uid>/volumes/kubernetes.io~csi/<pv name>/mount
+	kubeletCsiPodVolumesDir = "pods/*/volumes/kubernetes.io~csi"
+	kubeletVolDataFile      = "vol_data.json"
+	kubeletStagingDirName   = "globalmount"
+	kubeletPublishDirName   = "mount"
+
+	// Block devices of the host by their major:minor device number
+	sysDevBlockPath = "/sys/dev/block"
+)
+
+// kubeletVolData is the part of the vol_data.json file kubelet writes next to CSI volume directories.
+type kubeletVolData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// orphanDir is a staging or publish directory of this driver that no volume uses anymore.
+type orphanDir struct {
+	Path     string
+	VolumeId string
+	// StaleMount is the device of a mount whose device is gone, empty for an unmounted directory
+	StaleMount string
+}
+
+func (o orphanDir) String() string {
+	if o.StaleMount != "" {
+		return fmt.Sprintf("stale mount of %s on %s (volume %s)", o.StaleMount, o.Path, o.VolumeId)
+	}
+	return fmt.Sprintf("unmounted directory %s (volume %s)", o.Path, o.VolumeId)
+}
+
+// runOrphanDirCleanup scans the kubelet directories for orphaned driver directories every interval
+// until stopCh is closed. The policy is read from the current config on every scan, so a config
+// reload can change it.
+func (d *nodeService) runOrphanDirCleanup(stopCh <-chan struct{}) {
+	policy := CleanupPolicyDisabled
+	for {
+		interval := d.currentConfig().Node.Orphan_dir_cleanup.Interval
+		if interval <= 0 {
+			interval = DefaultCleanupInterval
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		newPolicy := d.currentConfig().Node.Orphan_dir_cleanup.Policy
+		if newPolicy == "" {
+			newPolicy = CleanupPolicyDisabled
+		}
+		if newPolicy != policy {
+			logging.Infof("Orphaned directory cleanup runs with policy %s and interval %v", newPolicy, interval)
+			policy = newPolicy
+		}
+		if policy == CleanupPolicyDisabled {
+			continue
+		}
+		if err := d.cleanupOrphanDirs(context.Background()); err != nil {
+			logging.Errorf("Orphaned directory cleanup failed: %v", err)
+		}
+	}
+}
+
+// cleanupOrphanDirs runs one scan and reports or removes the orphaned directories according to the policy.
+func (d *nodeService) cleanupOrphanDirs(ctx context.Context) error {
+	orphans, err := d.findOrphanDirs(time.Now())
+	if err != nil {
+		return err
+	}
+
+	policy := d.currentConfig().Node.Orphan_dir_cleanup.Policy
+	for _, orphan := range orphans {
+		if policy != CleanupPolicyRemove {
+			logging.Warningf("Found orphaned %s", orphan)
+			continue
+		}
+		if err := d.removeOrphanDir(ctx, orphan); err != nil {
+			logging.Errorf("Failed to clean up orphaned %s: %v", orphan, err)
+			continue
+		}
+		logging.Infof("Cleaned up orphaned %s", orphan)
+	}
+	return nil
+}
+
+// findOrphanDirs returns the staging and publish directories of this driver that are not mounted and
+// were not modified for the minimum age, and the ones mounted from a device that no longer exists.
+func (d *nodeService) findOrphanDirs(now time.Time) ([]orphanDir, error) {
+	minAge := d.currentConfig().Node.Orphan_dir_cleanup.Min_age
+	if minAge <= 0 {
+		minAge = DefaultCleanupMinAge
+	}
+
+	mounts, err := d.readMounts()
+	if err != nil {
+		return nil, err
+	}
+	mountsByPath := map[string]mountEntry{}
+	for _, mount := range mounts {
+		mountsByPath[filepath.Clean(mount.MountPoint)] = mount
+	}
+
+	var orphans []orphanDir
+	patterns := map[string]string{
+		filepath.Join(d.kubeletDir(), kubeletCsiStagingDir, "*", kubeletVolDataFile):    kubeletStagingDirName,
+		filepath.Join(d.kubeletDir(), kubeletCsiPodVolumesDir, "*", kubeletVolDataFile): kubeletPublishDirName,
+	}
+	for pattern, dirName := range patterns {
+		volDataFiles, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, volDataFile := range volDataFiles {
+			volData, ok := d.readDriverVolData(volDataFile)
+			if !ok {
+				continue
+			}
+			dir := filepath.Join(filepath.Dir(volDataFile), dirName)
+
+			if mount, mounted := mountsByPath[dir]; mounted {
+				if d.isStaleMount(mount) {
+					orphans = append(orphans, orphanDir{Path: dir, VolumeId: volData.VolumeHandle, StaleMount: mount.Device})
+				}
+				continue
+			}
+
+			info, err := os.Stat(dir)
+			if os.IsNotExist(err) {
+				// only the vol_data.json of kubelet is left, which kubelet removes itself
+				continue
+			}
+			if err != nil {
+				logging.Warningf("Failed to check %s: %v", dir, err)
+				continue
+			}
+			if now.Sub(info.ModTime()) < minAge {
+				logging.V(5).Infof("Unmounted directory %s is too new to be orphaned", dir)
+				continue
+			}
+			orphans = append(orphans, orphanDir{Path: dir, VolumeId: volData.VolumeHandle})
+		}
+	}
+
+	sort.Slice(orphans, func(i, k int) bool { return orphans[i].Path < orphans[k].Path })
+	return orphans, nil
+}
+
+// readDriverVolData returns the vol_data.json content if it belongs to a volume of this driver.
+func (d *nodeService) readDriverVolData(path string) (kubeletVolData, bool) {
+	var volData kubeletVolData
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.V(4).Infof("Failed to read %s: %v", path, err)
+		return volData, false
+	}
+	if err := json.Unmarshal(content, &volData); err != nil {
+		logging.V(4).Infof("Failed to parse %s: %v", path, err)
+		return volData, false
+	}
+	return volData, volData.DriverName == d.currentConfig().Identity.Name
+}
+
+// isStaleMount returns true for a mount of the host mount table whose block device no longer exists
+// on the host, by its device number.
+func (d *nodeService) isStaleMount(mount mountEntry) bool {
+	if !strings.HasPrefix(mount.Device, "/dev/") || mount.MajorMinor == "" {
+		return false
+	}
+	_, err := os.Stat(d.hostRoot.Path(filepath.Join(sysDevBlockPath, mount.MajorMinor)))
+	return os.IsNotExist(err)
+}
+
+// removeOrphanDir unmounts a stale mount, removes the empty directory and the stage info of an orphaned
+// staging directory.
+// The vol_data.json file and the volume directory are left to kubelet, which removes them once it no
+// longer tracks the volume. The unmount, directory and stage info removals are recorded in the journal.
+func (d *nodeService) removeOrphanDir(ctx context.Context, orphan orphanDir) error {
+	var steps []string
+	if orphan.StaleMount != "" {
+		steps = append(steps, stepUnmount)
+	}
+	steps = append(steps, stepRemoveDir)
+	if filepath.Base(orphan.Path) == kubeletStagingDirName {
+		steps = append(steps, stepRemoveStageInfo)
+	}
+	op, err := d.beginOperation(operationCleanupOrphanDir, orphan.VolumeId, steps, map[string]string{operationParamPath: orphan.Path})
+	if err != nil {
+		return err
+	}
+	// as for stale devices, the next scan retries a failed cleanup
+	defer d.finishOperation(op)
+	return d.runOrphanDirRemoval(ctx, op, orphan)
+}
+
+// runOrphanDirRemoval runs the steps of the cleanup of an orphaned directory that are not done in
+// the journal yet.
+func (d *nodeService) runOrphanDirRemoval(ctx context.Context, op *journal.Operation, orphan orphanDir) error {
+	if orphan.StaleMount != "" {
+		if err := d.runStep(op, stepUnmount, func() error {
+			_, err := d.executor.Execute(ctx, "umount", orphan.Path)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := d.runStep(op, stepRemoveDir, func() error {
+		// os.Remove never deletes a directory that still has content, so data is never lost here
+		if err := os.Remove(orphan.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if filepath.Base(orphan.Path) == kubeletStagingDirName {
+		if err := d.runStep(op, stepRemoveStageInfo, func() error { return d.removeStageInfo(orphan.VolumeId, orphan.Path) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
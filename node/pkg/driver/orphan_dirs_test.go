@@ -0,0 +1,138 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+)
+
+const (
+	testDriverName = "ibm-block-csi-driver"
+)
+
+func TestOrphanDirCleanup(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+
+	kubeletDir := "/var/lib/kubelet"
+	stagingDir := func(pv string) string {
+		return filepath.Join(kubeletDir, kubeletCsiStagingDir, pv, kubeletStagingDirName)
+	}
+	publishDir := func(pod, pv string) string {
+		return filepath.Join(kubeletDir, "pods", pod, "volumes/kubernetes.io~csi", pv, kubeletPublishDirName)
+	}
+	volData := func(driverName string, volumeId string) string {
+		return `{"driverName": "` + driverName + `", "volumeHandle": "` + volumeId + `"}`
+	}
+
+	// mounted staging directory of a live device
+	host.writeFile(filepath.Join(stagingDir("pv-live"), "..", kubeletVolDataFile), volData(testDriverName, "vol-live"))
+	host.mkdir(stagingDir("pv-live"))
+	host.mkdir(sysDevBlockPath + "/253:0")
+	// unmounted staging directory
+	host.writeFile(filepath.Join(stagingDir("pv-orphan"), "..", kubeletVolDataFile), volData(testDriverName, "vol-orphan"))
+	host.mkdir(stagingDir("pv-orphan"))
+	host.writeFile(filepath.Join(DefaultStageInfoDir, stageInfoFileName("vol-orphan")),
+		`{"version": 1, "volumeId": "vol-orphan", "stagingPath": "`+filepath.Join(host.root, stagingDir("pv-orphan"))+`"}`)
+	// publish directory mounted from a device that is gone
+	host.writeFile(filepath.Join(publishDir("pod-1", "pv-gone"), "..", kubeletVolDataFile), volData(testDriverName, "vol-gone"))
+	host.mkdir(publishDir("pod-1", "pv-gone"))
+	// unmounted publish directory that was just created
+	host.writeFile(filepath.Join(publishDir("pod-2", "pv-new"), "..", kubeletVolDataFile), volData(testDriverName, "vol-new"))
+	host.mkdir(publishDir("pod-2", "pv-new"))
+	// unmounted publish directory of another driver
+	host.writeFile(filepath.Join(publishDir("pod-3", "pv-other"), "..", kubeletVolDataFile), volData("other-driver", "vol-other"))
+	host.mkdir(publishDir("pod-3", "pv-other"))
+
+	host.writeFile("/proc/1/mountinfo",
+		"40 22 253:0 / "+filepath.Join(host.root, stagingDir("pv-live"))+" rw,relatime shared:2 - ext4 /dev/dm-0 rw\n"+
+			"41 22 253:7 / "+filepath.Join(host.root, publishDir("pod-1", "pv-gone"))+" rw,relatime shared:3 - ext4 /dev/dm-7 rw\n")
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{stagingDir("pv-orphan"), publishDir("pod-3", "pv-other")} {
+		if err := os.Chtimes(filepath.Join(host.root, dir), old, old); err != nil {
+			t.Fatalf("Cannot change times of %s : %v", dir, err)
+		}
+	}
+
+	fakeExec := executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "umount", Args: []string{filepath.Join(host.root, publishDir("pod-1", "pv-gone"))}},
+	)
+	d := newTestNodeServiceWithHost(host, fakeExec)
+	d.configYaml.Identity.Name = testDriverName
+	d.configYaml.Node.Orphan_dir_cleanup.Min_age = time.Hour
+
+	orphans, err := d.findOrphanDirs(time.Now())
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expOrphans := []orphanDir{
+		{Path: filepath.Join(host.root, stagingDir("pv-orphan")), VolumeId: "vol-orphan"},
+		{Path: filepath.Join(host.root, publishDir("pod-1", "pv-gone")), VolumeId: "vol-gone", StaleMount: "/dev/dm-7"},
+	}
+	if !reflect.DeepEqual(orphans, expOrphans) {
+		t.Fatalf("orphans mismatch: expected %v, got %v", expOrphans, orphans)
+	}
+
+	d.configYaml.Node.Orphan_dir_cleanup.Policy = CleanupPolicyRemove
+	if err := d.cleanupOrphanDirs(context.TODO()); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, orphan := range expOrphans {
+		if _, err := os.Stat(orphan.Path); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed, got %v", orphan.Path, err)
+		}
+		// kubelet removes its own files once it no longer tracks the volume
+		volDataFile := filepath.Join(filepath.Dir(orphan.Path), kubeletVolDataFile)
+		if _, err := os.Stat(volDataFile); err != nil {
+			t.Fatalf("Expected %s to be kept, got %v", volDataFile, err)
+		}
+	}
+	if _, err := d.readStageInfo("vol-orphan"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stage info of %s to be removed, got %v", stagingDir("pv-orphan"), err)
+	}
+	for _, dir := range []string{stagingDir("pv-live"), publishDir("pod-2", "pv-new"), publishDir("pod-3", "pv-other")} {
+		if _, err := os.Stat(filepath.Join(host.root, dir)); err != nil {
+			t.Fatalf("Expected %s to be kept, got %v", dir, err)
+		}
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	content := "40 22 253:3 / /var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv\\0401/mount rw,relatime shared:2 - ext4 /dev/mapper/mpatha rw\n" +
+		"41 22 0:4 / /proc rw,nosuid - proc proc rw\n" +
+		"42 22 0:5 / /mnt rw shared:4 master:1 - tmpfs tmpfs rw\n\nbroken line\n"
+
+	expMounts := []mountEntry{
+		{Device: "/dev/mapper/mpatha", MountPoint: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv 1/mount", FsType: "ext4", Options: "rw,relatime", MajorMinor: "253:3"},
+		{Device: "proc", MountPoint: "/proc", FsType: "proc", Options: "rw,nosuid", MajorMinor: "0:4"},
+		{Device: "tmpfs", MountPoint: "/mnt", FsType: "tmpfs", Options: "rw", MajorMinor: "0:5"},
+	}
+	if mounts := parseMountInfo(content); !reflect.DeepEqual(mounts, expMounts) {
+		t.Fatalf("mounts mismatch: expected %+v, got %+v", expMounts, mounts)
+	}
+}
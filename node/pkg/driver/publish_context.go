@@ -0,0 +1,69 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Connectivity types of the publish context, as the controller names them
+const (
+	ConnectivityIscsi = "iscsi"
+	ConnectivityFc    = "fc"
+)
+
+var supportedConnectivityTypes = []string{ConnectivityIscsi, ConnectivityFc}
+
+// publishContext is what the controller returns from ControllerPublishVolume for the node to
+// attach the volume.
+type publishContext struct {
+	Lun          int
+	Connectivity string
+}
+
+// parsePublishContext validates the publish context of a request, with the key names of the
+// controller section of the config and the LUN IDs of the array type of the node.
+func parsePublishContext(context map[string]string, config ConfigFile) (*publishContext, error) {
+	lunKey := config.Controller.Publish_context_lun_parameter
+	rawLun, ok := context[lunKey]
+	if !ok {
+		return nil, &RequestValidationError{fmt.Sprintf("Publish context has no LUN, expected key %s", lunKey)}
+	}
+	lun, err := strconv.Atoi(strings.TrimSpace(rawLun))
+	if err != nil {
+		return nil, &RequestValidationError{fmt.Sprintf("Publish context %s must be an integer LUN, got %q", lunKey, rawLun)}
+	}
+	if lunRange := arrayLunRange(config); !lunRange.contains(lun) {
+		return nil, &RequestValidationError{fmt.Sprintf("Publish context %s must be a LUN in %d-%d, got %d", lunKey, lunRange.Min, lunRange.Max, lun)}
+	}
+
+	connectivityKey := config.Controller.Publish_context_connectivity_parameter
+	rawConnectivity, ok := context[connectivityKey]
+	if !ok {
+		return nil, &RequestValidationError{fmt.Sprintf("Publish context has no connectivity type, expected key %s", connectivityKey)}
+	}
+	connectivity := strings.ToLower(strings.TrimSpace(rawConnectivity))
+	for _, supported := range supportedConnectivityTypes {
+		if connectivity == supported {
+			return &publishContext{Lun: lun, Connectivity: connectivity}, nil
+		}
+	}
+	return nil, &RequestValidationError{fmt.Sprintf("Publish context %s must be one of %s, got %q",
+		connectivityKey, strings.Join(supportedConnectivityTypes, ", "), rawConnectivity)}
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePublishContext(t *testing.T) {
+	testCases := []struct {
+		name       string
+		arrayType  string
+		context    map[string]string
+		expContext *publishContext
+		expErr     string
+	}{
+		{
+			name:       "iscsi",
+			context:    map[string]string{"LUN": "12", "CONNECTIVITY": "iscsi"},
+			expContext: &publishContext{Lun: 12, Connectivity: ConnectivityIscsi},
+		},
+		{
+			name:       "fc upper case",
+			arrayType:  ArrayTypeSvc,
+			context:    map[string]string{"LUN": "0", "CONNECTIVITY": "FC", "OTHER": "x"},
+			expContext: &publishContext{Lun: 0, Connectivity: ConnectivityFc},
+		},
+		{
+			name:    "default keys",
+			context: map[string]string{"PUBLISH_CONTEXT_LUN": "1", "PUBLISH_CONTEXT_CONNECTIVITY": "iscsi"},
+			expErr:  "Publish context has no LUN, expected key LUN",
+		},
+		{
+			name:    "not an integer",
+			context: map[string]string{"LUN": "1.5", "CONNECTIVITY": "iscsi"},
+			expErr:  `Publish context LUN must be an integer LUN, got "1.5"`,
+		},
+		{
+			name:    "negative",
+			context: map[string]string{"LUN": "-1", "CONNECTIVITY": "iscsi"},
+			expErr:  "Publish context LUN must be a LUN in 0-16383, got -1",
+		},
+		{
+			name:      "outside the array type",
+			arrayType: ArrayTypeA9000,
+			context:   map[string]string{"LUN": "0", "CONNECTIVITY": "iscsi"},
+			expErr:    "Publish context LUN must be a LUN in 1-511, got 0",
+		},
+		{
+			name:    "no connectivity",
+			context: map[string]string{"LUN": "1"},
+			expErr:  "Publish context has no connectivity type, expected key CONNECTIVITY",
+		},
+		{
+			name:    "unsupported connectivity",
+			context: map[string]string{"LUN": "1", "CONNECTIVITY": "nvme-of"},
+			expErr:  `Publish context CONNECTIVITY must be one of iscsi, fc, got "nvme-of"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var config ConfigFile
+			config.Controller.Publish_context_lun_parameter = "LUN"
+			config.Controller.Publish_context_connectivity_parameter = "CONNECTIVITY"
+			config.Node.Array_type = tc.arrayType
+
+			context, err := parsePublishContext(tc.context, config)
+			if tc.expErr != "" {
+				if validationErr, ok := err.(*RequestValidationError); !ok || validationErr.Msg != tc.expErr {
+					t.Fatalf("Expected the validation error %q, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if !reflect.DeepEqual(context, tc.expContext) {
+				t.Fatalf("Expected %+v, got %+v", tc.expContext, context)
+			}
+		})
+	}
+}
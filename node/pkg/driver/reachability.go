@@ -0,0 +1,282 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+const (
+	DefaultReachabilityInterval = time.Minute
+	DefaultReachabilityTimeout  = 5 * time.Second
+
+	// DefaultIscsiPort is the port of iSCSI portals configured without one
+	DefaultIscsiPort = "3260"
+
+	// TopologyKeyArrayPrefix is followed by the array name in the reachability segments
+	TopologyKeyArrayPrefix = TopologyKeyPrefix + "array-"
+
+	fcRemotePortsPath  = "/sys/class/fc_remote_ports"
+	fcPortStateOnline  = "Online"
+	fcRemotePortPrefix = "rport-"
+)
+
+var wwpnPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// ReachabilityConfig lists the storage arrays the node probes.
+type ReachabilityConfig struct {
+	// Time between probes
+	Interval time.Duration
+	// Time to wait for each iSCSI portal
+	Timeout time.Duration
+	// Endpoints by array name
+	Arrays map[string]ArrayEndpoints
+}
+
+// ArrayEndpoints are the endpoints the node probes to tell if it can reach a storage array.
+type ArrayEndpoints struct {
+	// iSCSI portals as host or host:port, the port defaults to 3260
+	Iscsi_portals []string
+	// WWPNs of FC target ports, reachable when the node has an online remote port for them
+	Fc_target_ports []string
+}
+
+// reachabilityChecker holds the results of the latest probe of the arrays. The methods can be
+// called on a nil *reachabilityChecker, it holds no results then.
+type reachabilityChecker struct {
+	mu sync.Mutex
+	// reachableEndpoints by array name, nil until the first probe
+	reachableEndpoints map[string]int
+}
+
+func newReachabilityChecker() *reachabilityChecker {
+	return &reachabilityChecker{}
+}
+
+func (r *reachabilityChecker) results() map[string]int {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reachableEndpoints
+}
+
+func (r *reachabilityChecker) setResults(reachableEndpoints map[string]int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reachableEndpoints = reachableEndpoints
+}
+
+// runReachabilityChecker probes the configured arrays every interval until stopCh is closed.
+func (d *nodeService) runReachabilityChecker(stopCh <-chan struct{}) {
+	for {
+		// read on every run, so a config reload changes the arrays and the interval
+		config := d.currentConfig().Node.Reachability
+		d.updateReachability(context.Background(), config)
+		interval := config.Interval
+		if interval <= 0 {
+			interval = DefaultReachabilityInterval
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// updateReachability probes the arrays of the config and publishes the results as metrics and for
+// NodeGetInfo.
+func (d *nodeService) updateReachability(ctx context.Context, config ReachabilityConfig) map[string]int {
+	reachableEndpoints := probeArrays(ctx, config, d.hostRoot.Path(fcRemotePortsPath))
+	for _, array := range sortedArrayNames(reachableEndpoints) {
+		if reachableEndpoints[array] == 0 {
+			logging.Warningf("Storage array %s is not reachable from the node", array)
+		} else {
+			logging.V(4).Infof("Storage array %s is reachable on %d endpoints", array, reachableEndpoints[array])
+		}
+	}
+	d.reachability.setResults(reachableEndpoints)
+	d.metrics.SetArrayReachability(reachableEndpoints)
+	return reachableEndpoints
+}
+
+// reachabilitySegments returns a topology segment per configured array that tells if the node
+// reaches it. It probes the arrays if the checker has not done so yet.
+func (d *nodeService) reachabilitySegments(ctx context.Context) map[string]string {
+	config := d.currentConfig().Node.Reachability
+	if len(config.Arrays) == 0 || d.reachability == nil {
+		return nil
+	}
+	reachableEndpoints := d.reachability.results()
+	if reachableEndpoints == nil {
+		reachableEndpoints = d.updateReachability(ctx, config)
+	}
+	segments := map[string]string{}
+	for array := range config.Arrays {
+		// an array added by a config reload counts as unreachable until the next probe
+		segments[TopologyKeyArrayPrefix+array] = strconv.FormatBool(reachableEndpoints[array] > 0)
+	}
+	return segments
+}
+
+// probeArrays returns the number of reachable endpoints of each array of the config. The endpoints
+// are probed concurrently, each within the probe timeout.
+func probeArrays(ctx context.Context, config ReachabilityConfig, fcRemotePortsDir string) map[string]int {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultReachabilityTimeout
+	}
+	onlineTargets := onlineFcTargetPorts(fcRemotePortsDir)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	reachableEndpoints := map[string]int{}
+	for array, endpoints := range config.Arrays {
+		fcTargets := 0
+		for _, wwpn := range endpoints.Fc_target_ports {
+			if onlineTargets[normalizeWwpn(wwpn)] {
+				fcTargets++
+			}
+		}
+		mu.Lock()
+		reachableEndpoints[array] += fcTargets
+		mu.Unlock()
+		for _, portal := range endpoints.Iscsi_portals {
+			wg.Add(1)
+			go func(array string, portal string) {
+				defer wg.Done()
+				if err := probeIscsiPortal(ctx, portal, timeout); err != nil {
+					logging.V(4).Infof("iSCSI portal %s of storage array %s is not reachable: %v", portal, array, err)
+					return
+				}
+				mu.Lock()
+				reachableEndpoints[array]++
+				mu.Unlock()
+			}(array, portal)
+		}
+	}
+	wg.Wait()
+	return reachableEndpoints
+}
+
+// probeIscsiPortal opens and closes a TCP connection to the portal.
+func probeIscsiPortal(ctx context.Context, portal string, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", iscsiPortalAddress(portal))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// iscsiPortalAddress returns the host:port of a portal, with the default iSCSI port if it has none.
+func iscsiPortalAddress(portal string) string {
+	if _, _, err := net.SplitHostPort(portal); err == nil {
+		return portal
+	}
+	return net.JoinHostPort(strings.Trim(portal, "[]"), DefaultIscsiPort)
+}
+
+// onlineFcTargetPorts returns the WWPNs of the FC remote ports the node is logged in to.
+func onlineFcTargetPorts(fcRemotePortsDir string) map[string]bool {
+	online := map[string]bool{}
+	entries, err := ioutil.ReadDir(fcRemotePortsDir)
+	if err != nil {
+		return online
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), fcRemotePortPrefix) {
+			continue
+		}
+		portDir := filepath.Join(fcRemotePortsDir, entry.Name())
+		state, err := ioutil.ReadFile(filepath.Join(portDir, "port_state"))
+		if err != nil || strings.TrimSpace(string(state)) != fcPortStateOnline {
+			continue
+		}
+		wwpn, err := ioutil.ReadFile(filepath.Join(portDir, "port_name"))
+		if err != nil {
+			continue
+		}
+		online[normalizeWwpn(string(wwpn))] = true
+	}
+	return online
+}
+
+// normalizeWwpn returns the bare lower case hex digits of a WWPN such as 0x500507680B21AC2E or
+// 50:05:07:68:0b:21:ac:2e.
+func normalizeWwpn(wwpn string) string {
+	wwpn = strings.ToLower(strings.TrimSpace(wwpn))
+	wwpn = strings.TrimPrefix(wwpn, "0x")
+	return strings.Replace(wwpn, ":", "", -1)
+}
+
+// validateArrayEndpoints verifies the name and the endpoints of an array of the config.
+func validateArrayEndpoints(array string, endpoints ArrayEndpoints) []string {
+	var problems []string
+	if len(TopologyKeyArrayPrefix+array) > len(TopologyKeyPrefix)+maxTopologyNameLength || !topologyNamePattern.MatchString(array) {
+		problems = append(problems, fmt.Sprintf("name must be at most %d letters, digits, '-', '_' and '.' between letters or digits", len(TopologyKeyPrefix)+maxTopologyNameLength-len(TopologyKeyArrayPrefix)))
+	}
+	if len(endpoints.Iscsi_portals) == 0 && len(endpoints.Fc_target_ports) == 0 {
+		problems = append(problems, "must have iscsi_portals or fc_target_ports")
+	}
+	for i, portal := range endpoints.Iscsi_portals {
+		host, port, err := net.SplitHostPort(iscsiPortalAddress(portal))
+		if err == nil && host == "" {
+			err = fmt.Errorf("missing host")
+		}
+		if err == nil {
+			if n, convErr := strconv.Atoi(port); convErr != nil || n <= 0 || n > 65535 {
+				err = fmt.Errorf("invalid port %q", port)
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("iscsi_portals[%d]: %q is not a host or host:port: %v", i, portal, err))
+		}
+	}
+	for i, wwpn := range endpoints.Fc_target_ports {
+		if !wwpnPattern.MatchString(normalizeWwpn(wwpn)) {
+			problems = append(problems, fmt.Sprintf("fc_target_ports[%d]: %q is not a WWPN of 16 hex digits", i, wwpn))
+		}
+	}
+	return problems
+}
+
+func sortedArrayNames(reachableEndpoints map[string]int) []string {
+	var arrays []string
+	for array := range reachableEndpoints {
+		arrays = append(arrays, array)
+	}
+	sort.Strings(arrays)
+	return arrays
+}
@@ -0,0 +1,155 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+)
+
+// listenPortal returns the address of a local TCP listener that stands in for an iSCSI portal.
+func listenPortal(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen : %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// closedPortal returns the address of a local TCP port nobody listens on.
+func closedPortal(t *testing.T) string {
+	address, closePortal := listenPortal(t)
+	closePortal()
+	return address
+}
+
+func TestProbeArrays(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.writeFile(fcRemotePortsPath+"/rport-1:0-0/port_name", "0x500507680b21ac2e\n")
+	host.writeFile(fcRemotePortsPath+"/rport-1:0-0/port_state", "Online\n")
+	host.writeFile(fcRemotePortsPath+"/rport-1:0-1/port_name", "0x500507680b21ac2f\n")
+	host.writeFile(fcRemotePortsPath+"/rport-1:0-1/port_state", "Blocked\n")
+
+	portal, closePortal := listenPortal(t)
+	defer closePortal()
+	unreachablePortal := closedPortal(t)
+
+	config := ReachabilityConfig{
+		Timeout: time.Second,
+		Arrays: map[string]ArrayEndpoints{
+			"fs-dal":   {Iscsi_portals: []string{portal, unreachablePortal}, Fc_target_ports: []string{"50:05:07:68:0B:21:AC:2E"}},
+			"fs-wdc":   {Iscsi_portals: []string{unreachablePortal}},
+			"fs-fc":    {Fc_target_ports: []string{"500507680b21ac2f"}},
+			"fs-iscsi": {Iscsi_portals: []string{portal}},
+		},
+	}
+	reachableEndpoints := probeArrays(context.TODO(), config, host.root+fcRemotePortsPath)
+	expEndpoints := map[string]int{"fs-dal": 2, "fs-wdc": 0, "fs-fc": 0, "fs-iscsi": 1}
+	if !reflect.DeepEqual(reachableEndpoints, expEndpoints) {
+		t.Fatalf("Expected reachable endpoints %v, got %v", expEndpoints, reachableEndpoints)
+	}
+}
+
+func TestReachabilitySegments(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	portal, closePortal := listenPortal(t)
+
+	d := newTestNodeServiceWithHost(host, executor.NewFakeExecutor())
+	d.reachability = newReachabilityChecker()
+	if segments := d.reachabilitySegments(context.TODO()); segments != nil {
+		t.Fatalf("Expected no segments without arrays, got %v", segments)
+	}
+
+	d.configYaml.Node.Reachability = ReachabilityConfig{
+		Timeout: time.Second,
+		Arrays: map[string]ArrayEndpoints{
+			"fs-dal": {Iscsi_portals: []string{portal}},
+			"fs-wdc": {Iscsi_portals: []string{closedPortal(t)}},
+		},
+	}
+	expSegments := map[string]string{TopologyKeyArrayPrefix + "fs-dal": "true", TopologyKeyArrayPrefix + "fs-wdc": "false"}
+	if segments := d.reachabilitySegments(context.TODO()); !reflect.DeepEqual(segments, expSegments) {
+		t.Fatalf("Expected segments %v after the first probe, got %v", expSegments, segments)
+	}
+
+	// the segments come from the latest probe until the checker runs again
+	closePortal()
+	if segments := d.reachabilitySegments(context.TODO()); !reflect.DeepEqual(segments, expSegments) {
+		t.Fatalf("Expected the segments %v of the latest probe, got %v", expSegments, segments)
+	}
+	d.updateReachability(context.TODO(), d.configYaml.Node.Reachability)
+	expSegments[TopologyKeyArrayPrefix+"fs-dal"] = "false"
+	if segments := d.reachabilitySegments(context.TODO()); !reflect.DeepEqual(segments, expSegments) {
+		t.Fatalf("Expected segments %v after the next probe, got %v", expSegments, segments)
+	}
+}
+
+func TestValidateArrayEndpoints(t *testing.T) {
+	testCases := []struct {
+		name        string
+		array       string
+		endpoints   ArrayEndpoints
+		expProblems []string
+	}{
+		{
+			name:      "valid",
+			array:     "fs-dal.site1",
+			endpoints: ArrayEndpoints{Iscsi_portals: []string{"10.0.0.1", "10.0.0.2:3261", "[fd00::1]", "array.example.com"}, Fc_target_ports: []string{"0x500507680B21AC2E", "50:05:07:68:0b:21:ac:2f"}},
+		},
+		{name: "no endpoints", array: "fs-dal", expProblems: []string{"must have iscsi_portals or fc_target_ports"}},
+		{
+			name:        "invalid name",
+			array:       "fs dal",
+			endpoints:   ArrayEndpoints{Iscsi_portals: []string{"10.0.0.1"}},
+			expProblems: []string{"name must be at most 57 letters, digits, '-', '_' and '.' between letters or digits"},
+		},
+		{
+			name:      "invalid endpoints",
+			array:     "fs-dal",
+			endpoints: ArrayEndpoints{Iscsi_portals: []string{"10.0.0.1:iscsi", ":3260"}, Fc_target_ports: []string{"500507680b21ac"}},
+			expProblems: []string{
+				`iscsi_portals[0]: "10.0.0.1:iscsi" is not a host or host:port: invalid port "iscsi"`,
+				`iscsi_portals[1]: ":3260" is not a host or host:port: missing host`,
+				`fc_target_ports[0]: "500507680b21ac" is not a WWPN of 16 hex digits`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if problems := validateArrayEndpoints(tc.array, tc.endpoints); !reflect.DeepEqual(problems, tc.expProblems) {
+				t.Fatalf("Expected problems %q, got %q", tc.expProblems, problems)
+			}
+		})
+	}
+}
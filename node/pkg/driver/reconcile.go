@@ -0,0 +1,307 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+const (
+	DefaultJournalRetryInterval = 10 * time.Minute
+	DefaultJournalMaxAge        = 24 * time.Hour
+)
+
+// Journaled node operations, their steps and their parameters
+const (
+	operationStage             = "stage"
+	operationUnstage           = "unstage"
+	operationRemoveStaleDevice = "remove-stale-device"
+	operationCleanupOrphanDir  = "cleanup-orphan-dir"
+
+	stepRescan          = "rescan"
+	stepWaitMultipath   = "wait-multipath"
+	stepMkfs            = "mkfs"
+	stepMount           = "mount"
+	stepWriteStageInfo  = "write-stage-info"
+	stepUnmount         = "unmount"
+	stepFlushMultipath  = "flush-multipath"
+	stepRemoveStageInfo = "remove-stage-info"
+	stepRemoveDir       = "remove-dir"
+	// stepFlushBuffers and stepDeleteDevice are done for each SCSI device, see deviceStep. An unstage
+	// has the steps of the removal of the device of its volume between stepUnmount and stepRemoveStageInfo
+	stepFlushBuffers = "flush-buffers"
+	stepDeleteDevice = "delete-device"
+
+	operationParamStagingPath  = "stagingPath"
+	operationParamPath         = "path"
+	operationParamDevice       = "device"
+	operationParamMultipathMap = "multipathMap"
+	operationParamScsiDevices  = "scsiDevices"
+)
+
+var (
+	stageSteps = []string{stepRescan, stepWaitMultipath, stepMkfs, stepMount, stepWriteStageInfo}
+)
+
+// reconcile recovers the operations that were interrupted by a restart of the node plugin.
+// It must run before the driver starts serving requests.
+func (d *nodeService) reconcile(ctx context.Context) error {
+	if d.journal == nil {
+		return nil
+	}
+	report, err := d.recoverOperations(ctx)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Startup reconciliation report: %s", report)
+	return nil
+}
+
+// runJournalRecovery retries the recovery of the operations whose recovery failed every interval
+// until stopCh is closed, after moving the operations older than the max age out of the journal.
+func (d *nodeService) runJournalRecovery(stopCh <-chan struct{}) {
+	if d.journal == nil {
+		return
+	}
+	for {
+		// read on every run, so a config reload changes the interval and the max age
+		recovery := d.currentConfig().Node.Journal_recovery
+		interval := recovery.Retry_interval
+		if interval <= 0 {
+			interval = DefaultJournalRetryInterval
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		maxAge := recovery.Max_age
+		if maxAge <= 0 {
+			maxAge = DefaultJournalMaxAge
+		}
+		expired, err := d.journal.Expire(maxAge)
+		for _, op := range expired {
+			d.metrics.ObserveJournalExpiry(op.Type)
+		}
+		if err != nil {
+			logging.Errorf("Failed to expire unfinished node operations: %v", err)
+		}
+		report, err := d.recoverOperations(context.Background())
+		if err != nil {
+			logging.Errorf("%v", err)
+		} else if len(report) > 0 {
+			logging.Infof("Journal recovery report: %s", report)
+		}
+	}
+}
+
+// recoverOperations recovers the unfinished operations of the journal that are not in progress,
+// and updates the metric of the failed ones.
+func (d *nodeService) recoverOperations(ctx context.Context) (journal.Report, error) {
+	report, err := d.journal.Reconcile(ctx, map[string]journal.RecoveryFunc{
+		operationStage:             d.rollBackStage,
+		operationUnstage:           d.replayUnstage,
+		operationRemoveStaleDevice: d.replayDeviceRemoval,
+		operationCleanupOrphanDir:  d.replayOrphanDirCleanup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile unfinished node operations: %v", err)
+	}
+	d.metrics.SetJournalFailures(report.Failed())
+	return report, nil
+}
+
+// rollBackStage undoes a stage that did not complete. Kubelet retries NodeStageVolume, which then
+// starts over from a clean host state.
+func (d *nodeService) rollBackStage(ctx context.Context, op *journal.Operation) (journal.RecoveryAction, error) {
+	if err := d.undoStage(ctx, op); err != nil {
+		return journal.ActionFailed, err
+	}
+	return journal.ActionRolledBack, nil
+}
+
+// replayUnstage completes an unstage that did not complete, since the volume is about to be detached anyway.
+func (d *nodeService) replayUnstage(ctx context.Context, op *journal.Operation) (journal.RecoveryAction, error) {
+	stagingPath := op.Params[operationParamStagingPath]
+	if stagingPath == "" {
+		return journal.ActionFailed, fmt.Errorf("missing %s parameter", operationParamStagingPath)
+	}
+	var device *ibmDevice
+	if op.Params[operationParamDevice] != "" {
+		if remaining, ok := d.remainingDevice(op, volumeWwn(op.VolumeId)); ok {
+			device = &remaining
+		}
+	}
+	if err := d.runUnstage(ctx, op, op.VolumeId, stagingPath, device); err != nil {
+		return journal.ActionFailed, err
+	}
+	return journal.ActionReplayed, nil
+}
+
+// undoStage unmounts the staging path of the operation, removes the device of its volume unless
+// something else uses it, and removes the stage info. Each of them is checked on the host rather
+// than trusted from the journal, a step may have been done right before the restart without
+// being recorded.
+func (d *nodeService) undoStage(ctx context.Context, op *journal.Operation) error {
+	stagingPath := op.Params[operationParamStagingPath]
+	if stagingPath == "" {
+		return fmt.Errorf("missing %s parameter", operationParamStagingPath)
+	}
+	var device *ibmDevice
+	if wwn := volumeWwn(op.VolumeId); wwn != "" {
+		if found, ok := d.findVolumeDevice(wwn); ok {
+			device = &found
+		}
+	}
+	// the steps of the stage record are not those of an unstage, nothing is recorded
+	return d.runUnstage(ctx, nil, op.VolumeId, stagingPath, device)
+}
+
+// replayDeviceRemoval completes the removal of a stale device. The SCSI devices that are gone or
+// now belong to another volume are skipped, and the removal is abandoned if the device is in use again.
+func (d *nodeService) replayDeviceRemoval(ctx context.Context, op *journal.Operation) (journal.RecoveryAction, error) {
+	device, ok := d.remainingDevice(op, op.VolumeId)
+	if ok {
+		if err := d.verifyStaleDevice(ctx, device, ""); err != nil {
+			// what was removed cannot be restored, the rest is left to the garbage collector
+			logging.Warningf("Abandoning the removal of %s: %v", device, err)
+			return journal.ActionRolledBack, nil
+		}
+	}
+	if err := d.runDeviceRemoval(ctx, op, device); err != nil {
+		return journal.ActionFailed, err
+	}
+	return journal.ActionReplayed, nil
+}
+
+// remainingDevice returns what is left of the device recorded in the parameters of a device removal:
+// the multipath map unless it was flushed, and the SCSI devices that were not deleted and still
+// have the wwid. It tells if anything is left.
+func (d *nodeService) remainingDevice(op *journal.Operation, wwid string) (ibmDevice, bool) {
+	device := ibmDevice{Name: op.Params[operationParamDevice], Wwid: wwid}
+	if !op.StepDone(stepFlushMultipath) {
+		device.MultipathMap = op.Params[operationParamMultipathMap]
+	}
+	for _, scsiDevice := range strings.Split(op.Params[operationParamScsiDevices], ",") {
+		if scsiDevice == "" || op.StepDone(deviceStep(stepDeleteDevice, scsiDevice)) {
+			continue
+		}
+		// a deleted SCSI device name can be reused by the next device the host discovers
+		if normalizeWwid(d.readSysBlockAttr(scsiDevice, "device/wwid")) != normalizeWwid(device.Wwid) {
+			continue
+		}
+		device.ScsiDevices = append(device.ScsiDevices, scsiDevice)
+	}
+
+	if device.MultipathMap == "" && len(device.ScsiDevices) > 0 {
+		// the name of a flushed multipath map can belong to another device by now
+		device.Name = device.ScsiDevices[0]
+	}
+	return device, device.MultipathMap != "" || len(device.ScsiDevices) > 0
+}
+
+// replayOrphanDirCleanup completes the cleanup of an orphaned directory, unless it is mounted from
+// a device that exists again.
+func (d *nodeService) replayOrphanDirCleanup(ctx context.Context, op *journal.Operation) (journal.RecoveryAction, error) {
+	path := op.Params[operationParamPath]
+	if path == "" {
+		return journal.ActionFailed, fmt.Errorf("missing %s parameter", operationParamPath)
+	}
+	mounts, err := d.readMounts()
+	if err != nil {
+		return journal.ActionFailed, err
+	}
+	orphan := orphanDir{Path: path, VolumeId: op.VolumeId}
+	for _, mount := range mounts {
+		if mount.MountPoint != filepath.Clean(path) {
+			continue
+		}
+		if !d.isStaleMount(mount) {
+			logging.Warningf("Abandoning the cleanup of %s, it is mounted from %s", path, mount.Device)
+			return journal.ActionRolledBack, nil
+		}
+		orphan.StaleMount = mount.Device
+	}
+	if err := d.runOrphanDirRemoval(ctx, op, orphan); err != nil {
+		return journal.ActionFailed, err
+	}
+	return journal.ActionReplayed, nil
+}
+
+// isMountPoint tells if the path is a mount point in the host mount table.
+func (d *nodeService) isMountPoint(path string) (bool, error) {
+	mounts, err := d.readMounts()
+	if err != nil {
+		return false, err
+	}
+	for _, mount := range mounts {
+		if mount.MountPoint == filepath.Clean(path) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runStep runs a step of an operation and records it as done, unless the journal has it done
+// already, as for the steps an operation that is replayed after a restart did before it.
+func (d *nodeService) runStep(op *journal.Operation, step string, run func() error) error {
+	if op != nil && op.StepDone(step) {
+		return nil
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	return d.completeStep(op, step)
+}
+
+// deviceStep returns the name of a step done for each of several devices, e.g. delete-device:sdb.
+func deviceStep(step string, device string) string {
+	return step + ":" + device
+}
+
+// beginOperation records an operation in the journal. Without a journal it returns a nil operation,
+// which the other journal helpers accept.
+func (d *nodeService) beginOperation(opType string, volumeId string, steps []string, params map[string]string) (*journal.Operation, error) {
+	if d.journal == nil {
+		return nil, nil
+	}
+	return d.journal.Begin(opType, volumeId, steps, params)
+}
+
+func (d *nodeService) completeStep(op *journal.Operation, step string) error {
+	if op == nil {
+		return nil
+	}
+	return d.journal.CompleteStep(op, step)
+}
+
+func (d *nodeService) finishOperation(op *journal.Operation) {
+	if op == nil {
+		return
+	}
+	if err := d.journal.Finish(op); err != nil {
+		logging.Errorf("%v", err)
+	}
+}
@@ -0,0 +1,253 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+)
+
+func TestReconcile(t *testing.T) {
+	const volumeId = "SVC:6005076810830198A800000000000001"
+	stagingDir := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"
+	stageInfoFile := filepath.Join(DefaultStageInfoDir, stageInfoFileName(volumeId))
+	unstageSteps := []string{stepUnmount, stepFlushMultipath, "flush-buffers:sdb", "delete-device:sdb", "flush-buffers:sdc", "delete-device:sdc", stepRemoveStageInfo}
+	unstageParams := func(host *fakeHost) map[string]string {
+		return map[string]string{operationParamStagingPath: filepath.Join(host.root, stagingDir),
+			operationParamDevice: "dm-0", operationParamMultipathMap: "mpatha", operationParamScsiDevices: "sdb,sdc"}
+	}
+
+	testCases := []struct {
+		name       string
+		opType     string
+		volumeId   string
+		steps      []string
+		doneSteps  []string
+		params     func(host *fakeHost) map[string]string
+		setup      func(host *fakeHost)
+		mountInfo  func(host *fakeHost) string
+		script     []executor.FakeCommand
+		expDeleted []string
+		expRemoved []string
+		expKept    []string
+		expAction  journal.RecoveryAction
+	}{
+		{
+			name:      "stage is rolled back",
+			opType:    operationStage,
+			volumeId:  volumeId,
+			steps:     stageSteps,
+			doneSteps: []string{stepRescan, stepWaitMultipath},
+			params: func(host *fakeHost) map[string]string {
+				return map[string]string{operationParamStagingPath: filepath.Join(host.root, stagingDir)}
+			},
+			script: []executor.FakeCommand{
+				{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+				{Name: "multipath", Args: []string{"-f", "mpatha"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdb", "sdc"},
+			expRemoved: []string{stageInfoFile},
+			expAction:  journal.ActionRolledBack,
+		},
+		{
+			name:     "unstage is replayed and keeps a device that is still mounted",
+			opType:   operationUnstage,
+			volumeId: volumeId,
+			steps:    unstageSteps,
+			params:   unstageParams,
+			mountInfo: func(host *fakeHost) string {
+				return "40 22 253:0 / " + filepath.Join(host.root, stagingDir) + " rw shared:2 - ext4 /dev/mapper/mpatha rw\n"
+			},
+			script: []executor.FakeCommand{
+				{Name: "umount", Args: []string{"STAGING"}},
+			},
+			expRemoved: []string{stageInfoFile},
+			expAction:  journal.ActionReplayed,
+		},
+		{
+			name:      "unstage is replayed from the first step not done",
+			opType:    operationUnstage,
+			volumeId:  volumeId,
+			steps:     unstageSteps,
+			doneSteps: []string{stepUnmount},
+			params:    unstageParams,
+			script: []executor.FakeCommand{
+				{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+				{Name: "multipath", Args: []string{"-f", "mpatha"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdb", "sdc"},
+			expRemoved: []string{stageInfoFile},
+			expAction:  journal.ActionReplayed,
+		},
+		{
+			name:      "device removal is replayed from the first step not done",
+			opType:    operationRemoveStaleDevice,
+			volumeId:  "36005076810830198a800000000000001",
+			steps:     []string{stepFlushMultipath, "flush-buffers:sdb", "delete-device:sdb", "flush-buffers:sdc", "delete-device:sdc"},
+			doneSteps: []string{stepFlushMultipath, "flush-buffers:sdb", "delete-device:sdb"},
+			params: func(host *fakeHost) map[string]string {
+				return map[string]string{operationParamDevice: "dm-0", operationParamMultipathMap: "mpatha", operationParamScsiDevices: "sdb,sdc"}
+			},
+			// the multipath map was flushed and sdb deleted before the restart
+			setup: func(host *fakeHost) {
+				for _, path := range []string{"/sys/block/dm-0", "/sys/block/sdb", "/sys/block/sdc/holders/dm-0"} {
+					os.RemoveAll(filepath.Join(host.root, path))
+				}
+			},
+			script: []executor.FakeCommand{
+				{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+			},
+			expDeleted: []string{"sdc"},
+			expAction:  journal.ActionReplayed,
+		},
+		{
+			name:      "orphan cleanup is replayed",
+			opType:    operationCleanupOrphanDir,
+			volumeId:  volumeId,
+			steps:     []string{stepUnmount, stepRemoveDir, stepRemoveStageInfo},
+			doneSteps: []string{stepUnmount},
+			params: func(host *fakeHost) map[string]string {
+				return map[string]string{operationParamPath: filepath.Join(host.root, stagingDir)}
+			},
+			expRemoved: []string{stagingDir, stageInfoFile},
+			expAction:  journal.ActionReplayed,
+		},
+		{
+			name:     "orphan cleanup of a directory mounted again is abandoned",
+			opType:   operationCleanupOrphanDir,
+			volumeId: volumeId,
+			steps:    []string{stepUnmount, stepRemoveDir, stepRemoveStageInfo},
+			params: func(host *fakeHost) map[string]string {
+				return map[string]string{operationParamPath: filepath.Join(host.root, stagingDir)}
+			},
+			mountInfo: func(host *fakeHost) string {
+				return "40 22 253:0 / " + filepath.Join(host.root, stagingDir) + " rw shared:2 - ext4 /dev/dm-0 rw\n"
+			},
+			expKept:   []string{stagingDir, stageInfoFile},
+			expAction: journal.ActionRolledBack,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			defer host.cleanup()
+			host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+			host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000001")
+			host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb", "sdc")
+			host.writeFile("/sys/block/dm-0/dev", "253:0\n")
+			host.mkdir(sysDevBlockPath + "/253:0")
+			host.mkdir(stagingDir)
+			host.writeFile(stageInfoFile, `{"version": 1, "volumeId": "`+volumeId+`"}`)
+			if tc.setup != nil {
+				tc.setup(host)
+			}
+			mountInfo := ""
+			if tc.mountInfo != nil {
+				mountInfo = tc.mountInfo(host)
+			}
+			host.writeFile("/proc/1/mountinfo", mountInfo)
+
+			journalDir, err := ioutil.TempDir("", "journal-")
+			if err != nil {
+				t.Fatalf("Cannot create temporary dir : %v", err)
+			}
+			defer os.RemoveAll(journalDir)
+			j, err := journal.NewJournal(journalDir)
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			op, err := j.Begin(tc.opType, tc.volumeId, tc.steps, tc.params(host))
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			for _, step := range tc.doneSteps {
+				if err := j.CompleteStep(op, step); err != nil {
+					t.Fatalf("err is not nil. got: %v", err)
+				}
+			}
+
+			// Simulate a restart, the operation is not in progress in the new process
+			j, err = journal.NewJournal(journalDir)
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+
+			var script []executor.FakeCommand
+			for _, cmd := range tc.script {
+				if len(cmd.Args) == 1 && cmd.Args[0] == "STAGING" {
+					cmd.Args = []string{filepath.Join(host.root, stagingDir)}
+				}
+				script = append(script, cmd)
+			}
+			fakeExec := executor.NewFakeExecutor(script...)
+			d := newTestNodeServiceWithHost(host, fakeExec)
+			d.journal = j
+
+			report, err := j.Reconcile(context.TODO(), map[string]journal.RecoveryFunc{
+				operationStage:             d.rollBackStage,
+				operationUnstage:           d.replayUnstage,
+				operationRemoveStaleDevice: d.replayDeviceRemoval,
+				operationCleanupOrphanDir:  d.replayOrphanDirCleanup,
+			})
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if len(report) != 1 || report[0].Action != tc.expAction || report[0].Err != nil {
+				t.Fatalf("Expected the operation to be %s, got %s", tc.expAction, report)
+			}
+			if err := fakeExec.Verify(); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if pending, err := j.Pending(); err != nil || len(pending) != 0 {
+				t.Fatalf("Expected no pending operations, got %v, err %v", pending, err)
+			}
+
+			var deleted []string
+			for _, disk := range []string{"sdb", "sdc"} {
+				content, err := ioutil.ReadFile(filepath.Join(host.root, "sys/block", disk, "device/delete"))
+				if err == nil && string(content) == "1" {
+					deleted = append(deleted, disk)
+				}
+			}
+			if !reflect.DeepEqual(deleted, tc.expDeleted) {
+				t.Fatalf("deleted devices mismatch: expected %v, got %v", tc.expDeleted, deleted)
+			}
+			for _, path := range tc.expRemoved {
+				if _, err := os.Stat(filepath.Join(host.root, path)); !os.IsNotExist(err) {
+					t.Fatalf("Expected %s to be removed, got %v", path, err)
+				}
+			}
+			for _, path := range tc.expKept {
+				if _, err := os.Stat(filepath.Join(host.root, path)); err != nil {
+					t.Fatalf("Expected %s to be kept, got %v", path, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+const (
+	DefaultConfigWatchInterval = 10 * time.Second
+)
+
+// ReloadConfig loads the config again and applies it at once to the running node service. Changes
+// of settings that are used only at startup are rejected with a warning and the current values are
+// kept, the endpoint and the other command line settings never change. An invalid config is
+// rejected as a whole.
+func (d *Driver) ReloadConfig() error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	newConfig, err := LoadConfig(d.configSources)
+	if err != nil {
+		logging.Errorf("Config reload failed, keeping the current config: %v", err)
+		d.metrics.ObserveConfigReload(err)
+		return err
+	}
+	current := d.currentConfig()
+	for _, setting := range keepNonReloadable(current, &newConfig) {
+		logging.Warningf("Ignoring the change of %s in the reloaded config, it requires a restart of the node plugin", setting)
+	}
+	if reflect.DeepEqual(current, newConfig) {
+		logging.V(4).Infof("Config reloaded without changes")
+		d.metrics.ObserveConfigReload(nil)
+		return nil
+	}
+
+	if err := applyLogVerbosity(newConfig, d.flagLogVerbosity); err != nil {
+		logging.Errorf("Config reload failed, keeping the current config: %v", err)
+		d.metrics.ObserveConfigReload(err)
+		return err
+	}
+	if setter, ok := d.executor.(executor.TimeoutSetter); ok {
+		setter.SetTimeouts(newConfig.Node.Command_timeouts)
+	}
+	d.setConfig(newConfig)
+	logging.Infof("Config reloaded, effective config:\n%s", redactedConfig(newConfig))
+	d.metrics.ObserveConfigReload(nil)
+	return nil
+}
+
+// keepNonReloadable restores the settings of the current config that are used only at startup or
+// when the node registers in the new config, and returns the paths of the ones that changed.
+func keepNonReloadable(current ConfigFile, newConfig *ConfigFile) []string {
+	var changed []string
+	keep := func(path string, currentValue interface{}, newValue interface{}) {
+		value := reflect.ValueOf(newValue).Elem()
+		if !reflect.DeepEqual(value.Interface(), currentValue) {
+			changed = append(changed, path)
+			value.Set(reflect.ValueOf(currentValue))
+		}
+	}
+	keep("identity.name", current.Identity.Name, &newConfig.Identity.Name)
+	keep("identity.version", current.Identity.Version, &newConfig.Identity.Version)
+	keep("identity.volume_expansion", current.Identity.Volume_expansion, &newConfig.Identity.Volume_expansion)
+	keep("node.capabilities", current.Node.Capabilities, &newConfig.Node.Capabilities)
+	keep("node.plugin_capabilities", current.Node.Plugin_capabilities, &newConfig.Node.Plugin_capabilities)
+	// the node ID, topology and volume limit are registered with the container orchestrator once
+	keep("node.host_name", current.Node.Host_name, &newConfig.Node.Host_name)
+	keep("node.topology", current.Node.Topology, &newConfig.Node.Topology)
+	keep("node.array_type", current.Node.Array_type, &newConfig.Node.Array_type)
+	keep("node.max_volumes", current.Node.Max_volumes, &newConfig.Node.Max_volumes)
+	keep("node.host_root", current.Node.Host_root, &newConfig.Node.Host_root)
+	keep("node.journal_dir", current.Node.Journal_dir, &newConfig.Node.Journal_dir)
+	keep("node.stage_info_dir", current.Node.Stage_info_dir, &newConfig.Node.Stage_info_dir)
+	keep("node.kubelet_dir", current.Node.Kubelet_dir, &newConfig.Node.Kubelet_dir)
+	return changed
+}
+
+// applyLogVerbosity sets the level of the V logs of the config, or the flag level if the config sets
+// none, so that removing node.log_verbosity on reload restores the level of the -v flag.
+func applyLogVerbosity(config ConfigFile, flagLevel int) error {
+	if config.Node.Log_verbosity == nil {
+		return logging.SetVerbosity(flagLevel)
+	}
+	return logging.SetVerbosity(*config.Node.Log_verbosity)
+}
+
+// runConfigWatcher reloads the config whenever one of its files changes, until stopCh is closed.
+// The files are polled, which also sees the symlink swaps of mounted ConfigMaps.
+func (d *Driver) runConfigWatcher(stopCh <-chan struct{}) {
+	if d.configWatchInterval <= 0 {
+		logging.V(4).Infof("Config file watch is disabled")
+		return
+	}
+	files := d.configFiles
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(d.configWatchInterval):
+		}
+		newFiles := configFileStates(d.configSources)
+		if reflect.DeepEqual(files, newFiles) {
+			continue
+		}
+		files = newFiles
+		logging.Infof("Config files changed, reloading the config")
+		d.ReloadConfig()
+	}
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// configFileStates returns the state of the config file and of the drop-in files.
+func configFileStates(sources ConfigSources) map[string]fileState {
+	configYamlPath, dropInDir := sources.paths()
+	dropIns, _ := filepath.Glob(filepath.Join(dropInDir, "*.yaml"))
+
+	states := map[string]fileState{}
+	for _, file := range append([]string{configYamlPath}, dropIns...) {
+		if info, err := os.Stat(file); err == nil {
+			states[file] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
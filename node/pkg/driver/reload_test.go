@@ -0,0 +1,194 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	"k8s.io/klog"
+)
+
+// newTestReloadDriver returns a driver that loads its config from a config file in dir.
+func newTestReloadDriver(t *testing.T, dir string, config string) *Driver {
+	sources := ConfigSources{File: filepath.Join(dir, "config.yaml")}
+	writeTestFile(t, sources.File, []byte(config), time.Now().Add(-time.Minute))
+	configFiles := configFileStates(sources)
+	configFile, err := LoadConfig(sources)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	d := &Driver{nodeService: newTestNodeService(nil), configSources: sources, configFiles: configFiles, stopCh: make(chan struct{})}
+	d.configYaml = configFile
+	d.metrics = metrics.NewMetrics()
+	return d
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := newTestReloadDriver(t, dir, validTestConfig)
+
+	writeTestFile(t, d.configSources.File, []byte(`
+identity:
+   name: other-driver
+   version: 1.0.0
+controller:
+   publish_context_lun_parameter: "LUN"
+   publish_context_connectivity_parameter: "CONNECTIVITY"
+node:
+   journal_dir: /var/lib/other
+   stale_device_gc:
+      mode: report
+`), time.Now())
+	if err := d.ReloadConfig(); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	config := d.currentConfig()
+	if config.Node.Stale_device_gc.Mode != GCModeReport || config.Controller.Publish_context_lun_parameter != "LUN" {
+		t.Fatalf("Expected the reloadable settings to change, got %+v", config)
+	}
+	if config.Identity.Name != "ibm-block-csi-driver" || config.Node.Journal_dir != DefaultJournalDir {
+		t.Fatalf("Expected the driver name and journal dir to be kept, got %q and %q", config.Identity.Name, config.Node.Journal_dir)
+	}
+
+	writeTestFile(t, d.configSources.File, []byte(validTestConfig+"node:\n   stale_device_gc:\n      mode: delete\n"), time.Now())
+	if err := d.ReloadConfig(); err == nil {
+		t.Fatalf("Expected an invalid config to fail the reload")
+	}
+	if mode := d.currentConfig().Node.Stale_device_gc.Mode; mode != GCModeReport {
+		t.Fatalf("Expected a failed reload to keep the current config, got mode %q", mode)
+	}
+}
+
+// timeoutRecorder is a fake executor that records the command timeouts it is given.
+type timeoutRecorder struct {
+	executor.Executor
+	timeouts map[string]time.Duration
+}
+
+func (r *timeoutRecorder) SetTimeouts(timeouts map[string]time.Duration) {
+	r.timeouts = timeouts
+}
+
+func TestReloadCommandTimeoutsWithMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := newTestReloadDriver(t, dir, validTestConfig)
+	recorder := &timeoutRecorder{Executor: executor.NewFakeExecutor()}
+	// the executor NewDriver builds when --metrics-port is set
+	d.executor = &instrumentedExecutor{Executor: recorder, metrics: d.metrics}
+
+	writeTestFile(t, d.configSources.File, []byte(validTestConfig+"node:\n   command_timeouts:\n      mkfs: 20m\n"), time.Now())
+	if err := d.ReloadConfig(); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if recorder.timeouts["mkfs"] != 20*time.Minute {
+		t.Fatalf("Expected the mkfs timeout to be reloaded, got %v", recorder.timeouts)
+	}
+}
+
+func TestKeepNonReloadable(t *testing.T) {
+	current := defaultConfig()
+	current.Identity.Name = "ibm-block-csi-driver"
+	newConfig := current
+	newConfig.Node.Host_root = "/host"
+	newConfig.Node.Kubelet_dir = "/var/lib/k8s"
+	newConfig.Node.Host_name.Template = "{{ .ShortName }}"
+	newConfig.Node.Topology.Segments = map[string]string{"site": "dal10"}
+	newConfig.Node.Max_volumes.Source = MaxVolumesSourceStatic
+	newConfig.Node.Plugin_capabilities = []string{"VOLUME_ACCESSIBILITY_CONSTRAINTS"}
+	newConfig.Node.Orphan_dir_cleanup.Policy = CleanupPolicyReport
+
+	changed := keepNonReloadable(current, &newConfig)
+	expChanged := []string{"node.plugin_capabilities", "node.host_name", "node.topology", "node.max_volumes", "node.host_root", "node.kubelet_dir"}
+	if !reflect.DeepEqual(changed, expChanged) {
+		t.Fatalf("Expected %v to be rejected, got %v", expChanged, changed)
+	}
+	expConfig := current
+	expConfig.Node.Orphan_dir_cleanup.Policy = CleanupPolicyReport
+	if !reflect.DeepEqual(newConfig, expConfig) {
+		t.Fatalf("Expected only the orphan dir cleanup policy to change, got %+v", newConfig.Node)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := newTestReloadDriver(t, dir, validTestConfig)
+	d.configWatchInterval = 10 * time.Millisecond
+	go d.runConfigWatcher(d.stopCh)
+	defer close(d.stopCh)
+
+	dropInDir := filepath.Join(dir, DefaultConfigDropInDir)
+	if err := os.Mkdir(dropInDir, 0755); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dropInDir, "node.yaml"), []byte("node:\n   orphan_dir_cleanup:\n      policy: report\n"), time.Now())
+
+	deadline := time.Now().Add(10 * time.Second)
+	for d.currentConfig().Node.Orphan_dir_cleanup.Policy != CleanupPolicyReport {
+		if time.Now().After(deadline) {
+			t.Fatalf("The new drop-in file was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadLogVerbosity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer logging.SetVerbosity(0)
+	d := newTestReloadDriver(t, dir, validTestConfig)
+	d.flagLogVerbosity = 2
+
+	writeTestFile(t, d.configSources.File, []byte(validTestConfig+"node:\n   log_verbosity: 5\n"), time.Now())
+	if err := d.ReloadConfig(); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if !klog.V(5) {
+		t.Fatalf("Expected the V logs of level 5 to be enabled")
+	}
+
+	// without node.log_verbosity the level of the -v flag is restored
+	writeTestFile(t, d.configSources.File, []byte(validTestConfig), time.Now().Add(time.Second))
+	if err := d.ReloadConfig(); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if klog.V(3) || !klog.V(2) {
+		t.Fatalf("Expected the V logs of the -v level 2 only")
+	}
+}
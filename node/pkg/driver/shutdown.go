@@ -0,0 +1,102 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultShutdownGracePeriod = 30 * time.Second
+)
+
+// mutatingMethods are the RPCs that change the node state, they are refused once the shutdown started
+// so no new host operation begins while the in-flight ones drain.
+var mutatingMethods = map[string]bool{
+	"NodeStageVolume":     true,
+	"NodeUnstageVolume":   true,
+	"NodePublishVolume":   true,
+	"NodeUnpublishVolume": true,
+	"NodeExpandVolume":    true,
+}
+
+// shutdownInterceptor refuses the mutating RPCs during the shutdown with Unavailable, so the
+// container orchestrator retries them on the next node plugin instance.
+func (d *Driver) shutdownInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	if d.isShuttingDown() && mutatingMethods[method] {
+		return nil, status.Errorf(codes.Unavailable, "%s refused, the node plugin is shutting down", method)
+	}
+	return handler(ctx, req)
+}
+
+// Shutdown stops the driver: it refuses new mutating RPCs, waits up to the grace period for the
+// in-flight RPCs to finish, then stops the server forcibly and removes the unix socket. Only the
+// first call has an effect.
+func (d *Driver) Shutdown(gracePeriod time.Duration) {
+	if !atomic.CompareAndSwapInt32(&d.shuttingDown, 0, 1) {
+		return
+	}
+	logging.Infof("Shutting down with a grace period of %v", gracePeriod)
+	close(d.stopCh)
+
+	d.mu.Lock()
+	srv, socketPath := d.srv, d.socketPath
+	d.mu.Unlock()
+	if srv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			logging.Infof("All in-flight RPCs finished")
+		case <-time.After(gracePeriod):
+			logging.Warningf("In-flight RPCs did not finish in %v, stopping the server", gracePeriod)
+			srv.Stop()
+			<-stopped
+		}
+	}
+
+	d.stopHTTPServers()
+	if d.tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+		if err := d.tracer.Shutdown(ctx); err != nil {
+			logging.Warningf("Failed to export the remaining spans: %v", err)
+		}
+	}
+	if socketPath != "" {
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			logging.Warningf("Failed to remove socket %s: %v", socketPath, err)
+		}
+	}
+}
+
+func (d *Driver) isShuttingDown() bool {
+	return atomic.LoadInt32(&d.shuttingDown) == 1
+}
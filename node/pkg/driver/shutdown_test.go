@@ -0,0 +1,90 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestShutdownInterceptor(t *testing.T) {
+	d := &Driver{stopCh: make(chan struct{})}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "resp", nil }
+	call := func(method string) error {
+		_, err := d.shutdownInterceptor(context.TODO(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/" + method}, handler)
+		return err
+	}
+
+	if err := call("NodeStageVolume"); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	d.Shutdown(0)
+	if err := call("NodeStageVolume"); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable during the shutdown, got %v", err)
+	}
+	if err := call("NodeGetInfo"); err != nil {
+		t.Fatalf("Expected read only RPCs during the shutdown, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "csi.sock")
+
+	d := &Driver{nodeService: newTestNodeService(nil), endpoint: "unix://" + socket, stopCh: make(chan struct{})}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- d.Run()
+	}()
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(10*time.Second))
+	if err != nil {
+		t.Fatalf("Cannot connect to %s: %v", socket, err)
+	}
+	defer conn.Close()
+	if _, err := csi.NewNodeClient(conn).NodeGetCapabilities(context.TODO(), &csi.NodeGetCapabilitiesRequest{}); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	d.Shutdown(time.Second)
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after the shutdown, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run did not return after the shutdown")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket %s to be removed, got %v", socket, err)
+	}
+	// a second shutdown is a no-op
+	d.Shutdown(time.Second)
+}
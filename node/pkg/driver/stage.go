@@ -0,0 +1,255 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	metrics "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/metrics"
+	tracing "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/tracing"
+)
+
+const (
+	defaultFsType = "ext4"
+	scsiHostPath  = "/sys/class/scsi_host"
+	// blkid exits with 2 when the device has no file system signature
+	blkidNoMatchExitCode = 2
+)
+
+var (
+	supportedFsTypes = []string{"ext3", "ext4", "xfs"}
+
+	// How long NodeStageVolume waits for the SCSI devices of the volume after a rescan, and then for
+	// multipathd to create their multipath map, and how often it looks for them
+	deviceWaitTimeout  = 30 * time.Second
+	devicePollInterval = time.Second
+)
+
+// stageVolume discovers the device of the volume, creates its file system unless it has one, mounts
+// it at the staging path and persists its stage info. The steps are recorded in the journal, a stage
+// interrupted by a restart is rolled back by reconcile.
+func (d *nodeService) stageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) error {
+	info, err := d.newStageInfo(req)
+	if err != nil {
+		return err
+	}
+	info.Wwn = volumeWwn(info.VolumeId)
+	if info.FsType == "" {
+		info.FsType = defaultFsType
+	}
+	setSpanAttributes(ctx, info)
+
+	op, err := d.beginOperation(operationStage, info.VolumeId, stageSteps, map[string]string{operationParamStagingPath: info.StagingPath})
+	if err != nil {
+		return err
+	}
+	// A failed stage is not left pending in the journal, kubelet retries NodeStageVolume, which checks
+	// every step on the host again. Only a stage interrupted by a restart is rolled back.
+	defer d.finishOperation(op)
+
+	if err := d.runStep(op, stepRescan, func() error {
+		start := time.Now()
+		err := d.rescanVolume(ctx, info)
+		d.metrics.ObserveHostOperation(metrics.HostOpRescanWait, start, err)
+		return err
+	}); err != nil {
+		return err
+	}
+	var device ibmDevice
+	if err := d.runStep(op, stepWaitMultipath, func() error {
+		start := time.Now()
+		var waitErr error
+		device, waitErr = d.waitForVolumeDevice(ctx, info.Wwn, "multipath map", func(device ibmDevice) bool { return device.MultipathMap != "" })
+		d.metrics.ObserveHostOperation(metrics.HostOpMultipathWait, start, waitErr)
+		return waitErr
+	}); err != nil {
+		return err
+	}
+	info.DevicePath = "/dev/" + device.Name
+	info.MultipathMap = device.MultipathMap
+	setSpanAttributes(ctx, info)
+
+	if err := d.runStep(op, stepMkfs, func() error { return d.ensureFileSystem(ctx, info.DevicePath, info.FsType) }); err != nil {
+		return err
+	}
+	if err := d.runStep(op, stepMount, func() error { return d.mountStagingPath(ctx, info) }); err != nil {
+		return err
+	}
+	if err := d.runStep(op, stepWriteStageInfo, func() error { return d.writeStageInfo(info) }); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Infof("Volume %s is staged at %s from %s", info.VolumeId, info.StagingPath, info.DevicePath)
+	return nil
+}
+
+// rescanVolume scans the SCSI hosts of the connectivity of the volume for its LUN and waits for a
+// SCSI device of the volume. The iSCSI sessions to the storage array must be logged in already.
+func (d *nodeService) rescanVolume(ctx context.Context, info *StageInfo) error {
+	switch info.Connectivity {
+	case ConnectivityIscsi:
+		if _, err := d.executor.Execute(ctx, "iscsiadm", "-m", "session", "--rescan"); err != nil {
+			return err
+		}
+	case ConnectivityFc:
+		hosts, err := ioutil.ReadDir(d.hostRoot.Path(fcHostPath))
+		if err != nil {
+			return fmt.Errorf("failed to list the FC hosts: %v", err)
+		}
+		for _, host := range hosts {
+			scanPath := filepath.Join(d.hostRoot.Path(scsiHostPath), host.Name(), "scan")
+			if err := ioutil.WriteFile(scanPath, []byte(fmt.Sprintf("- - %d", info.Lun)), 0200); err != nil {
+				return fmt.Errorf("failed to scan FC host %s: %v", host.Name(), err)
+			}
+		}
+	}
+	_, err := d.waitForVolumeDevice(ctx, info.Wwn, "SCSI device", func(ibmDevice) bool { return true })
+	return err
+}
+
+// waitForVolumeDevice polls for the device of the volume with the WWN until ready accepts it.
+func (d *nodeService) waitForVolumeDevice(ctx context.Context, wwn string, what string, ready func(ibmDevice) bool) (ibmDevice, error) {
+	deadline := time.Now().Add(deviceWaitTimeout)
+	for {
+		if device, ok := d.findVolumeDevice(wwn); ok && ready(device) {
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return ibmDevice{}, &TimeoutError{Operation: fmt.Sprintf("the %s of volume %s", what, wwn), Timeout: deviceWaitTimeout}
+		}
+		select {
+		case <-ctx.Done():
+			return ibmDevice{}, ctx.Err()
+		case <-time.After(devicePollInterval):
+		}
+	}
+}
+
+// ensureFileSystem creates a file system of the type on the device unless it has one. A device with
+// a file system of another type is never formatted.
+func (d *nodeService) ensureFileSystem(ctx context.Context, devicePath string, fsType string) error {
+	out, err := d.executor.Execute(ctx, "blkid", "-p", "-s", "TYPE", "-o", "value", devicePath)
+	if cmdErr, ok := err.(*executor.CommandError); ok && cmdErr.ExitCode == blkidNoMatchExitCode {
+		args := []string{devicePath}
+		if strings.HasPrefix(fsType, "ext") {
+			args = []string{"-F", devicePath}
+		}
+		_, err := d.executor.Execute(ctx, "mkfs."+fsType, args...)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing := strings.TrimSpace(string(out)); existing != fsType {
+		return &PreconditionError{fmt.Sprintf("%s has a %s file system instead of %s", devicePath, existing, fsType)}
+	}
+	return nil
+}
+
+// mountStagingPath mounts the device of the stage info at its staging path. persistStagedVolume
+// already accepted a staging path mounted from the device, any other mount there is refused.
+func (d *nodeService) mountStagingPath(ctx context.Context, info *StageInfo) error {
+	mounted, err := d.isMountPoint(info.StagingPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return &PreconditionError{fmt.Sprintf("%s is mounted from another device", info.StagingPath)}
+	}
+	if err := os.MkdirAll(info.StagingPath, 0750); err != nil {
+		return err
+	}
+	args := []string{"-t", info.FsType}
+	if len(info.MountOptions) > 0 {
+		args = append(args, "-o", strings.Join(info.MountOptions, ","))
+	}
+	_, err = d.executor.Execute(ctx, "mount", append(args, info.DevicePath, info.StagingPath)...)
+	return err
+}
+
+// unstageVolume unmounts the staging path, removes the device of the volume unless something else
+// uses it and removes the stage info. The steps are recorded in the journal, an unstage interrupted
+// by a restart is completed by reconcile.
+func (d *nodeService) unstageVolume(ctx context.Context, volumeId string, stagingPath string) error {
+	stagingPath = filepath.Clean(stagingPath)
+	steps := []string{stepUnmount}
+	params := map[string]string{operationParamStagingPath: stagingPath}
+	var device *ibmDevice
+	if wwn := volumeWwn(volumeId); wwn != "" {
+		span := tracing.SpanFromContext(ctx)
+		span.SetAttribute(tracing.AttrWwn, wwn)
+		if found, ok := d.findVolumeDevice(wwn); ok {
+			span.SetAttribute(tracing.AttrDevice, "/dev/"+found.Name)
+			device = &found
+			steps = append(steps, deviceRemovalSteps(found)...)
+			params[operationParamDevice] = found.Name
+			params[operationParamMultipathMap] = found.MultipathMap
+			params[operationParamScsiDevices] = strings.Join(found.ScsiDevices, ",")
+		}
+	}
+	steps = append(steps, stepRemoveStageInfo)
+
+	op, err := d.beginOperation(operationUnstage, volumeId, steps, params)
+	if err != nil {
+		return err
+	}
+	// as for a stage, kubelet retries a failed unstage
+	defer d.finishOperation(op)
+	return d.runUnstage(ctx, op, volumeId, stagingPath, device)
+}
+
+// runUnstage runs the steps of an unstage that are not done in the journal yet. The device is
+// checked to be unused, by anything but the stage info of the volume itself, right before its removal.
+func (d *nodeService) runUnstage(ctx context.Context, op *journal.Operation, volumeId string, stagingPath string, device *ibmDevice) error {
+	if err := d.runStep(op, stepUnmount, func() error {
+		mounted, err := d.isMountPoint(stagingPath)
+		if err != nil || !mounted {
+			return err
+		}
+		_, err = d.executor.Execute(ctx, "umount", stagingPath)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if device != nil {
+		if err := d.verifyStaleDevice(ctx, *device, volumeId); err != nil {
+			logging.FromContext(ctx).Warningf("Leaving %s of volume %s in place: %v", device, volumeId, err)
+		} else if err := d.runDeviceRemoval(ctx, op, *device); err != nil {
+			return err
+		}
+	}
+	return d.runStep(op, stepRemoveStageInfo, func() error { return d.removeStageInfo(volumeId, stagingPath) })
+}
+
+func isSupportedFsType(fsType string) bool {
+	for _, supported := range supportedFsTypes {
+		if fsType == supported {
+			return true
+		}
+	}
+	return false
+}
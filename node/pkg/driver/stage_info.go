@@ -0,0 +1,321 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	tracing "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/tracing"
+	util "github.com/ibm/ibm-block-csi-driver/node/util"
+)
+
+const (
+	stageInfoVersion    = 1
+	stageInfoFileSuffix = ".json"
+
+	DefaultKubeletDir = "/var/lib/kubelet"
+	// Kubelet creates the staging path of a volume at <kubelet dir>/plugins/kubernetes.io/csi/pv/<pv name>/globalmount
+	kubeletCsiStagingDir = "plugins/kubernetes.io/csi/pv"
+
+	// The controller creates volume IDs as <array type>:<volume WWN>
+	volumeIdDelimiter = ":"
+)
+
+// StageInfo is what NodeStageVolume did on the host for a volume. It is persisted in the stage info
+// directory of the driver, keyed by volume ID, so unstage, expand and stats keep working after the
+// node plugin restarts. Kubelet's staging directory is left to kubelet.
+type StageInfo struct {
+	Version      int      `json:"version"`
+	VolumeId     string   `json:"volumeId"`
+	StagingPath  string   `json:"stagingPath"`
+	DevicePath   string   `json:"devicePath"`
+	MultipathMap string   `json:"multipathMap"`
+	Wwn          string   `json:"wwn"`
+	Lun          int      `json:"lun"`
+	Connectivity string   `json:"connectivity"`
+	FsType       string   `json:"fsType"`
+	MountOptions []string `json:"mountOptions"`
+}
+
+// newStageInfo returns the stage info of the request, the device details are filled by the caller
+// once the device is discovered.
+func (d *nodeService) newStageInfo(req *csi.NodeStageVolumeRequest) (*StageInfo, error) {
+	publishContext, err := parsePublishContext(req.GetPublishContext(), d.currentConfig())
+	if err != nil {
+		return nil, err
+	}
+	info := &StageInfo{
+		Version:      stageInfoVersion,
+		VolumeId:     req.GetVolumeId(),
+		StagingPath:  filepath.Clean(req.GetStagingTargetPath()),
+		Lun:          publishContext.Lun,
+		Connectivity: publishContext.Connectivity,
+	}
+
+	if mnt := req.GetVolumeCapability().GetMount(); mnt != nil {
+		info.FsType = mnt.GetFsType()
+		info.MountOptions = mnt.GetMountFlags()
+	}
+	return info, nil
+}
+
+// persistStagedVolume writes the stage info of the request if the staging path is mounted from the device of the volume, and tells if it is.
+func (d *nodeService) persistStagedVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (bool, error) {
+	device := d.discoverStageInfo(req.GetVolumeId())
+	if device == nil {
+		return false, nil
+	}
+	mounts, err := d.readMounts()
+	if err != nil {
+		return false, err
+	}
+	stagingPath := filepath.Clean(req.GetStagingTargetPath())
+	dev := d.readSysBlockAttr(filepath.Base(device.DevicePath), "dev")
+	staged := false
+	for _, mount := range mounts {
+		if mount.MountPoint == stagingPath && dev != "" && mount.MajorMinor == dev {
+			staged = true
+			break
+		}
+	}
+	if !staged {
+		return false, nil
+	}
+
+	info, err := d.newStageInfo(req)
+	if err != nil {
+		return false, err
+	}
+	info.DevicePath = device.DevicePath
+	info.MultipathMap = device.MultipathMap
+	info.Wwn = device.Wwn
+	if err := d.writeStageInfo(info); err != nil {
+		return false, err
+	}
+	logging.FromContext(ctx).Infof("Volume %s is already staged at %s from %s", info.VolumeId, stagingPath, info.DevicePath)
+	return true, nil
+}
+
+// stageInfoDir returns the directory of the stage info records on the host.
+func (d *nodeService) stageInfoDir() string {
+	dir := d.currentConfig().Node.Stage_info_dir
+	if dir == "" {
+		dir = DefaultStageInfoDir
+	}
+	return d.hostRoot.Path(dir)
+}
+
+// stageInfoFileName returns the name of the stage info record of a volume, the volume ID is escaped
+// since it is chosen by the controller.
+func stageInfoFileName(volumeId string) string {
+	return url.PathEscape(volumeId) + stageInfoFileSuffix
+}
+
+func (d *nodeService) stageInfoPath(volumeId string) string {
+	return filepath.Join(d.stageInfoDir(), stageInfoFileName(volumeId))
+}
+
+// writeStageInfo atomically replaces the stage info of the volume.
+func (d *nodeService) writeStageInfo(info *StageInfo) error {
+	info.Version = stageInfoVersion
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(d.stageInfoDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create stage info directory: %v", err)
+	}
+	path := d.stageInfoPath(info.VolumeId)
+	if err := util.WriteFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write stage info file: %v", err)
+	}
+
+	logging.V(4).Infof("Stage info of volume %s written to %s", info.VolumeId, path)
+	return nil
+}
+
+// readStageInfo returns the stage info of the volume, or an error that satisfies os.IsNotExist if
+// the volume has no record.
+func (d *nodeService) readStageInfo(volumeId string) (*StageInfo, error) {
+	info, err := readStageInfoFile(d.stageInfoPath(volumeId))
+	if err != nil {
+		return nil, err
+	}
+	if info.VolumeId != volumeId {
+		return nil, fmt.Errorf("stage info file %s belongs to volume %s instead of %s", d.stageInfoPath(volumeId), info.VolumeId, volumeId)
+	}
+	return info, nil
+}
+
+func readStageInfoFile(path string) (*StageInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &StageInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("failed to parse stage info file %s: %v", path, err)
+	}
+	if info.Version < 1 || info.Version > stageInfoVersion {
+		return nil, fmt.Errorf("unsupported stage info version %d in %s", info.Version, path)
+	}
+	return info, nil
+}
+
+// removeStageInfo removes the stage info of the volume if it was staged at the staging path. The
+// record of a volume staged again at another path, as when its PV was recreated, is kept.
+func (d *nodeService) removeStageInfo(volumeId string, stagingPath string) error {
+	info, err := d.readStageInfo(volumeId)
+	if err == nil && info.StagingPath != "" && info.StagingPath != filepath.Clean(stagingPath) {
+		logging.V(4).Infof("Keeping stage info of volume %s, it is staged at %s", volumeId, info.StagingPath)
+		return nil
+	}
+	if err := os.Remove(d.stageInfoPath(volumeId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getStageInfo returns the stage info of the volume. Without a persisted record it falls back to
+// live discovery of the device, and returns nil when the volume has no device on the host.
+func (d *nodeService) getStageInfo(ctx context.Context, volumeId string) *StageInfo {
+	info, err := d.readStageInfo(volumeId)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logging.FromContext(ctx).V(4).Infof("No stage info for volume %s, falling back to live discovery", volumeId)
+		} else {
+			logging.FromContext(ctx).Warningf("Ignoring stage info of volume %s, falling back to live discovery: %v", volumeId, err)
+		}
+		info = d.discoverStageInfo(volumeId)
+		if info == nil {
+			logging.FromContext(ctx).V(4).Infof("Live discovery found no device of volume %s", volumeId)
+			return nil
+		}
+	}
+
+	setSpanAttributes(ctx, info)
+	return info
+}
+
+// setSpanAttributes sets the LUN, WWN, device and connectivity of the stage info that are known on
+// the current span. The spans of the host commands started afterwards inherit them.
+func setSpanAttributes(ctx context.Context, info *StageInfo) {
+	span := tracing.SpanFromContext(ctx)
+	attributes := map[string]string{
+		tracing.AttrLun:          strconv.Itoa(info.Lun),
+		tracing.AttrWwn:          info.Wwn,
+		tracing.AttrDevice:       info.DevicePath,
+		tracing.AttrConnectivity: info.Connectivity,
+	}
+	for key, value := range attributes {
+		if value != "" {
+			span.SetAttribute(key, value)
+		}
+	}
+}
+
+// discoverStageInfo finds the device of a volume on the host by the WWN in its volume ID, and
+// returns what the host tells about it. It returns nil when the volume has no device on the host.
+func (d *nodeService) discoverStageInfo(volumeId string) *StageInfo {
+	wwn := volumeWwn(volumeId)
+	if wwn == "" {
+		return nil
+	}
+	device, ok := d.findVolumeDevice(wwn)
+	if !ok {
+		return nil
+	}
+	info := &StageInfo{
+		Version:      stageInfoVersion,
+		VolumeId:     volumeId,
+		DevicePath:   "/dev/" + device.Name,
+		MultipathMap: device.MultipathMap,
+		Wwn:          wwn,
+	}
+	for _, scsiDevice := range device.ScsiDevices {
+		if lun, ok := d.scsiDeviceLun(scsiDevice); ok {
+			info.Lun = lun
+			break
+		}
+	}
+	if mounts, err := d.readMounts(); err == nil {
+		dev := d.readSysBlockAttr(device.Name, "dev")
+		for _, mount := range mounts {
+			if dev != "" && mount.MajorMinor == dev {
+				info.FsType = mount.FsType
+				break
+			}
+		}
+	}
+	return info
+}
+
+// volumeWwn returns the normalized WWN of a volume ID of the controller, or "" for a volume ID of
+// another format.
+func volumeWwn(volumeId string) string {
+	parts := strings.Split(volumeId, volumeIdDelimiter)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return ""
+	}
+	return normalizeWwid(parts[1])
+}
+
+func (d *nodeService) kubeletDir() string {
+	if kubeletDir := d.currentConfig().Node.Kubelet_dir; kubeletDir != "" {
+		return kubeletDir
+	}
+	return DefaultKubeletDir
+}
+
+// listStageInfos returns the persisted stage infos of all the volumes staged on this node.
+func (d *nodeService) listStageInfos() []*StageInfo {
+	files, err := ioutil.ReadDir(d.stageInfoDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Errorf("Failed to list stage info directory %s: %v", d.stageInfoDir(), err)
+		}
+		return nil
+	}
+
+	var infos []*StageInfo
+	for _, file := range files {
+		// Leftovers of an interrupted atomic write have a ".tmp-" suffix and are ignored
+		if file.IsDir() || !strings.HasSuffix(file.Name(), stageInfoFileSuffix) {
+			continue
+		}
+		path := filepath.Join(d.stageInfoDir(), file.Name())
+		info, err := readStageInfoFile(path)
+		if err != nil {
+			logging.Warningf("Ignoring stage info file %s: %v", path, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,289 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestStageInfoWriteReadRemove(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	d := newTestNodeServiceWithHost(host, nil)
+	const volumeId = "SVC:6005076810830198A800000000000A1C"
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"
+
+	if _, err := d.readStageInfo(volumeId); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error, got %v", err)
+	}
+
+	info := &StageInfo{
+		VolumeId:     volumeId,
+		StagingPath:  stagingPath,
+		DevicePath:   "/dev/dm-3",
+		MultipathMap: "mpathb",
+		Wwn:          "6005076810830198a800000000000a1c",
+		Lun:          3,
+		Connectivity: "iscsi",
+		FsType:       "ext4",
+		MountOptions: []string{"noatime"},
+	}
+	if err := d.writeStageInfo(info); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	readInfo, err := d.readStageInfo(volumeId)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expInfo := *info
+	expInfo.Version = stageInfoVersion
+	if !reflect.DeepEqual(*readInfo, expInfo) {
+		t.Fatalf("stage info mismatches: expected %+v, got %+v", expInfo, *readInfo)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(host.root, DefaultStageInfoDir))
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != "SVC:6005076810830198A800000000000A1C.json" {
+		t.Fatalf("Expected only the stage info file of the volume, got %v", files)
+	}
+	if infos := d.listStageInfos(); len(infos) != 1 || !reflect.DeepEqual(*infos[0], expInfo) {
+		t.Fatalf("Expected the stage info in the list, got %v", infos)
+	}
+
+	// the volume was staged again at another path
+	if err := d.removeStageInfo(volumeId, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-old/globalmount"); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if _, err := d.readStageInfo(volumeId); err != nil {
+		t.Fatalf("Expected the stage info of another staging path to be kept, got %v", err)
+	}
+	if err := d.removeStageInfo(volumeId, stagingPath); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if _, err := d.readStageInfo(volumeId); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stage info to be removed, got %v", err)
+	}
+	if err := d.removeStageInfo(volumeId, stagingPath); err != nil {
+		t.Fatalf("Expected remove of missing stage info to succeed, got %v", err)
+	}
+}
+
+func TestStageInfoFileName(t *testing.T) {
+	if name := stageInfoFileName("SVC:600507681083"); name != "SVC:600507681083.json" {
+		t.Fatalf("Expected the volume ID as the file name, got %q", name)
+	}
+	if name := stageInfoFileName("../vol/1"); name != "..%2Fvol%2F1.json" {
+		t.Fatalf("Expected the slashes of the volume ID to be escaped, got %q", name)
+	}
+}
+
+func TestGetStageInfo(t *testing.T) {
+	testCases := []struct {
+		name         string
+		fileContent  string
+		volumeId     string
+		expStageInfo bool
+	}{
+		{
+			name:         "valid record",
+			fileContent:  `{"version": 1, "volumeId": "vol-test", "lun": 1}`,
+			volumeId:     "vol-test",
+			expStageInfo: true,
+		},
+		{
+			name:     "missing record",
+			volumeId: "vol-test",
+		},
+		{
+			name:        "record of another volume",
+			fileContent: `{"version": 1, "volumeId": "vol-other"}`,
+			volumeId:    "vol-test",
+		},
+		{
+			name:        "unsupported version",
+			fileContent: `{"version": 2, "volumeId": "vol-test"}`,
+			volumeId:    "vol-test",
+		},
+		{
+			name:        "corrupted record",
+			fileContent: `{"version": 1, "volu`,
+			volumeId:    "vol-test",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			defer host.cleanup()
+			d := newTestNodeServiceWithHost(host, nil)
+			if tc.fileContent != "" {
+				host.writeFile(filepath.Join(DefaultStageInfoDir, stageInfoFileName(tc.volumeId)), tc.fileContent)
+			}
+
+			info := d.getStageInfo(context.TODO(), tc.volumeId)
+			if tc.expStageInfo && info == nil {
+				t.Fatalf("Expected stage info, got nil")
+			}
+			if !tc.expStageInfo && info != nil {
+				t.Fatalf("Expected no stage info, got %+v", *info)
+			}
+		})
+	}
+}
+
+func TestGetStageInfoDiscovery(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	const volumeId = "SVC:6005076810830198A800000000000001"
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.mkdir("/sys/block/sdb/device/scsi_device/1:0:0:5")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb")
+	host.writeFile("/sys/block/dm-0/dev", "253:0\n")
+
+	stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+	host.writeFile("/proc/1/mountinfo", "40 22 253:0 / "+stagingPath+" rw,relatime shared:2 - xfs /dev/mapper/mpatha rw\n")
+	d := newTestNodeServiceWithHost(host, nil)
+
+	// without a record, live discovery finds the device by the WWN of the volume ID
+	info := d.getStageInfo(context.TODO(), volumeId)
+	expInfo := StageInfo{
+		Version:      stageInfoVersion,
+		VolumeId:     volumeId,
+		DevicePath:   "/dev/dm-0",
+		MultipathMap: "mpatha",
+		Wwn:          "6005076810830198a800000000000001",
+		Lun:          5,
+		FsType:       "xfs",
+	}
+	if info == nil || !reflect.DeepEqual(*info, expInfo) {
+		t.Fatalf("discovered stage info mismatches: expected %+v, got %+v", expInfo, info)
+	}
+	if info := d.getStageInfo(context.TODO(), "SVC:6005076810830198A800000000000002"); info != nil {
+		t.Fatalf("Expected no stage info of a volume without a device, got %+v", *info)
+	}
+
+	// the persisted record is preferred
+	if err := d.writeStageInfo(&StageInfo{VolumeId: volumeId, StagingPath: stagingPath, Lun: 5, Connectivity: ConnectivityFc}); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	info = d.getStageInfo(context.TODO(), volumeId)
+	if info == nil || info.Connectivity != ConnectivityFc {
+		t.Fatalf("Expected the persisted stage info, got %+v", info)
+	}
+}
+
+func TestPersistStagedVolume(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	const volumeId = "SVC:6005076810830198A800000000000001"
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb")
+	host.writeFile("/sys/block/dm-0/dev", "253:0\n")
+	host.mkdir("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+	stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+	host.writeFile("/proc/1/mountinfo", "")
+
+	d := newTestNodeServiceWithHost(host, nil)
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeId,
+		StagingTargetPath: stagingPath,
+		PublishContext:    map[string]string{PublishContextParamLun: "7", PublishContextParamConnectivity: "iscsi"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	if staged, err := d.persistStagedVolume(context.TODO(), req); err != nil || staged {
+		t.Fatalf("Expected an unmounted staging path not to be staged, got %v, err %v", staged, err)
+	}
+	if _, err := d.readStageInfo(volumeId); !os.IsNotExist(err) {
+		t.Fatalf("Expected no stage info, got %v", err)
+	}
+
+	host.writeFile("/proc/1/mountinfo", "40 22 253:0 / "+stagingPath+" rw,relatime shared:2 - ext4 /dev/mapper/mpatha rw\n")
+	if _, err := d.NodeStageVolume(context.TODO(), req); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	info, err := d.readStageInfo(volumeId)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expInfo := StageInfo{
+		Version:      stageInfoVersion,
+		VolumeId:     volumeId,
+		StagingPath:  stagingPath,
+		DevicePath:   "/dev/dm-0",
+		MultipathMap: "mpatha",
+		Wwn:          "6005076810830198a800000000000001",
+		Lun:          7,
+		Connectivity: ConnectivityIscsi,
+		FsType:       "ext4",
+	}
+	if !reflect.DeepEqual(*info, expInfo) {
+		t.Fatalf("stage info mismatches: expected %+v, got %+v", expInfo, *info)
+	}
+}
+
+func TestNewStageInfo(t *testing.T) {
+	d := newTestNodeService(nil)
+	d.configYaml.Controller.Publish_context_lun_parameter = PublishContextParamLun
+	d.configYaml.Controller.Publish_context_connectivity_parameter = PublishContextParamConnectivity
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-test",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount/",
+		PublishContext:    map[string]string{PublishContextParamLun: "7", PublishContextParamConnectivity: "iscsi"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs", MountFlags: []string{"noatime"}},
+			},
+		},
+	}
+
+	info, err := d.newStageInfo(req)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expInfo := StageInfo{
+		Version:      stageInfoVersion,
+		VolumeId:     "vol-test",
+		StagingPath:  "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount",
+		Lun:          7,
+		Connectivity: "iscsi",
+		FsType:       "xfs",
+		MountOptions: []string{"noatime"},
+	}
+	if !reflect.DeepEqual(*info, expInfo) {
+		t.Fatalf("stage info mismatches: expected %+v, got %+v", expInfo, *info)
+	}
+
+	req.PublishContext[PublishContextParamLun] = "not-a-lun"
+	if _, err := d.newStageInfo(req); err == nil {
+		t.Fatalf("Expected error for invalid LUN")
+	}
+}
@@ -0,0 +1,246 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	journal "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/journal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const stageTestVolumeId = "SVC:6005076810830198A800000000000001"
+
+func newStageTestHost(t *testing.T) *fakeHost {
+	host := newFakeHost(t)
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addScsiDevice("sdc", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.addMultipathDevice("dm-0", "mpatha", "36005076810830198a800000000000001", "sdb", "sdc")
+	host.writeFile("/sys/block/dm-0/dev", "253:0\n")
+	host.writeFile("/proc/1/mountinfo", "")
+	return host
+}
+
+func newStageTestJournal(t *testing.T) (*journal.Journal, func()) {
+	dir, err := ioutil.TempDir("", "journal-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	j, err := journal.NewJournal(dir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	return j, func() { os.RemoveAll(dir) }
+}
+
+func newStageRequest(stagingPath string, connectivity string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          stageTestVolumeId,
+		StagingTargetPath: stagingPath,
+		PublishContext:    map[string]string{PublishContextParamLun: "7", PublishContextParamConnectivity: connectivity},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"noatime"}}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+func TestStageVolume(t *testing.T) {
+	noFileSystem := &executor.CommandError{Command: "blkid", ExitCode: blkidNoMatchExitCode, Err: errors.New("exit status 2")}
+	testCases := []struct {
+		name         string
+		connectivity string
+		script       func(devicePath string, stagingPath string) []executor.FakeCommand
+		expErrCode   codes.Code
+		expScanned   bool
+	}{
+		{
+			name:         "iSCSI volume without a file system",
+			connectivity: ConnectivityIscsi,
+			script: func(devicePath string, stagingPath string) []executor.FakeCommand {
+				return []executor.FakeCommand{
+					{Name: "iscsiadm", Args: []string{"-m", "session", "--rescan"}},
+					{Name: "blkid", Args: []string{"-p", "-s", "TYPE", "-o", "value", devicePath}, Err: noFileSystem},
+					{Name: "mkfs.ext4", Args: []string{"-F", devicePath}},
+					{Name: "mount", Args: []string{"-t", "ext4", "-o", "noatime", devicePath, stagingPath}},
+				}
+			},
+		},
+		{
+			name:         "FC volume with a file system",
+			connectivity: ConnectivityFc,
+			script: func(devicePath string, stagingPath string) []executor.FakeCommand {
+				return []executor.FakeCommand{
+					{Name: "blkid", Args: []string{"-p", "-s", "TYPE", "-o", "value", devicePath}, Stdout: "ext4\n"},
+					{Name: "mount", Args: []string{"-t", "ext4", "-o", "noatime", devicePath, stagingPath}},
+				}
+			},
+			expScanned: true,
+		},
+		{
+			name:         "volume with a file system of another type",
+			connectivity: ConnectivityIscsi,
+			script: func(devicePath string, stagingPath string) []executor.FakeCommand {
+				return []executor.FakeCommand{
+					{Name: "iscsiadm", Args: []string{"-m", "session", "--rescan"}},
+					{Name: "blkid", Args: []string{"-p", "-s", "TYPE", "-o", "value", devicePath}, Stdout: "xfs\n"},
+				}
+			},
+			expErrCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := newStageTestHost(t)
+			defer host.cleanup()
+			host.mkdir(fcHostPath + "/host3")
+			host.mkdir(scsiHostPath + "/host3")
+			j, cleanup := newStageTestJournal(t)
+			defer cleanup()
+			stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+
+			fakeExec := executor.NewFakeExecutor(tc.script("/dev/dm-0", stagingPath)...)
+			d := newTestNodeServiceWithHost(host, fakeExec)
+			d.journal = j
+
+			_, err := d.NodeStageVolume(context.TODO(), newStageRequest(stagingPath, tc.connectivity))
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("Expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if err := fakeExec.Verify(); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if pending, err := j.Pending(); err != nil || len(pending) != 0 {
+				t.Fatalf("Expected no pending operations, got %v, err %v", pending, err)
+			}
+			scan, _ := ioutil.ReadFile(filepath.Join(host.root, scsiHostPath, "host3/scan"))
+			if tc.expScanned != (string(scan) == "- - 7") {
+				t.Fatalf("Expected FC host scanned %v, got scan %q", tc.expScanned, scan)
+			}
+
+			info, err := d.readStageInfo(stageTestVolumeId)
+			if tc.expErrCode != codes.OK {
+				if !os.IsNotExist(err) {
+					t.Fatalf("Expected no stage info, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			expInfo := StageInfo{
+				Version:      stageInfoVersion,
+				VolumeId:     stageTestVolumeId,
+				StagingPath:  stagingPath,
+				DevicePath:   "/dev/dm-0",
+				MultipathMap: "mpatha",
+				Wwn:          "6005076810830198a800000000000001",
+				Lun:          7,
+				Connectivity: tc.connectivity,
+				FsType:       "ext4",
+				MountOptions: []string{"noatime"},
+			}
+			if !reflect.DeepEqual(*info, expInfo) {
+				t.Fatalf("stage info mismatches: expected %+v, got %+v", expInfo, *info)
+			}
+		})
+	}
+}
+
+func TestStageVolumeWithoutMultipathMap(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+	host.addScsiDevice("sdb", "IBM", "2145", "naa.6005076810830198a800000000000001")
+	host.writeFile("/proc/1/mountinfo", "")
+	defer func(timeout, interval time.Duration) { deviceWaitTimeout, devicePollInterval = timeout, interval }(deviceWaitTimeout, devicePollInterval)
+	deviceWaitTimeout, devicePollInterval = 20*time.Millisecond, 5*time.Millisecond
+
+	fakeExec := executor.NewFakeExecutor(executor.FakeCommand{Name: "iscsiadm", Args: []string{"-m", "session", "--rescan"}})
+	d := newTestNodeServiceWithHost(host, fakeExec)
+	stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+
+	_, err := d.NodeStageVolume(context.TODO(), newStageRequest(stagingPath, ConnectivityIscsi))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected a timeout waiting for the multipath map, got %v", err)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestUnstageVolume(t *testing.T) {
+	host := newStageTestHost(t)
+	defer host.cleanup()
+	j, cleanup := newStageTestJournal(t)
+	defer cleanup()
+	stagingPath := filepath.Join(host.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount")
+	host.writeFile("/proc/1/mountinfo", "40 22 253:0 / "+stagingPath+" rw,relatime shared:2 - ext4 /dev/dm-0 rw\n")
+
+	fakeExec := executor.NewFakeExecutor(executor.FakeCommand{Name: "umount", Args: []string{stagingPath}})
+	d := newTestNodeServiceWithHost(host, fakeExec)
+	d.journal = j
+	if err := d.writeStageInfo(&StageInfo{VolumeId: stageTestVolumeId, StagingPath: stagingPath, DevicePath: "/dev/dm-0", MultipathMap: "mpatha"}); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: stageTestVolumeId, StagingTargetPath: stagingPath}
+
+	// the host mount table of the fake executor still has the staging path, the device is kept
+	if _, err := d.NodeUnstageVolume(context.TODO(), req); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := d.readStageInfo(stageTestVolumeId); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stage info to be removed, got %v", err)
+	}
+
+	// once unmounted, the device of the volume is removed
+	host.writeFile("/proc/1/mountinfo", "")
+	fakeExec = executor.NewFakeExecutor(
+		executor.FakeCommand{Name: "dmsetup", Args: []string{"info", "-c", "--noheadings", "-o", "open", "mpatha"}, Stdout: "0\n"},
+		executor.FakeCommand{Name: "multipath", Args: []string{"-f", "mpatha"}},
+		executor.FakeCommand{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdb"}},
+		executor.FakeCommand{Name: "blockdev", Args: []string{"--flushbufs", "/dev/sdc"}},
+	)
+	d.executor = fakeExec
+	if _, err := d.NodeUnstageVolume(context.TODO(), req); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if err := fakeExec.Verify(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, disk := range []string{"sdb", "sdc"} {
+		if content, err := ioutil.ReadFile(filepath.Join(host.root, "sys/block", disk, "device/delete")); err != nil || string(content) != "1" {
+			t.Fatalf("Expected %s to be deleted, got %q, err %v", disk, content, err)
+		}
+	}
+	if pending, err := j.Pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("Expected no pending operations, got %v, err %v", pending, err)
+	}
+}
@@ -0,0 +1,159 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+)
+
+// newEndpointCerts returns the certificates of the endpoint, or nil for a unix socket. A tcp://
+// endpoint without TLS is allowed only with the InsecureTCP option.
+func newEndpointCerts(options DriverOptions) (*certReloader, error) {
+	isTCP := strings.HasPrefix(strings.ToLower(options.Endpoint), "tcp://")
+	if options.TLSCertFile == "" && options.TLSKeyFile == "" {
+		if options.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("a TLS client CA bundle requires a TLS certificate and key")
+		}
+		if isTCP && !options.InsecureTCP {
+			return nil, fmt.Errorf("TCP endpoint %s requires a TLS certificate and key, or explicitly allowing plaintext TCP", options.Endpoint)
+		}
+		return nil, nil
+	}
+	if !isTCP {
+		return nil, fmt.Errorf("TLS is supported only on tcp:// endpoints, got %s", options.Endpoint)
+	}
+	return newCertReloader(options.TLSCertFile, options.TLSKeyFile, options.TLSClientCAFile)
+}
+
+// certReloader serves the TLS certificate and client CA bundle of the endpoint and loads them again
+// when one of the files changes, so rotated certificates are used without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	// caFile is the CA bundle client certificates are verified with, empty disables mutual TLS
+	caFile string
+
+	mu       sync.Mutex
+	config   *tls.Config
+	modTimes map[string]time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and a key file are required")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the server TLS config, it picks up the latest certificate on every handshake.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// current returns the config of the latest files, a failed reload keeps the previous config.
+func (r *certReloader) current() *tls.Config {
+	r.mu.Lock()
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if changed {
+		if err := r.reload(); err != nil {
+			logging.Errorf("Failed to reload the TLS certificates, keeping the previous ones: %v", err)
+		} else {
+			logging.Infof("Reloaded the TLS certificates from %s", r.certFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+func (r *certReloader) reload() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	// Files that fail to load are not tried again until they change
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate %s: %v", r.certFile, err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+	if r.caFile != "" {
+		caBundle, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBundle) {
+			return fmt.Errorf("no CA certificates found in %s", r.caFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+	return nil
+}
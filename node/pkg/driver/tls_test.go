@@ -0,0 +1,204 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeTestFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("Cannot write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Cannot change times of %s: %v", path, err)
+	}
+}
+
+// handshake connects to the listener and returns the common name of the server certificate.
+func handshake(listener net.Listener, config *tls.Config) (string, error) {
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// TLS 1.3 reports a rejected client certificate on the first read
+	if _, err := conn.Read(make([]byte, 1)); err != nil && err.Error() != "EOF" {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "node-1", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "csi-client", 3, x509.ExtKeyUsageClientAuth)
+	modTime := time.Now().Add(-time.Minute)
+	writeTestFile(t, certFile, serverCert, modTime)
+	writeTestFile(t, keyFile, serverKey, modTime)
+	writeTestFile(t, caFile, ca.pem, modTime)
+
+	reloader, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig())
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	defer listener.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	client, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	mtlsConfig := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client}}
+
+	if name, err := handshake(listener, mtlsConfig); err != nil || name != "node-1" {
+		t.Fatalf("Expected a handshake with node-1, got %q, %v", name, err)
+	}
+	if _, err := handshake(listener, &tls.Config{RootCAs: roots}); err == nil {
+		t.Fatalf("Expected a handshake without a client certificate to fail")
+	}
+
+	rotatedCert, rotatedKey := ca.issue(t, "node-1-rotated", 4, x509.ExtKeyUsageServerAuth)
+	writeTestFile(t, certFile, rotatedCert, time.Now())
+	writeTestFile(t, keyFile, rotatedKey, time.Now())
+	if name, err := handshake(listener, mtlsConfig); err != nil || name != "node-1-rotated" {
+		t.Fatalf("Expected a handshake with the rotated certificate, got %q, %v", name, err)
+	}
+
+	// a broken certificate keeps the previous one
+	writeTestFile(t, certFile, []byte("not a certificate"), time.Now().Add(time.Minute))
+	if name, err := handshake(listener, mtlsConfig); err != nil || name != "node-1-rotated" {
+		t.Fatalf("Expected a handshake with the previous certificate, got %q, %v", name, err)
+	}
+}
+
+func TestNewEndpointCerts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options DriverOptions
+		expErr  bool
+	}{
+		{name: "unix socket", options: DriverOptions{Endpoint: "unix://csi/csi.sock"}},
+		{name: "plaintext tcp", options: DriverOptions{Endpoint: "tcp://0.0.0.0:10000"}, expErr: true},
+		{name: "insecure tcp", options: DriverOptions{Endpoint: "tcp://0.0.0.0:10000", InsecureTCP: true}},
+		{name: "ca without certificate", options: DriverOptions{Endpoint: "tcp://0.0.0.0:10000", TLSClientCAFile: "/certs/ca.crt"}, expErr: true},
+		{name: "tls on unix socket", options: DriverOptions{Endpoint: "unix://csi/csi.sock", TLSCertFile: "/certs/tls.crt", TLSKeyFile: "/certs/tls.key"}, expErr: true},
+		{name: "missing key", options: DriverOptions{Endpoint: "tcp://0.0.0.0:10000", TLSCertFile: "/certs/tls.crt"}, expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certs, err := newEndpointCerts(tc.options)
+			if tc.expErr && err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if !tc.expErr && (err != nil || certs != nil) {
+				t.Fatalf("Expected no certificates and no error, got %v, %v", certs, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// TopologyKeyPrefix is the prefix of the topology keys of the driver, and of the static segments
+	// of the config that have no prefix of their own
+	TopologyKeyPrefix = "topology.block.csi.ibm.com/"
+
+	fcHostPath = "/sys/class/fc_host"
+
+	maxTopologyNameLength   = 63
+	maxTopologyPrefixLength = 253
+)
+
+var (
+	// topologyNamePattern is the Kubernetes label name and value syntax, the segments become node labels
+	topologyNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	topologyPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// readFcPortNames returns the WWPNs of the FC host ports under the fc_host class directory.
+func readFcPortNames(fcHostDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(fcHostDir)
+	if err != nil {
+		return nil, err
+	}
+	var wwpns []string
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(filepath.Join(fcHostDir, entry.Name(), "port_name"))
+		if err != nil {
+			continue
+		}
+		wwpn := normalizeWwpn(string(content))
+		if wwpn != "" {
+			wwpns = append(wwpns, wwpn)
+		}
+	}
+	if len(wwpns) == 0 {
+		return nil, fmt.Errorf("no FC host ports in %s", fcHostDir)
+	}
+	sort.Strings(wwpns)
+	return wwpns, nil
+}
+
+// topologySegmentKey returns the key of a static segment of the config, with the driver prefix if
+// it has none.
+func topologySegmentKey(key string) string {
+	if strings.Contains(key, "/") {
+		return key
+	}
+	return TopologyKeyPrefix + key
+}
+
+// topologySegments returns the static topology segments of the config. The connectivity of the node
+// is no segment, NodeGetInfo fails on nodes without an iSCSI initiator, so it would be the same on
+// every node.
+func topologySegments(config ConfigFile) map[string]string {
+	segments := map[string]string{}
+	for key, value := range config.Node.Topology.Segments {
+		segments[topologySegmentKey(key)] = value
+	}
+	return segments
+}
+
+// validateTopologySegment verifies that a static segment of the config is a valid node label and
+// does not replace a segment of the driver.
+func validateTopologySegment(key string, value string) error {
+	fullKey := topologySegmentKey(key)
+	if strings.HasPrefix(fullKey, TopologyKeyArrayPrefix) {
+		return fmt.Errorf("%s is reported by the driver", fullKey)
+	}
+	parts := strings.Split(fullKey, "/")
+	if len(parts) != 2 || len(parts[0]) > maxTopologyPrefixLength || !topologyPrefixPattern.MatchString(parts[0]) {
+		return fmt.Errorf("key %q must be a name with an optional DNS subdomain prefix", key)
+	}
+	if len(parts[1]) > maxTopologyNameLength || !topologyNamePattern.MatchString(parts[1]) {
+		return fmt.Errorf("key name %q must be at most %d letters, digits, '-', '_' and '.' between letters or digits", parts[1], maxTopologyNameLength)
+	}
+	if value == "" || len(value) > maxTopologyNameLength || !topologyNamePattern.MatchString(value) {
+		return fmt.Errorf("value %q must be 1-%d letters, digits, '-', '_' and '.' between letters or digits", value, maxTopologyNameLength)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	gomock "github.com/golang/mock/gomock"
+	mocks "github.com/ibm/ibm-block-csi-driver/node/mocks"
+	executor "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/executor"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadFcPortNames(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.cleanup()
+
+	if _, err := readFcPortNames(host.root + fcHostPath); err == nil {
+		t.Fatalf("Expected an error without the fc_host class")
+	}
+	host.mkdir(fcHostPath + "/host0")
+	if _, err := readFcPortNames(host.root + fcHostPath); err == nil {
+		t.Fatalf("Expected an error without FC host ports")
+	}
+	host.writeFile(fcHostPath+"/host3/port_name", "0x10000000C9A1B2C3\n")
+	host.writeFile(fcHostPath+"/host2/port_name", "0x10000000c9a1b2c2\n")
+
+	wwpns, err := readFcPortNames(host.root + fcHostPath)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	expWwpns := []string{"10000000c9a1b2c2", "10000000c9a1b2c3"}
+	if !reflect.DeepEqual(wwpns, expWwpns) {
+		t.Fatalf("Expected WWPNs %v, got %v", expWwpns, wwpns)
+	}
+}
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	testCases := []struct {
+		name        string
+		iscsiErr    error
+		fcPorts     bool
+		segments    map[string]string
+		expErr      codes.Code
+		expNodeId   string
+		expSegments map[string]string
+	}{
+		{
+			name:        "iscsi only",
+			expNodeId:   "test-host;iqn.1994-07.com.redhat:e123456789",
+			expSegments: map[string]string{},
+		},
+		{
+			name:        "iscsi and fc with static segments",
+			fcPorts:     true,
+			segments:    map[string]string{"site": "dal10", "example.com/rack": "r12"},
+			expNodeId:   "test-host;iqn.1994-07.com.redhat:e123456789",
+			expSegments: map[string]string{TopologyKeyPrefix + "site": "dal10", "example.com/rack": "r12"},
+		},
+		{
+			name:     "fc only",
+			iscsiErr: fmt.Errorf("no initiator name"),
+			fcPorts:  true,
+			expErr:   codes.FailedPrecondition,
+		},
+		{
+			name:     "no connectivity",
+			iscsiErr: fmt.Errorf("no initiator name"),
+			expErr:   codes.Internal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := newFakeHost(t)
+			defer host.cleanup()
+			if tc.fcPorts {
+				host.writeFile(fcHostPath+"/host0/port_name", "0x10000000c9a1b2c3\n")
+			}
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			fakeNodeUtils := mocks.NewMockNodeUtilsInterface(mockCtrl)
+			fakeNodeUtils.EXPECT().ParseIscsiInitiators(host.root+iscsiInitiatorNamePath).Return("iqn.1994-07.com.redhat:e123456789", tc.iscsiErr)
+
+			d := newTestNodeServiceWithHost(host, executor.NewFakeExecutor())
+			d.nodeUtils = fakeNodeUtils
+			d.configYaml.Node.Topology.Segments = tc.segments
+
+			res, err := d.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+			if tc.expErr != codes.OK {
+				if status.Code(err) != tc.expErr {
+					t.Fatalf("Expected error code %v, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err is not nil. got: %v", err)
+			}
+			if res.NodeId != tc.expNodeId {
+				t.Fatalf("Expected node id %s, got %s", tc.expNodeId, res.NodeId)
+			}
+			if !reflect.DeepEqual(res.AccessibleTopology.GetSegments(), tc.expSegments) {
+				t.Fatalf("Expected segments %v, got %v", tc.expSegments, res.AccessibleTopology.GetSegments())
+			}
+		})
+	}
+}
+
+func TestValidateTopologySegment(t *testing.T) {
+	testCases := []struct {
+		key    string
+		value  string
+		expErr bool
+	}{
+		{key: "site", value: "dal10"},
+		{key: "topology.kubernetes.io/zone", value: "us-south-1"},
+		{key: "rack", value: "r_12.a"},
+		{key: "array-fs-dal", value: "true", expErr: true},
+		{key: "site", value: "", expErr: true},
+		{key: "site", value: "dal 10", expErr: true},
+		{key: "site", value: strings.Repeat("a", maxTopologyNameLength+1), expErr: true},
+		{key: "-site", value: "dal10", expErr: true},
+		{key: "Example.com/site", value: "dal10", expErr: true},
+		{key: "a/b/c", value: "dal10", expErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key+"="+tc.value, func(t *testing.T) {
+			if err := validateTopologySegment(tc.key, tc.value); (err != nil) != tc.expErr {
+				t.Fatalf("Expected error %v, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Exporter names
+const (
+	ExporterNone = "none"
+	ExporterFile = "file"
+)
+
+// NewExporter returns the exporter of the name. The endpoint is the file path of ExporterFile.
+func NewExporter(name string, endpoint string) (Exporter, error) {
+	switch name {
+	case ExporterFile:
+		if endpoint == "" {
+			return nil, fmt.Errorf("the %s tracing exporter requires a file path", name)
+		}
+		return NewFileExporter(endpoint)
+	}
+	return nil, fmt.Errorf("unknown tracing exporter %q, supported exporters are %s and %s", name, ExporterNone, ExporterFile)
+}
+
+// FileExporter appends the spans as JSON lines to a local file.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) ExportSpans(ctx context.Context, serviceName string, spans []*Span) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, span := range spans {
+		span.mu.Lock()
+		err := encoder.Encode(span)
+		span.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
@@ -0,0 +1,318 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tracing records spans of the node operations and exports them in batches as JSON lines to
+// a local file.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Span attributes of the node operations
+const (
+	AttrRpcMethod    = "rpc.method"
+	AttrRpcCode      = "rpc.grpc.status_code"
+	AttrVolumeId     = "csi.volume_id"
+	AttrNodeId       = "csi.node_id"
+	AttrRequestId    = "csi.request_id"
+	AttrLun          = "storage.lun"
+	AttrWwn          = "storage.wwn"
+	AttrDevice       = "storage.device"
+	AttrConnectivity = "storage.connectivity"
+	AttrCommand      = "host.command"
+)
+
+// Span kinds, with the values of OpenTelemetry
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 5 * time.Second
+	defaultQueueSize     = 2048
+)
+
+// inheritedAttributes are copied from the parent span to a child span when it starts, so the spans
+// of the host commands of a volume carry its LUN, WWN and device.
+var inheritedAttributes = []string{AttrVolumeId, AttrLun, AttrWwn, AttrDevice, AttrConnectivity}
+
+// Span is one timed operation of a trace. A nil *Span is valid and records nothing, it is what
+// StartSpan returns when tracing is disabled.
+type Span struct {
+	TraceId      string            `json:"traceId"`
+	SpanId       string            `json:"spanId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Kind         int               `json:"kind"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+
+	mu     sync.Mutex
+	tracer *Tracer
+	ended  bool
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// RecordError marks the span as failed with the error, a nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export, only the first call has an effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = s.tracer.now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(ctx context.Context, serviceName string, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and exports them in batches in the background.
+type Tracer struct {
+	serviceName   string
+	exporter      Exporter
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan *Span
+	flushCh       chan chan struct{}
+	stopCh        chan struct{}
+	doneCh        chan struct{}
+	now           func() time.Time
+}
+
+// NewTracer returns a tracer that exports the spans of the service with the exporter.
+func NewTracer(serviceName string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		serviceName:   serviceName,
+		exporter:      exporter,
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		queue:         make(chan *Span, defaultQueueSize),
+		flushCh:       make(chan chan struct{}),
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+		now:           time.Now,
+	}
+	go t.run()
+	return t
+}
+
+var (
+	globalMu     sync.RWMutex
+	globalTracer *Tracer
+)
+
+// SetTracer makes the tracer the one StartSpan uses, nil disables tracing.
+func SetTracer(t *Tracer) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	globalTracer = t
+}
+
+func getTracer() *Tracer {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return globalTracer
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span of the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts an internal span as a child of the current span of the context, with the
+// inherited attributes of the parent span, and returns a context with the new span. It returns the context unchanged and a nil span when tracing is disabled.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, SpanKindInternal)
+}
+
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := getTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Kind: kind, Start: t.now(), SpanId: newId(8), tracer: t}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+		parent.mu.Lock()
+		for _, key := range inheritedAttributes {
+			if value, ok := parent.Attributes[key]; ok {
+				if span.Attributes == nil {
+					span.Attributes = map[string]string{}
+				}
+				span.Attributes[key] = value
+			}
+		}
+		parent.mu.Unlock()
+	} else {
+		span.TraceId = newId(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func newId(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// UnaryServerInterceptor starts a server span for every RPC. It has to run after the logging
+// interceptor to pick up the request fields.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		ctx, span := startSpan(ctx, method, SpanKindServer)
+		if span == nil {
+			return handler(ctx, req)
+		}
+		defer span.Finish()
+
+		span.SetAttribute(AttrRpcMethod, info.FullMethod)
+		fields := logging.FieldsFromContext(ctx)
+		for key, value := range map[string]string{AttrRequestId: fields.RequestId, AttrVolumeId: fields.VolumeId, AttrNodeId: fields.NodeId} {
+			if value != "" {
+				span.SetAttribute(key, value)
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		span.SetAttribute(AttrRpcCode, status.Code(err).String())
+		span.RecordError(err)
+		return resp, err
+	}
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		logging.V(4).Infof("Tracing queue is full, dropping span %s", span.Name)
+	}
+}
+
+// run exports the queued spans when a batch is full, every flush interval and on Flush and Shutdown.
+func (t *Tracer) run() {
+	defer close(t.doneCh)
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+	drain:
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(context.Background(), t.serviceName, batch); err != nil {
+			logging.Warningf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flushCh:
+			export()
+			close(done)
+		case <-t.stopCh:
+			export()
+			return
+		}
+	}
+}
+
+// Flush exports the spans finished so far.
+func (t *Tracer) Flush() {
+	done := make(chan struct{})
+	select {
+	case t.flushCh <- done:
+		<-done
+	case <-t.doneCh:
+	}
+}
+
+// Shutdown exports the remaining spans and shuts the exporter down.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	close(t.stopCh)
+	select {
+	case <-t.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Shutdown(ctx)
+}
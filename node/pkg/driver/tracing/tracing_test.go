@@ -0,0 +1,167 @@
+/**
+ * Copyright 2019 IBM Corp.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	logging "github.com/ibm/ibm-block-csi-driver/node/pkg/driver/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(ctx context.Context, serviceName string, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func withTracer(t *testing.T, exporter Exporter) (*Tracer, func()) {
+	tracer := NewTracer("ibm-block-csi-driver", exporter)
+	SetTracer(tracer)
+	return tracer, func() {
+		SetTracer(nil)
+		if err := tracer.Shutdown(context.TODO()); err != nil {
+			t.Fatalf("err is not nil. got: %v", err)
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer, restore := withTracer(t, exporter)
+	defer restore()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		SpanFromContext(ctx).SetAttribute(AttrLun, "1")
+		_, span := StartSpan(ctx, "exec iscsiadm")
+		span.SetAttribute(AttrCommand, "iscsiadm")
+		span.Finish()
+		return nil, status.Error(codes.NotFound, "volume not found")
+	}
+	ctx := logging.WithFields(context.TODO(), logging.Fields{RequestId: "req-1", VolumeId: "vol-1", NodeId: "node-1"})
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	if _, err := UnaryServerInterceptor()(ctx, nil, info, handler); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected the handler error, got %v", err)
+	}
+	tracer.Flush()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(exporter.spans))
+	}
+	child, server := exporter.spans[0], exporter.spans[1]
+	if server.Name != "NodeStageVolume" || server.Kind != SpanKindServer || server.ParentSpanId != "" {
+		t.Fatalf("Unexpected server span %+v", server)
+	}
+	if child.TraceId != server.TraceId || child.ParentSpanId != server.SpanId || child.Kind != SpanKindInternal {
+		t.Fatalf("Expected %+v to be a child of %+v", child, server)
+	}
+	expAttributes := map[string]string{
+		AttrRpcMethod: "/csi.v1.Node/NodeStageVolume",
+		AttrRpcCode:   "NotFound",
+		AttrRequestId: "req-1",
+		AttrVolumeId:  "vol-1",
+		AttrNodeId:    "node-1",
+	}
+	for key, value := range expAttributes {
+		if server.Attributes[key] != value {
+			t.Fatalf("Expected attribute %s=%s, got %v", key, value, server.Attributes)
+		}
+	}
+	if !strings.Contains(server.Error, "volume not found") {
+		t.Fatalf("Unexpected server span %+v", server)
+	}
+	// the exec span inherits the volume attributes of the server span, not the others
+	expChildAttributes := map[string]string{AttrVolumeId: "vol-1", AttrLun: "1", AttrCommand: "iscsiadm"}
+	if !reflect.DeepEqual(child.Attributes, expChildAttributes) {
+		t.Fatalf("Expected child attributes %v, got %v", expChildAttributes, child.Attributes)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := StartSpan(context.TODO(), "exec multipath")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatalf("Expected no span without a tracer")
+	}
+	span.SetAttribute(AttrWwn, "6005076810830198a800000000000001")
+	span.RecordError(fmt.Errorf("failed"))
+	span.Finish()
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+
+	exporter, err := NewExporter(ExporterFile, path)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	tracer, restore := withTracer(t, exporter)
+	_, span := StartSpan(context.TODO(), "exec mkfs.ext4")
+	span.SetAttribute(AttrDevice, "/dev/dm-0")
+	span.Finish()
+	tracer.Flush()
+	restore()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	var exported Span
+	if err := json.Unmarshal(content, &exported); err != nil {
+		t.Fatalf("Cannot decode %s: %v", content, err)
+	}
+	if exported.Name != "exec mkfs.ext4" || exported.Attributes[AttrDevice] != "/dev/dm-0" || exported.End.Before(exported.Start) {
+		t.Fatalf("Unexpected exported span %+v", &exported)
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	for _, tc := range []struct{ name, endpoint string }{
+		{ExporterFile, ""},
+		{"otlp", "http://otel-collector:4318"},
+		{"jaeger", "http://localhost:14268"},
+	} {
+		if _, err := NewExporter(tc.name, tc.endpoint); err == nil {
+			t.Fatalf("Expected an error for exporter %q with endpoint %q", tc.name, tc.endpoint)
+		}
+	}
+}
@@ -18,11 +18,21 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// socketProbeTimeout bounds the check for a live server on an existing socket
+	socketProbeTimeout = time.Second
 )
 
 func ParseEndpoint(endpoint string) (string, string, error) {
@@ -38,12 +48,147 @@ func ParseEndpoint(endpoint string) (string, string, error) {
 	case "tcp":
 	case "unix":
 		addr = path.Join("/", addr)
-		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return "", "", fmt.Errorf("could not remove unix domain socket %q: %v", addr, err)
-		}
 	default:
 		return "", "", fmt.Errorf("unsupported protocol: %s", scheme)
 	}
 
 	return scheme, addr, nil
 }
+
+// RemoveStaleSocket removes the unix domain socket left behind by a previous server at path. It
+// refuses to remove anything that is not a socket, and a socket another server still listens on.
+func RemoveStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %q, it is not a unix domain socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another server is listening on unix domain socket %q", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove unix domain socket %q: %v", path, err)
+	}
+	return nil
+}
+
+// SetSocketPermissions sets the mode of the socket at path, and its group when group is not empty.
+// The group is a group name or a numeric group id.
+func SetSocketPermissions(path string, mode os.FileMode, group string) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("could not change the mode of unix domain socket %q: %v", path, err)
+	}
+	if group == "" {
+		return nil
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %s has a non numeric id %q", group, g.Gid)
+		}
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		return fmt.Errorf("could not change the group of unix domain socket %q: %v", path, err)
+	}
+	return nil
+}
+
+// ListenUnixSocket listens on a unix domain socket at path that has the mode and group from the
+// start. The socket is created in a directory next to path that only the owner can enter, and moved
+// to path once its permissions are set. Path is checked again right before the move, anything there
+// but a stale socket is left alone and fails the listen.
+func ListenUnixSocket(path string, mode os.FileMode, group string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create a private directory for unix domain socket %q: %v", path, err)
+	}
+	defer os.RemoveAll(dir)
+
+	privatePath := filepath.Join(dir, filepath.Base(path))
+	listener, err := net.Listen("unix", privatePath)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is moved away, whoever removes path removes it
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := SetSocketPermissions(privatePath, mode, group); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// something may have been created at path since the caller removed the stale socket
+	if err := RemoveStaleSocket(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(privatePath, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not move unix domain socket to %q: %v", path, err)
+	}
+	return listener, nil
+}
+
+// HostRoot is the directory the host root file system is mounted on inside the driver container.
+// Every lookup of a host file (/etc/iscsi, /sys, /dev, /proc ...) should go through it, so the
+// driver can run with the host mounted at e.g. /host and tests can use a synthetic tree.
+// An empty HostRoot or "/" means the container sees the host paths as is.
+type HostRoot string
+
+// Path returns the location of the absolute host path inside the container.
+func (r HostRoot) Path(hostPath string) string {
+	if r == "" || r == "/" {
+		return hostPath
+	}
+	return filepath.Join(string(r), hostPath)
+}
+
+// WriteFileAtomic replaces the file at path with data, so readers see either the previous or the new
+// content even if the process dies in the middle: data is written to a temporary file in the same
+// directory, synced and then renamed over path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %s: %v", dir, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // no-op after a successful rename
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to chmod %s: %v", tmpPath, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync %s: %v", tmpPath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmpPath, path, err)
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
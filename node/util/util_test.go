@@ -18,6 +18,11 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -79,3 +84,182 @@ func TestParseEndpoint(t *testing.T) {
 	}
 
 }
+
+func TestHostRootPath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hostRoot HostRoot
+		path     string
+		expPath  string
+	}{
+		{
+			name:    "empty host root",
+			path:    "/etc/iscsi/initiatorname.iscsi",
+			expPath: "/etc/iscsi/initiatorname.iscsi",
+		},
+		{
+			name:     "slash host root",
+			hostRoot: "/",
+			path:     "/sys/class/scsi_host",
+			expPath:  "/sys/class/scsi_host",
+		},
+		{
+			name:     "host mounted under /host",
+			hostRoot: "/host",
+			path:     "/etc/iscsi/initiatorname.iscsi",
+			expPath:  "/host/etc/iscsi/initiatorname.iscsi",
+		},
+		{
+			name:     "host root with trailing slash",
+			hostRoot: "/tmp/fake-host/",
+			path:     "/dev/disk/by-id",
+			expPath:  "/tmp/fake-host/dev/disk/by-id",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if path := tc.hostRoot.Path(tc.path); path != tc.expPath {
+				t.Fatalf("path mismatches: expected %v, got %v", tc.expPath, path)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listen := func(path string) *net.UnixListener {
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatalf("Cannot listen on %s: %v", path, err)
+		}
+		return listener
+	}
+
+	if err := RemoveStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+
+	regular := filepath.Join(dir, "regular.sock")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0600); err != nil {
+		t.Fatalf("Cannot write %s: %v", regular, err)
+	}
+	if err := RemoveStaleSocket(regular); err == nil {
+		t.Fatalf("Expected an error for a regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Fatalf("Expected %s to be kept, got %v", regular, err)
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	listener := listen(live)
+	defer listener.Close()
+	if err := RemoveStaleSocket(live); err == nil {
+		t.Fatalf("Expected an error for a socket with a live server")
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	staleListener := listen(stale)
+	staleListener.SetUnlinkOnClose(false)
+	staleListener.Close()
+	if err := RemoveStaleSocket(stale); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", stale, err)
+	}
+}
+
+func TestSetSocketPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "csi.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %v", path, err)
+	}
+	defer listener.Close()
+
+	if err := SetSocketPermissions(path, 0660, strconv.Itoa(os.Getgid())); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected mode 0660, got %v", info.Mode().Perm())
+	}
+	if err := SetSocketPermissions(path, 0660, "no-such-group-ibm-csi"); err == nil {
+		t.Fatalf("Expected an error for an unknown group")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket-")
+	if err != nil {
+		t.Fatalf("Cannot create temporary dir : %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "csi.sock")
+
+	listener, err := ListenUnixSocket(path, 0600, strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	defer listener.Close()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a socket with mode 0600, got %v", info.Mode())
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Cannot connect to %s: %v", path, err)
+	}
+	conn.Close()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the socket in %s, got %d files", dir, len(files))
+	}
+
+	// the socket of a live server is not replaced
+	if _, err := ListenUnixSocket(path, 0600, ""); err == nil {
+		t.Fatalf("Expected an error for the socket of a live server")
+	}
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Cannot connect to %s: %v", path, err)
+	}
+	conn.Close()
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0600); err != nil {
+		t.Fatalf("err is not nil. got: %v", err)
+	}
+	if _, err := ListenUnixSocket(regular, 0600, ""); err == nil {
+		t.Fatalf("Expected an error for a regular file")
+	}
+	if content, err := ioutil.ReadFile(regular); err != nil || string(content) != "data" {
+		t.Fatalf("Expected the regular file to be kept, got %q, err %v", content, err)
+	}
+
+	if _, err := ListenUnixSocket(path+"-bad", 0600, "no-such-group-ibm-csi"); err == nil {
+		t.Fatalf("Expected an error for an unknown group")
+	}
+	if _, err := os.Lstat(path + "-bad"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no socket after a failure, got %v", err)
+	}
+}